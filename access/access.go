@@ -0,0 +1,200 @@
+// Access rules of the bots - who gets to have their updates published.
+
+// Rules are per bot, from the bot profile or set at runtime through the api. Runtime rules replace the ones in the profile until deleted.
+// Updates that match any of the deny list are rejected, then the ones that arent private when the bot is private only,
+// then the ones that dont match any of the allow list - when there is one. Everything else is accepted.
+package access
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+)
+
+const (
+	OnRejectDrop  = "drop"  // rejected updates are not published
+	OnRejectRoute = "route" // rejected updates are published under the rejected topic of the bot
+)
+
+// Reasons the update was rejected for
+const (
+	ReasonDenied     = "denied"
+	ReasonNotPrivate = "not_private"
+	ReasonNotAllowed = "not_allowed"
+)
+
+var chatTypes = []string{"private", "group", "supergroup", "channel"}
+
+// RejectedTopic : topic the rejected updates of the bot are published under, when the rules route them
+func RejectedTopic(botid string) string {
+	return botid + ".rejected"
+}
+
+// Match : who the rule is for, the update matches when it meets all that are set
+type Match struct {
+	ChatID   int64  `yaml:"chat_id" json:"chat_id,omitempty"`
+	ChatType string `yaml:"chat_type" json:"chat_type,omitempty"` // private, group, supergroup or channel
+	SenderID int64  `yaml:"sender_id" json:"sender_id,omitempty"`
+	Username string `yaml:"username" json:"username,omitempty"` // of the sender, case insensitive, with or without the @
+}
+
+func (m Match) validate() error {
+	if m == (Match{}) {
+		return fmt.Errorf("empty match, at least one of chat_id, chat_type, sender_id or username is required")
+	}
+	if m.ChatType != "" && !contains(chatTypes, m.ChatType) {
+		return fmt.Errorf("unknown chat type %q, expected one of %s", m.ChatType, strings.Join(chatTypes, ", "))
+	}
+	return nil
+}
+
+func (m Match) matches(u models.Update) bool {
+	chat, from := u.Chat(), u.From()
+	if m.ChatID != 0 {
+		if id, _ := chat.ChatID.Int64(); id != m.ChatID {
+			return false
+		}
+	}
+	if m.ChatType != "" && chat.Typ != m.ChatType {
+		return false
+	}
+	if m.SenderID != 0 {
+		if id, _ := from.SenderID.Int64(); id != m.SenderID {
+			return false
+		}
+	}
+	if m.Username != "" && !strings.EqualFold(strings.TrimPrefix(m.Username, "@"), from.UName) {
+		return false
+	}
+	return true
+}
+
+// Rules : access rules of a bot
+type Rules struct {
+	PrivateOnly bool    `yaml:"private_only" json:"private_only"` // only updates from private chats with the bot are accepted
+	Allow       []Match `yaml:"allow" json:"allow"`               // when not empty, only updates that match any of these are accepted
+	Deny        []Match `yaml:"deny" json:"deny"`                 // updates that match any of these are rejected, even if allowed
+	OnReject    string  `yaml:"on_reject" json:"on_reject"`       // drop or route, drop when empty
+	Reply       string  `yaml:"reply" json:"reply,omitempty"`     // sent back to the chat of the rejected update, empty for no reply
+}
+
+// Validate : all the matches are valid and on_reject is known
+func (r Rules) Validate() error {
+	if r.OnReject != "" && r.OnReject != OnRejectDrop && r.OnReject != OnRejectRoute {
+		return fmt.Errorf("unknown on_reject %q, expected %s or %s", r.OnReject, OnRejectDrop, OnRejectRoute)
+	}
+	for i, m := range r.Allow {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("allow[%d]: %s", i, err)
+		}
+	}
+	for i, m := range r.Deny {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("deny[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Routes : true if the rejected updates are published under the rejected topic instead of being dropped
+func (r Rules) Routes() bool {
+	return r.OnReject == OnRejectRoute
+}
+
+// Check : empty reason when the update is accepted, else why it was rejected
+func (r Rules) Check(u models.Update) string {
+	for _, m := range r.Deny {
+		if m.matches(u) {
+			return ReasonDenied
+		}
+	}
+	if r.PrivateOnly && u.Chat().Typ != "private" {
+		return ReasonNotPrivate
+	}
+	if len(r.Allow) == 0 {
+		return ""
+	}
+	for _, m := range r.Allow {
+		if m.matches(u) {
+			return ""
+		}
+	}
+	return ReasonNotAllowed
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Store : rules set at runtime for each bot, and when each chat was last replied to. Safe for concurrent use
+type Store struct {
+	mu      sync.Mutex
+	rules   map[string]Rules
+	replied map[string]time.Time // bot/chat to when the reply was sent
+}
+
+// NewStore : store without any runtime rules, all bots follow their profiles
+func NewStore() *Store {
+	return &Store{rules: map[string]Rules{}, replied: map[string]time.Time{}}
+}
+
+// Get : runtime rules of the bot, false when the bot follows its profile
+func (s *Store) Get(botid string) (Rules, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rules[botid]
+	return r, ok
+}
+
+// Set : rules replace the ones from the profile of the bot, errors if the rules arent valid
+func (s *Store) Set(botid string, r Rules) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[botid] = r
+	return nil
+}
+
+// Delete : bot goes back to the rules of its profile, false if there werent any runtime rules
+func (s *Store) Delete(botid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rules[botid]
+	delete(s.rules, botid)
+	return ok
+}
+
+// ReplyDue : true if the chat wasnt replied to within every.
+// Someone who keeps messaging the bot gets the reply once in a while, not for each message
+func (s *Store) ReplyDue(botid string, chatID int64, every time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, at := range s.replied {
+		if now.Sub(at) >= every {
+			delete(s.replied, k)
+		}
+	}
+	_, ok := s.replied[replyKey(botid, chatID)]
+	return !ok
+}
+
+// MarkReplied : reply to the chat taken as sent at now, call once the reply is queued - a reply that fails is due again
+func (s *Store) MarkReplied(botid string, chatID int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replied[replyKey(botid, chatID)] = now
+}
+
+func replyKey(botid string, chatID int64) string {
+	return fmt.Sprintf("%s/%d", botid, chatID)
+}
@@ -0,0 +1,81 @@
+package access
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const bot = "6425245255"
+
+func update(chat, typ, from, username string) models.Update {
+	return models.Update{UpdtID: "100", Message: &models.UpdateMessage{
+		Text: "hello", Chat: models.Chat{ChatID: json.Number(chat), Typ: typ},
+		From: models.Sender{SenderID: json.Number(from), UName: username},
+	}}
+}
+
+func TestCheck(t *testing.T) {
+	alice := update("5157350442", "private", "5157350442", "alice")
+	bob := update("7001", "private", "7001", "Bob")
+	group := update("-1001", "group", "5157350442", "alice")
+	other := update("-2002", "supergroup", "7002", "mallory")
+
+	none := Rules{}
+	for _, u := range []models.Update{alice, bob, group, other} {
+		assert.Equal(t, "", none.Check(u), "Expected all accepted without rules")
+	}
+
+	r := Rules{Allow: []Match{{SenderID: 5157350442}, {Username: "@bob"}, {ChatID: -2002, ChatType: "supergroup"}}}
+	assert.Equal(t, "", r.Check(alice))
+	assert.Equal(t, "", r.Check(bob), "Usernames are case insensitive, @ is optional")
+	assert.Equal(t, "", r.Check(group), "Allowed sender in any chat")
+	assert.Equal(t, "", r.Check(other))
+	assert.Equal(t, ReasonNotAllowed, r.Check(update("7003", "private", "7003", "eve")))
+
+	r.Deny = []Match{{Username: "mallory"}}
+	assert.Equal(t, ReasonDenied, r.Check(other), "Deny takes precedence over allow")
+	r.PrivateOnly = true
+	assert.Equal(t, ReasonNotPrivate, r.Check(group))
+	assert.Equal(t, "", r.Check(alice))
+	assert.Equal(t, ReasonNotPrivate, r.Check(models.Update{UpdtID: "101"}), "Updates without a chat arent private")
+}
+
+func TestValidate(t *testing.T) {
+	for _, bad := range []Rules{
+		{OnReject: "bounce"},
+		{Allow: []Match{{}}},
+		{Deny: []Match{{ChatType: "forum"}}},
+	} {
+		assert.NotNil(t, bad.Validate(), "Expected invalid: %+v", bad)
+	}
+	good := Rules{PrivateOnly: true, Deny: []Match{{ChatType: "channel"}}, OnReject: OnRejectRoute, Reply: "This bot is private"}
+	assert.Nil(t, good.Validate())
+	assert.True(t, good.Routes())
+	assert.Equal(t, bot+".rejected", RejectedTopic(bot))
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	_, ok := s.Get(bot)
+	assert.False(t, ok, "Bots follow their profiles until rules are set")
+	assert.NotNil(t, s.Set(bot, Rules{OnReject: "bounce"}), "Expected invalid rules refused")
+	assert.Nil(t, s.Set(bot, Rules{PrivateOnly: true}))
+	r, ok := s.Get(bot)
+	assert.True(t, ok)
+	assert.True(t, r.PrivateOnly)
+	assert.True(t, s.Delete(bot))
+	assert.False(t, s.Delete(bot), "Nothing left to delete")
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	assert.True(t, s.ReplyDue(bot, -1001, time.Hour, now))
+	assert.True(t, s.ReplyDue(bot, -1001, time.Hour, now), "Due till the reply is marked sent")
+	s.MarkReplied(bot, -1001, now)
+	assert.False(t, s.ReplyDue(bot, -1001, time.Hour, now.Add(time.Minute)), "Expected one reply within the hour")
+	assert.True(t, s.ReplyDue(bot, -1002, time.Hour, now.Add(time.Minute)), "Replies are per chat")
+	assert.True(t, s.ReplyDue("6133190482", -1001, time.Hour, now.Add(time.Minute)), "Replies are per bot")
+	assert.True(t, s.ReplyDue(bot, -1001, time.Hour, now.Add(time.Hour)))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/access"
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// replyEvery : a chat that keeps getting rejected is replied to once in this long
+const replyEvery = time.Hour
+
+// Sources of the access rules of a bot
+const (
+	accessFromAPI     = "api"
+	accessFromProfile = "profile"
+	accessNone        = "none" // everyone is accepted
+)
+
+// accessView : access rules of the bot as the api sends them back
+type accessView struct {
+	Bot    string        `json:"bot"`
+	Source string        `json:"source"` // api, profile or none
+	Rules  *access.Rules `json:"rules"`  // null when there arent any rules
+}
+
+// accessRules : rules set through the api take precedence over the ones in the profile, nil when the bot has neither
+func (a *App) accessRules(botid string) (*access.Rules, string) {
+	if r, ok := a.Access.Get(botid); ok {
+		return &r, accessFromAPI
+	}
+	if r := a.Profiles.For(botid).Access; r != nil {
+		return r, accessFromProfile
+	}
+	return nil, accessNone
+}
+
+// checkAccess : updates the access rules of the bot reject are moved out of the result, before the processors get them.
+// Rejected updates that the rules route are sent back as items for the rejected topic, the rest are moved over to Dropped.
+// On a dry run nothing is counted
+func (a *App) checkAccess(ctx context.Context, result *scrapers.ScrapeResult, dryRun bool) []pipeline.Item {
+	rules, source := a.accessRules(result.ForBot)
+	if rules == nil {
+		return nil
+	}
+	kept, routed := []models.Update{}, []pipeline.Item{}
+	for _, updt := range result.Updates {
+		reason := rules.Check(updt)
+		if reason == "" {
+			kept = append(kept, updt)
+			continue
+		}
+		result.Rejected = append(result.Rejected, updt)
+		logging.From(ctx).WithFields(log.Fields{
+			"bot":       result.ForBot,
+			"update_id": updt.UpdtID,
+			"chat":      updt.Chat().ChatID,
+			"sender":    updt.From().SenderID,
+			"reason":    reason,
+			"rules":     source,
+		}).Info("update rejected by the access rules")
+		if rules.Routes() {
+			routed = append(routed, pipeline.Item{Update: updt, Topic: access.RejectedTopic(result.ForBot), Headers: map[string]interface{}{"rejected_reason": reason}})
+			continue
+		}
+		result.Dropped = append(result.Dropped, updt)
+		if !dryRun {
+			metrics.Dropped(result.ForBot, "access")
+		}
+	}
+	result.Updates = kept
+	return routed
+}
+
+// replyRejected : reply of the access rules is queued in the outbox of the bot, for the chats of the rejected updates.
+// Each chat gets the reply once in replyEvery, counted from when the reply was queued.
+// Failures are only logged and the reply stays due for the next rejected update, the updates are published by now
+func (a *App) replyRejected(ctx context.Context, conn Publisher, result *scrapers.ScrapeResult) {
+	rules, _ := a.accessRules(result.ForBot)
+	if rules == nil || rules.Reply == "" {
+		return
+	}
+	for _, updt := range result.Rejected {
+		chat, err := updt.Chat().ChatID.Int64()
+		if err != nil || !a.Access.ReplyDue(result.ForBot, chat, replyEvery, time.Now()) {
+			continue
+		}
+		byt, _ := json.Marshal(senders.OutboundMessage{ChatID: updt.Chat().ChatID, Text: rules.Reply})
+		queue := senders.OutboxQueue(result.ForBot)
+		if err := conn.Publish(ctx, "amq.topic", queue, amqp.Publishing{ContentType: "application/json", Body: byt}); err != nil {
+			logging.From(ctx).WithFields(log.Fields{
+				"bot":  result.ForBot,
+				"chat": chat,
+				"err":  err,
+			}).Warn("failed to queue the reply for the rejected update")
+			continue
+		}
+		a.Access.MarkReplied(result.ForBot, chat, time.Now())
+	}
+}
+
+// HndlAccessRules : access rules the bot is following now, and where they are from
+func (a *App) HndlAccessRules(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	if _, ok := a.Registry.Find(botid); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", botid), nil)
+		return
+	}
+	rules, source := a.accessRules(botid)
+	ctx.AbortWithStatusJSON(http.StatusOK, accessView{Bot: botid, Source: source, Rules: rules})
+}
+
+// HndlPutAccessRules : rules replace the ones from the profile of the bot, till they are deleted or the service restarts
+func (a *App) HndlPutAccessRules(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	if _, ok := a.Registry.Find(botid); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", botid), nil)
+		return
+	}
+	rules := access.Rules{}
+	if err := ctx.ShouldBindJSON(&rules); err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid payload, expected access rules", nil)
+		return
+	}
+	if err := a.Access.Set(botid, rules); err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, err.Error(), nil)
+		return
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"bot":          botid,
+		"private_only": rules.PrivateOnly,
+		"allow":        len(rules.Allow),
+		"deny":         len(rules.Deny),
+	}).Info("access rules of the bot set")
+	ctx.AbortWithStatusJSON(http.StatusOK, accessView{Bot: botid, Source: accessFromAPI, Rules: &rules})
+}
+
+// HndlDeleteAccessRules : bot goes back to the access rules of its profile
+func (a *App) HndlDeleteAccessRules(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	if !a.Access.Delete(botid) {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("no access rules set for bot %s, it follows its profile", botid), nil)
+		return
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"bot": botid,
+	}).Info("access rules of the bot deleted, back to the profile")
+	ctx.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/eensymachines/tgramscraper/alerts"
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/brokers"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// newAlerter : alerts go to the admin chat through the admin bot, only logged when there isnt an admin bot configured
+func (a *App) newAlerter() *alerts.Alerter {
+	var notify func(string) error
+	if a.Config.Alerts.AdminBot != "" {
+		notify = a.notifyAdmin
+	}
+	al := alerts.New(notify, a.Config.Alerts.Cooldown, a.Config.Alerts.BrokerDownAfter)
+	a.Registry.Subscribe(func(evt tokens.RegistryEvent) {
+		if evt.Kind == tokens.EvtTokenRevoked {
+			al.Raise(alerts.KindTokenRevoked, evt.UID, fmt.Sprintf("token of bot %s was refused by the telegram server, stage a new token to resume", evt.UID))
+		}
+	})
+	return al
+}
+
+// notifyAdmin : sends the text to NirChatID as the admin bot, through the same limiter as all the other sends
+func (a *App) notifyAdmin(text string) error {
+	sender, config := a.newSender(a.Config.Alerts.AdminBot)
+	_, err := sender.Send(senders.OutboundMessage{ChatID: json.Number(a.Config.NirChatID), Text: text}, config)
+	return err
+}
+
+// watchedBroker : Broker that lets the alerter know each time the broker could or could not be reached
+type watchedBroker struct {
+	Broker
+	alerts *alerts.Alerter
+}
+
+func (wb *watchedBroker) Open() (Publisher, error) {
+	conn, err := wb.Broker.Open()
+	wb.observe(err)
+	return conn, err
+}
+
+func (wb *watchedBroker) Dial() (*brokers.RabbitConnResult, error) {
+	conn, err := wb.Broker.Dial()
+	wb.observe(err)
+	return conn, err
+}
+
+func (wb *watchedBroker) observe(err error) {
+	if err != nil {
+		wb.alerts.Failing(alerts.KindBrokerDown, "broker", err)
+		return
+	}
+	wb.alerts.Recovered(alerts.KindBrokerDown, "broker")
+}
+
+// HndlRecover : panics in the handlers are alerted and sent back as 500 with the error envelope.
+// Alerts are per route, so a route that panics on every request is alerted once per cooldown
+func (a *App) HndlRecover(ctx *gin.Context, recovered interface{}) {
+	text := fmt.Sprintf("%s %s: %v", ctx.Request.Method, ctx.Request.URL.Path, recovered)
+	if len(text) > 1000 {
+		// telegram messages are limited to 4096 chars, cut on a rune boundary so the text stays valid utf-8
+		cut := 1000
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	if id := logging.RequestID(ctx.Request.Context()); id != "" {
+		text = fmt.Sprintf("%s\nrequest id %s", text, id)
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"route": ctx.FullPath(),
+	}).Errorf("handler panicked: %v", recovered)
+	a.Alerts.Raise(alerts.KindPanic, ctx.FullPath(), text)
+	api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "internal error", nil)
+}
@@ -0,0 +1,156 @@
+// Alerts are operational failures sent to the admin chat (NIRCHATID) through the admin bot.
+
+// Alerts of the same kind and key are sent once per cooldown, the ones held back in between are counted and
+// mentioned with the next alert that goes out - one outage does not flood the chat.
+package alerts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kind : what has gone wrong
+type Kind string
+
+const (
+	KindTokenRevoked  Kind = "token_revoked"  // telegram server has refused the token of a bot
+	KindBrokerDown    Kind = "broker_down"    // broker unreachable for longer than DownAfter
+	KindOutboxBacklog Kind = "outbox_backlog" // outbox has grown beyond the threshold
+	KindPanic         Kind = "panic"          // a handler panicked
+)
+
+// sent : last time an alert went out for a kind & key, and how many were held back since
+type sent struct {
+	at         time.Time
+	suppressed int
+}
+
+// Alerter : dedups the alerts and sends them in the background. Safe for concurrent use
+type Alerter struct {
+	Notify    func(text string) error // sends the text to the admin chat, nil to only log the alerts
+	Cooldown  time.Duration           // same kind & key is not sent again within this
+	DownAfter time.Duration           // components failing for this long are alerted
+
+	mu      sync.Mutex
+	last    map[string]*sent
+	down    map[string]time.Time // when did the failing components start failing
+	alerted map[string]bool      // failing components that have been alerted, recovery is sent only for these
+	sending sync.WaitGroup
+	now     func() time.Time
+}
+
+// New : alerter that sends with notify, notify can be nil
+func New(notify func(text string) error, cooldown, downAfter time.Duration) *Alerter {
+	return &Alerter{
+		Notify:    notify,
+		Cooldown:  cooldown,
+		DownAfter: downAfter,
+		last:      map[string]*sent{},
+		down:      map[string]time.Time{},
+		alerted:   map[string]bool{},
+		now:       time.Now,
+	}
+}
+
+// Raise : sends the alert unless the same kind & key was sent within the cooldown.
+// Never blocks the caller, true when the alert is sent
+func (al *Alerter) Raise(kind Kind, key, text string) bool {
+	id := fmt.Sprintf("%s/%s", kind, key)
+	al.mu.Lock()
+	now := al.now()
+	prev, ok := al.last[id]
+	if ok && now.Sub(prev.at) < al.Cooldown {
+		prev.suppressed++
+		al.mu.Unlock()
+		log.WithFields(log.Fields{
+			"kind": kind,
+			"key":  key,
+		}).Debug("alert suppressed, within cooldown")
+		return false
+	}
+	suppressed := 0
+	if ok {
+		suppressed = prev.suppressed
+	}
+	al.last[id] = &sent{at: now}
+	al.mu.Unlock()
+
+	msg := fmt.Sprintf("ALERT %s: %s", kind, text)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s\n(%d more since the last alert)", msg, suppressed)
+	}
+	log.WithFields(log.Fields{
+		"kind": kind,
+		"key":  key,
+	}).Warn(msg)
+	al.send(kind, msg)
+	return true
+}
+
+// Failing : the component has failed, alerted only once its been failing for longer than DownAfter
+func (al *Alerter) Failing(kind Kind, key string, err error) {
+	id := fmt.Sprintf("%s/%s", kind, key)
+	al.mu.Lock()
+	since, ok := al.down[id]
+	if !ok {
+		since = al.now()
+		al.down[id] = since
+	}
+	failingFor := al.now().Sub(since)
+	al.mu.Unlock()
+	if failingFor < al.DownAfter {
+		return
+	}
+	if al.Raise(kind, key, fmt.Sprintf("%s unreachable for %s: %s", key, failingFor.Round(time.Second), err)) {
+		al.mu.Lock()
+		al.alerted[id] = true
+		al.mu.Unlock()
+	}
+}
+
+// Recovered : the component is back, a note is sent if the failure was alerted
+func (al *Alerter) Recovered(kind Kind, key string) {
+	id := fmt.Sprintf("%s/%s", kind, key)
+	al.mu.Lock()
+	since, ok := al.down[id]
+	alerted := al.alerted[id]
+	delete(al.down, id)
+	delete(al.alerted, id)
+	delete(al.last, id) // next outage is alerted afresh
+	now := al.now()
+	al.mu.Unlock()
+	if !ok || !alerted {
+		return
+	}
+	msg := fmt.Sprintf("RESOLVED %s: %s is reachable again after %s", kind, key, now.Sub(since).Round(time.Second))
+	log.WithFields(log.Fields{
+		"kind": kind,
+		"key":  key,
+	}).Info(msg)
+	al.send(kind, msg)
+}
+
+// send : notifies in the background, failing to send is only logged
+func (al *Alerter) send(kind Kind, msg string) {
+	if al.Notify == nil {
+		return
+	}
+	al.sending.Add(1)
+	go func() {
+		defer al.sending.Done()
+		if err := al.Notify(msg); err != nil {
+			log.WithFields(log.Fields{
+				"kind": kind,
+				"err":  err,
+			}).Error("failed Alerter: could not send to the admin chat")
+		}
+	}()
+}
+
+// Wait : blocks till the alerts being sent are done, on shutdown
+func (al *Alerter) Wait() {
+	al.sending.Wait()
+}
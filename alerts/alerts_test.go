@@ -0,0 +1,104 @@
+package alerts
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock : time that moves only when the test says so
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time       { return c.t }
+func (c *clock) pass(d time.Duration) { c.t = c.t.Add(d) }
+
+// install : alerter runs on the clock from here on
+func (c *clock) install(al *Alerter) *clock {
+	al.now = c.now
+	return c
+}
+
+func newClock() *clock {
+	return &clock{t: time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// inbox : what the admin chat has received
+type inbox struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (ib *inbox) notify(text string) error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ib.msgs = append(ib.msgs, text)
+	return nil
+}
+
+func TestCooldown(t *testing.T) {
+	ib := &inbox{}
+	al := New(ib.notify, 10*time.Minute, time.Minute)
+	clk := newClock().install(al)
+
+	assert.True(t, al.Raise(KindTokenRevoked, "6425245255", "token refused"), "First alert should go out")
+	assert.False(t, al.Raise(KindTokenRevoked, "6425245255", "token refused"), "Same alert within cooldown should be held back")
+	assert.True(t, al.Raise(KindTokenRevoked, "6133190482", "token refused"), "Alert for another bot is not a duplicate")
+	assert.True(t, al.Raise(KindPanic, "6425245255", "boom"), "Alert of another kind is not a duplicate")
+	clk.pass(5 * time.Minute)
+	assert.False(t, al.Raise(KindTokenRevoked, "6425245255", "token refused"), "Still within cooldown")
+	clk.pass(5 * time.Minute)
+	assert.True(t, al.Raise(KindTokenRevoked, "6425245255", "token refused"), "Alert should go out after the cooldown")
+	al.Wait()
+
+	assert.Equal(t, 4, len(ib.msgs), "Unexpected count of alerts sent: %v", ib.msgs)
+	last := ""
+	for _, m := range ib.msgs {
+		if strings.Contains(m, "2 more") {
+			last = m
+		}
+	}
+	assert.NotEmpty(t, last, "Expected the held back alerts counted in the next alert: %v", ib.msgs)
+}
+
+func TestFailing(t *testing.T) {
+	ib := &inbox{}
+	al := New(ib.notify, 10*time.Minute, time.Minute)
+	clk := newClock().install(al)
+
+	al.Recovered(KindBrokerDown, "broker") // nothing was failing, nothing to say
+	for i := 0; i < 6; i++ {
+		al.Failing(KindBrokerDown, "broker", fmt.Errorf("connection refused"))
+		clk.pass(10 * time.Second)
+	}
+	al.Wait()
+	assert.Equal(t, 0, len(ib.msgs), "Failing for less than DownAfter should not be alerted")
+
+	al.Failing(KindBrokerDown, "broker", fmt.Errorf("connection refused"))
+	al.Failing(KindBrokerDown, "broker", fmt.Errorf("connection refused"))
+	al.Wait()
+	assert.Equal(t, 1, len(ib.msgs), "Expected one alert once down for longer than DownAfter")
+	assert.Contains(t, ib.msgs[0], "connection refused")
+
+	clk.pass(time.Minute)
+	al.Recovered(KindBrokerDown, "broker")
+	al.Wait()
+	assert.Equal(t, 2, len(ib.msgs), "Expected a note on recovery")
+	assert.True(t, strings.HasPrefix(ib.msgs[1], "RESOLVED"), "Unexpected recovery note %s", ib.msgs[1])
+
+	// a short blip after recovery is not alerted
+	al.Failing(KindBrokerDown, "broker", fmt.Errorf("connection refused"))
+	al.Recovered(KindBrokerDown, "broker")
+	al.Wait()
+	assert.Equal(t, 2, len(ib.msgs), "Blips shorter than DownAfter should not be alerted")
+}
+
+func TestNotifyFails(t *testing.T) {
+	al := New(func(string) error { return fmt.Errorf("bot blocked by the admin") }, time.Minute, time.Minute)
+	assert.True(t, al.Raise(KindPanic, "/v1/scrape", "boom"), "Failing to send should not hold the alert back")
+	al.Wait()
+	assert.True(t, New(nil, time.Minute, time.Minute).Raise(KindPanic, "/v1/scrape", "boom"), "Alerts are logged when there isnt a notifier")
+}
@@ -0,0 +1,101 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	spec, err := api.Spec()
+	assert.Nil(t, err, "Unexpected error loading the spec")
+	validator, err := api.Validator(spec)
+	assert.Nil(t, err, "Unexpected error building the validator")
+	r := gin.New()
+	r.NoRoute(api.HndlNoRoute)
+	v1 := r.Group("/v1", validator)
+	v1.GET("/openapi.json", api.HndlSpec)
+	v1.GET("/bots/:botid", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"uid": ctx.Param("botid"), "state": "active", "has_pending": false})
+	})
+	v1.PUT("/bots/:botid/token", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"uid": ctx.Param("botid"), "state": "active", "has_pending": true})
+	})
+	return r
+}
+
+func TestValidator(t *testing.T) {
+	r := testRouter(t)
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"GET", "/v1/bots/6133190482", "", http.StatusOK, ""},
+		{"GET", "/v1/bots/61331sd90482", "", http.StatusBadRequest, api.CodeInvalidRequest},
+		{"GET", "/v1/nosuchroute", "", http.StatusNotFound, api.CodeNotFound},
+		{"PUT", "/v1/bots/6425245255/token", `{"token":"6425245255:oOkCGb-FjTX43v4u4A2p1IOED0-oHZ-hMPt"}`, http.StatusOK, ""},
+		{"PUT", "/v1/bots/6425245255/token", `{"token":"notatoken"}`, http.StatusBadRequest, api.CodeInvalidRequest},
+		{"PUT", "/v1/bots/6425245255/token", `{}`, http.StatusBadRequest, api.CodeInvalidRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if c.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, "Unexpected status for %s %s", c.method, c.path)
+		if c.code != "" {
+			envelope := api.Error{}
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &envelope), "Unexpected error envelope %s", rec.Body.String())
+			assert.Equal(t, c.code, envelope.Code, "Unexpected error code for %s %s", c.method, c.path)
+			assert.NotEmpty(t, envelope.Message, "Unexpected empty error message")
+		}
+	}
+}
+
+func TestServeSpec(t *testing.T) {
+	r := testRouter(t)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status serving spec")
+	doc := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &doc), "Unexpected error unmarshaling spec")
+	assert.Equal(t, "3.0.3", doc["openapi"], "Unexpected openapi version")
+}
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(api.HndlRequestID)
+	r.GET("/echo", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, logging.RequestID(ctx.Request.Context()))
+	})
+	// id from the caller is kept
+	req := httptest.NewRequest("GET", "/echo", nil)
+	req.Header.Set(logging.RequestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, "abc-123", rec.Header().Get(logging.RequestIDHeader), "Expected caller's id sent back")
+	assert.Equal(t, "abc-123", rec.Body.String(), "Expected caller's id in the request context")
+
+	// none or an insane one, a new one is made
+	for _, sent := range []string{"", "not an id"} {
+		req = httptest.NewRequest("GET", "/echo", nil)
+		req.Header.Set(logging.RequestIDHeader, sent)
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		id := rec.Header().Get(logging.RequestIDHeader)
+		assert.True(t, logging.ValidRequestID(id), "Expected a new id for %q", sent)
+		assert.Equal(t, id, rec.Body.String(), "Expected the new id in the request context")
+	}
+}
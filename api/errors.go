@@ -0,0 +1,48 @@
+// Versioned http api of the service, the OpenAPI document and the error envelope are what clients rely on.
+
+// All the errors are sent back in the same envelope, with a machine readable code.
+// Request & response validation is driven from the OpenAPI document embedded in this package.
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes sent back in the envelope, clients can switch on these.
+const (
+	CodeInvalidRequest = "invalid_request"   // url params, query or the payload is not as the spec expects
+	CodeNotFound       = "not_found"         // no such route
+	CodeBotNotFound    = "bot_not_found"     // bot isnt registered with us
+	CodeTokenRevoked   = "token_revoked"     // telegram server has refused the bot token
+	CodeUpstreamFailed = "upstream_failed"   // telegram server is unreachable or did not respond favourably
+	CodeGatewayFailed  = "gateway_failed"    // message broker is unreachable or publishing failed
+	CodeConflict       = "conflict"          // request conflicts with the state of the bot
+	CodeBotBusy        = "bot_busy"          // another replica is polling the bot, retry after a while
+	CodeRejected       = "telegram_rejected" // telegram server has refused the request, details has the reason
+	CodeRateLimited    = "rate_limited"      // too many requests, details has retry_after in seconds
+	CodeUnavailable    = "unavailable"       // service is shutting down, try another instance
+	CodeInternal       = "internal"          // something on our side has gone wrong
+)
+
+// Error is the envelope in which all the errors are sent back
+type Error struct {
+	Code    string      `json:"code"`              // one of the Code* constants
+	Message string      `json:"message"`           // human readable
+	Details interface{} `json:"details,omitempty"` // more context, shape depends on the code
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+// Abort : aborts the gin context with the error envelope
+func Abort(ctx *gin.Context, status int, code, message string, details interface{}) {
+	ctx.AbortWithStatusJSON(status, Error{Code: code, Message: message, Details: details})
+}
+
+// HndlNoRoute : routes that arent found get the envelope too, set this as the NoRoute handler of the engine
+func HndlNoRoute(ctx *gin.Context) {
+	Abort(ctx, http.StatusNotFound, CodeNotFound, "no such route in the api", nil)
+}
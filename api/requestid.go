@@ -0,0 +1,35 @@
+package api
+
+import (
+	"time"
+
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// HndlRequestID : request id from the caller's X-Request-ID, or a new one, is put in the request context and sent back.
+// Handlers log with logging.From(ctx.Request.Context()) so all the lines of a request carry the same id.
+// Access log line is written once the request is done, in the same format as the rest of the logs
+func HndlRequestID(ctx *gin.Context) {
+	id := ctx.GetHeader(logging.RequestIDHeader)
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	ctx.Request = ctx.Request.WithContext(logging.WithRequestID(ctx.Request.Context(), id))
+	ctx.Header(logging.RequestIDHeader, id)
+	start := time.Now()
+	ctx.Next()
+	entry := logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"method":  ctx.Request.Method,
+		"path":    ctx.Request.URL.Path,
+		"status":  ctx.Writer.Status(),
+		"latency": time.Since(start).String(),
+		"client":  ctx.ClientIP(),
+	})
+	if ctx.Writer.Status() >= 500 {
+		entry.Warn("request")
+		return
+	}
+	entry.Info("request")
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.yaml
+var specYaml []byte
+
+var (
+	loadOnce sync.Once
+	spec     *openapi3.T
+	specErr  error
+)
+
+// Spec : OpenAPI 3 document of the service, loaded & validated only once
+func Spec() (*openapi3.T, error) {
+	loadOnce.Do(func() {
+		loader := openapi3.NewLoader()
+		spec, specErr = loader.LoadFromData(specYaml)
+		if specErr != nil {
+			specErr = fmt.Errorf("failed to load openapi spec: %s", specErr)
+			return
+		}
+		if err := spec.Validate(context.Background()); err != nil {
+			specErr = fmt.Errorf("invalid openapi spec: %s", err)
+		}
+	})
+	return spec, specErr
+}
+
+// HndlSpec : serves the OpenAPI document as json, clients can generate SDKs from this
+func HndlSpec(ctx *gin.Context) {
+	doc, err := Spec()
+	if err != nil {
+		Abort(ctx, http.StatusInternalServerError, CodeInternal, "api specification unavailable", nil)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, doc)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// recorder : keeps a copy of the response body while writing it through, so the response can be validated after the handler
+type recorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// errDetails : flattens the validation errors to a list of messages for the envelope
+func errDetails(err error) []string {
+	result := []string{}
+	var me openapi3.MultiError
+	if errors.As(err, &me) {
+		for _, e := range me {
+			result = append(result, e.Error())
+		}
+		return result
+	}
+	return append(result, err.Error())
+}
+
+// isJSON : only json responses are recorded and validated.
+// Streams (SSE, websocket) are long lived and files can be large, these are passed through as is.
+func isJSON(route *routers.Route) bool {
+	if route.Operation == nil || route.Operation.Responses == nil {
+		return false
+	}
+	if ok := route.Operation.Responses.Get(http.StatusOK); ok != nil && ok.Value != nil {
+		return ok.Value.Content.Get("application/json") != nil
+	}
+	return false
+}
+
+// Validator : gin middleware that validates each request against the spec before it reaches the handlers.
+// Invalid requests are aborted with 400 and the envelope.
+// Responses are validated too, but since the response is already sent, a response that does not conform is only logged.
+func Validator(doc *openapi3.T) (gin.HandlerFunc, error) {
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx *gin.Context) {
+		route, pathParams, err := router.FindRoute(ctx.Request)
+		if err != nil {
+			if errors.Is(err, routers.ErrMethodNotAllowed) {
+				Abort(ctx, http.StatusMethodNotAllowed, CodeNotFound, "method not allowed on this route", nil)
+				return
+			}
+			Abort(ctx, http.StatusNotFound, CodeNotFound, "no such route in the api", nil)
+			return
+		}
+		reqInput := &openapi3filter.RequestValidationInput{
+			Request:    ctx.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{MultiError: true},
+		}
+		if err := openapi3filter.ValidateRequest(ctx.Request.Context(), reqInput); err != nil {
+			log.WithFields(log.Fields{
+				"path": ctx.Request.URL.Path,
+				"err":  err,
+			}).Debug("Validator: request does not conform to the spec")
+			Abort(ctx, http.StatusBadRequest, CodeInvalidRequest, "request does not conform to the api specification", errDetails(err))
+			return
+		}
+		if !isJSON(route) {
+			ctx.Next()
+			return
+		}
+		rec := &recorder{ResponseWriter: ctx.Writer, body: bytes.NewBuffer(nil)}
+		ctx.Writer = rec
+		ctx.Next()
+		respInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: reqInput,
+			Status:                 rec.Status(),
+			Header:                 rec.Header(),
+			Body:                   io.NopCloser(rec.body),
+			Options:                &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+		}
+		if err := openapi3filter.ValidateResponse(ctx.Request.Context(), respInput); err != nil {
+			log.WithFields(log.Fields{
+				"path":   ctx.Request.URL.Path,
+				"status": rec.Status(),
+				"err":    err,
+			}).Warn("Validator: response does not conform to the spec")
+		}
+	}, nil
+}
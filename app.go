@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/eensymachines/tgramscraper/access"
+	"github.com/eensymachines/tgramscraper/alerts"
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/brokers"
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/dedupe"
+	"github.com/eensymachines/tgramscraper/health"
+	"github.com/eensymachines/tgramscraper/lease"
+	"github.com/eensymachines/tgramscraper/media"
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/offsets"
+	"github.com/eensymachines/tgramscraper/profiles"
+	"github.com/eensymachines/tgramscraper/schedule"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/eensymachines/tgramscraper/stream"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"golang.org/x/sync/singleflight"
+)
+
+// Publisher : connection to the broker, as far as the handlers are concerned
+type Publisher interface {
+	Publish(ctx context.Context, exchange, topic string, msg amqp.Publishing) error
+	QueueDepth(queue string) (int, error) // count of messages ready in the queue
+	Close()
+}
+
+// Broker : opens connections to the message broker.
+// Handlers open a connection per request & close it when done, just as they always have
+type Broker interface {
+	Open() (Publisher, error)
+	Dial() (*brokers.RabbitConnResult, error) // full connection for the outbox consumers, which also consume & ack
+}
+
+// rabbitBroker : Broker over RabbitMQ with the credentials from the config
+type rabbitBroker struct {
+	user, passwd, server string
+}
+
+func (rb *rabbitBroker) Dial() (*brokers.RabbitConnResult, error) {
+	return brokers.RabbitConnDial(rb.user, rb.passwd, rb.server)
+}
+
+func (rb *rabbitBroker) Open() (Publisher, error) {
+	conn, err := rb.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &rabbitPublisher{conn: conn}, nil
+}
+
+// rabbitPublisher : Publisher over the function pointers of the rabbit connection
+type rabbitPublisher struct {
+	conn *brokers.RabbitConnResult
+}
+
+func (rp *rabbitPublisher) Publish(ctx context.Context, exchange, topic string, msg amqp.Publishing) error {
+	return rp.conn.PublishContext(ctx, exchange, topic, msg)
+}
+
+func (rp *rabbitPublisher) QueueDepth(queue string) (int, error) {
+	return rp.conn.QueueDepth(queue)
+}
+
+func (rp *rabbitPublisher) Close() {
+	rp.conn.CloseConn()
+}
+
+// ScraperFactory : scraper for the bot from the offset
+type ScraperFactory func(botid, offset string) scrapers.Scraper
+
+// App : everything the handlers need, handlers are methods on this.
+// Nothing here is dialled or read in when the App is created, tests can have fakes for the telegram server & the broker.
+type App struct {
+	Config    *config.Config
+	Registry  tokens.ManagedRegistry
+	Profiles  *profiles.Profiles // per bot configuration, defaults for bots that arent configured
+	Scrapers  ScraperFactory     // scrapers for the trigger, batch & peek
+	Broker    Broker
+	Hub       *stream.Hub         // internal stream of the published updates, for SSE & websocket subscribers
+	Limiter   *senders.Limiter    // all outbound messages are scheduled through this
+	Media     *media.Store        // files from the messages, nil when the store isnt available
+	Readiness *health.Checker     // component checks for the readiness probe
+	Transport http.RoundTripper   // all http calls to the telegram server go through this
+	Alerts    *alerts.Alerter     // operational alerts to the admin chat
+	Offsets   offsets.Store       // next offset of each bot, for the one-shot scrapes
+	Leases    lease.Locker        // only the holder of the lease of a bot polls it
+	Schedules *schedule.Scheduler // scrapes the service runs on its own
+	Dedupe    dedupe.Store        // update ids that were published, not published again
+	Access    *access.Store       // access rules set at runtime, over the ones in the bot profiles
+
+	draining   chan struct{}  // closed when shutdown begins, new work is refused from then on
+	stopOutbox chan struct{}  // closing this stops all the outbox consumers
+	outboxes   sync.WaitGroup // outbox consumers that are yet to stop
+
+	usernamesMu     sync.Mutex
+	usernames       map[string]string  // username of each bot as getMe has it, looked up once
+	usernameLookups singleflight.Group // getMe in flight for each bot
+}
+
+// NewApp : app with the defaults for everything other than the config, registry, profiles and the broker.
+// Scrapers call the telegram server at Config.BaseURL, replace App.Scrapers to fake the scraper itself
+func NewApp(cfg *config.Config, reg tokens.ManagedRegistry, prof *profiles.Profiles, broker Broker) *App {
+	a := &App{
+		Config:     cfg,
+		Registry:   reg,
+		Profiles:   prof,
+		Broker:     broker,
+		Hub:        stream.NewHub(100),
+		Limiter:    senders.NewLimiter(senders.DefaultLimits()),
+		Transport:  metrics.Transport(nil),
+		Offsets:    offsets.NewFileStore(cfg.OffsetsFile),
+		Leases:     lease.NewMemory(),
+		Dedupe:     dedupe.NewMemory(cfg.Dedupe.TTL, cfg.Dedupe.Size),
+		Access:     access.NewStore(),
+		draining:   make(chan struct{}),
+		stopOutbox: make(chan struct{}),
+		usernames:  map[string]string{},
+	}
+	a.Alerts = a.newAlerter()
+	a.Broker = &watchedBroker{Broker: broker, alerts: a.Alerts}
+	a.Scrapers = func(botid, offset string) scrapers.Scraper {
+		return a.telegram(botid, offset)
+	}
+	a.Readiness = a.newReadiness()
+	a.Schedules = schedule.New(a.runSchedule)
+	a.Schedules.Reason = scheduleReason
+	return a
+}
+
+// telegram : scraper for the telegram server, for what the Scraper interface doesnt cover - files, token verification
+func (a *App) telegram(botid, offset string) *scrapers.TelegramScraper {
+	return &scrapers.TelegramScraper{UID: botid, BaseUrl: a.Config.BaseURL, Offset: offset, Registry: a.Registry}
+}
+
+// newAppFromConfig : app as loadApp has it, broker is dialled to check it can be reached
+func newAppFromConfig(cfg *config.Config) (*App, error) {
+	a, err := loadApp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Testing amqp connection , and aborting early
+	conn, err := a.Broker.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMQP server %s: %s", cfg.AMQP.Server, err)
+	}
+	conn.Close()
+	return a, nil
+}
+
+// loadApp : secrets, registry, profiles and the media store as per the configuration.
+// Errors instead of panicking, nothing is dialled - commands that dont need the broker dont fail without it
+func loadApp(cfg *config.Config) (*App, error) {
+	user, passwd, err := cfg.AMQPCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read amqp credentials: %s", err)
+	}
+	log.Debug("AMQP credentials read in..")
+
+	/* -------------
+	Loading telegram bot secrets
+	------------- */
+	toks, err := cfg.BotTokens()
+	if err != nil {
+		return nil, err
+	}
+	registry := tokens.NewRotatingTokenRegistry(toks...)
+	log.WithFields(log.Fields{
+		"count": registry.Count(),
+	}).Debug("botsregistry read in")
+	registry.Subscribe(func(evt tokens.RegistryEvent) {
+		if evt.Kind == tokens.EvtTokenRevoked {
+			log.WithFields(log.Fields{
+				"uid": evt.UID,
+			}).Error("bot token revoked, stage a new token for the bot to resume scraping")
+		}
+	})
+
+	/* -------------
+	Loading per bot profiles, all bots get defaults when there isnt a profiles file
+	------------- */
+	var botProfiles *profiles.Profiles
+	if _, err := os.Stat(cfg.ProfilesPath); err != nil {
+		log.WithFields(log.Fields{
+			"path": cfg.ProfilesPath,
+		}).Warn("no bot profiles file, all bots will have default profiles")
+		botProfiles = profiles.NewDefaultProfiles()
+	} else {
+		botProfiles, err = profiles.Load(cfg.ProfilesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bot profiles: %s", err)
+		}
+		log.WithFields(log.Fields{
+			"count": len(botProfiles.Bots),
+		}).Debug("bot profiles read in")
+	}
+
+	broker := &rabbitBroker{user: user, passwd: passwd, server: cfg.AMQP.Server}
+	a := NewApp(cfg, registry, botProfiles, broker)
+	if a.Leases, err = newLocker(cfg, user, passwd); err != nil {
+		return nil, err
+	}
+	if a.Dedupe, err = newDedupe(cfg); err != nil {
+		return nil, err
+	}
+	a.openMediaStore()
+	if admin := cfg.Alerts.AdminBot; admin == "" {
+		log.Warn("no admin bot configured, alerts will only be logged")
+	} else if _, ok := registry.Find(admin); !ok {
+		return nil, fmt.Errorf("admin bot %s for the alerts is not a registered bot", admin)
+	}
+	return a, nil
+}
+
+// Router : all the routes of the service, versioned routes are validated against the OpenAPI spec
+func (a *App) Router() (*gin.Engine, error) {
+	r := gin.New()
+	r.Use(api.HndlRequestID, gin.CustomRecovery(a.HndlRecover))
+	r.NoRoute(api.HndlNoRoute)
+	r.GET("/ping", HndlPing)
+	r.GET("/healthz", a.HndlHealthz)
+	r.GET("/readyz", a.HndlReadyz)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	// unversioned routes are kept for the callers that are yet to move to /v1
+	r.POST("/bots/:botid/scrape/:updtid", a.HndlRefuseDraining, a.HndlLease, a.HndlScrapeTrigger, a.HndlDryRun, a.HndlRabbitPublish)
+	r.GET("/bots/:botid/updates", a.HndlLease, a.HndlPeekUpdates)
+	r.GET("/bots", a.HndlBotsStatus)
+	r.GET("/bots/:botid", a.HndlBotStatus)
+	r.GET("/bots/:botid/profile", a.HndlBotProfile)
+	r.PUT("/bots/:botid/token", a.HndlStageToken)
+	r.POST("/bots/:botid/token/rotate", a.HndlRotateToken)
+
+	spec, err := api.Spec()
+	if err != nil {
+		return nil, err
+	}
+	validator, err := api.Validator(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build api validator: %s", err)
+	}
+	v1 := r.Group("/v1", validator)
+	v1.GET("/ping", HndlPing)
+	v1.GET("/openapi.json", api.HndlSpec)
+	v1.POST("/bots/:botid/scrape/:updtid", a.HndlRefuseDraining, a.HndlLease, a.HndlScrapeTrigger, a.HndlDryRun, a.HndlRabbitPublish)
+	v1.GET("/bots/:botid/updates", a.HndlLease, a.HndlPeekUpdates)
+	v1.GET("/bots/:botid/stream", a.HndlStreamSSE)
+	v1.GET("/bots/:botid/stream/ws", a.HndlStreamWS)
+	v1.POST("/bots/:botid/messages", a.HndlRefuseDraining, a.HndlSendMessage)
+	v1.GET("/bots/:botid/messages/queue", a.HndlSendQueue)
+	v1.GET("/bots/:botid/files/:file_id", a.HndlGetFile)
+	v1.GET("/media/:sha256", a.HndlGetMedia)
+	v1.POST("/scrape", a.HndlRefuseDraining, a.HndlBatchScrape)
+	v1.GET("/bots", a.HndlBotsStatus)
+	v1.GET("/bots/:botid", a.HndlBotStatus)
+	v1.GET("/bots/:botid/profile", a.HndlBotProfile)
+	v1.PUT("/bots/:botid/token", a.HndlStageToken)
+	v1.POST("/bots/:botid/token/rotate", a.HndlRotateToken)
+	v1.GET("/schedules", a.HndlSchedules)
+	v1.GET("/schedules/:name", a.HndlSchedule)
+	v1.PUT("/schedules/:name", a.HndlPutSchedule)
+	v1.DELETE("/schedules/:name", a.HndlDeleteSchedule)
+	v1.GET("/bots/:botid/access", a.HndlAccessRules)
+	v1.PUT("/bots/:botid/access", a.HndlPutAccessRules)
+	v1.DELETE("/bots/:botid/access", a.HndlDeleteAccessRules)
+	return r, nil
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eensymachines/tgramscraper/alerts"
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/brokers"
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/health"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/media"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/offsets"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"github.com/eensymachines/tgramscraper/profiles"
+	"github.com/eensymachines/tgramscraper/schedule"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/stream"
+	"github.com/eensymachines/tgramscraper/telegramtest"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testBot     = "6425245255"
+	testToken   = "6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4"
+	testPending = "6425245255:oOkCGb-FjTX43v4u4A2p1IOED0-oHZ-hMPt"
+)
+
+// published : message as the fake broker got it
+type published struct {
+	Exchange, Topic string
+	Msg             amqp.Publishing
+	RequestID       string // from the context the publish was called in
+}
+
+// fakeBroker : keeps the published messages in memory, fails to open when down
+type fakeBroker struct {
+	mu        sync.Mutex
+	down      bool
+	published []published
+}
+
+func (fb *fakeBroker) Open() (Publisher, error) {
+	if fb.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return fb, nil
+}
+
+func (fb *fakeBroker) Dial() (*brokers.RabbitConnResult, error) {
+	return nil, fmt.Errorf("fake broker cannot consume")
+}
+
+func (fb *fakeBroker) Publish(ctx context.Context, exchange, topic string, msg amqp.Publishing) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.published = append(fb.published, published{Exchange: exchange, Topic: topic, Msg: msg, RequestID: logging.RequestID(ctx)})
+	return nil
+}
+
+func (fb *fakeBroker) QueueDepth(queue string) (int, error) { return 0, nil }
+func (fb *fakeBroker) Close()                               {}
+
+// fakeTelegram : telegram server that accepts only the tokens given, each bot has the same 2 updates waiting
+func fakeTelegram(accepted ...string) *telegramtest.Server {
+	srv := telegramtest.NewServer()
+	for _, tok := range accepted {
+		srv.AddBot(tok).Push(
+			models.Update{UpdtID: "100", Message: &models.UpdateMessage{MsgId: "1", Text: "hello", Chat: models.Chat{ChatID: "1"}}},
+			models.Update{Message: &models.UpdateMessage{MsgId: "2", Text: "world", Chat: models.Chat{ChatID: "2"}}},
+		)
+	}
+	return srv
+}
+
+// newTestApp : app over the fake telegram server & broker, bot registered with testToken
+func newTestApp(t *testing.T, baseURL string) (*App, *fakeBroker, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.BaseURL = baseURL
+	broker := &fakeBroker{}
+	a := NewApp(&cfg, tokens.NewRotatingTokenRegistry(testToken), profiles.NewDefaultProfiles(), broker)
+	r, err := a.Router()
+	assert.Nil(t, err, "Unexpected error building the router")
+	return a, broker, r
+}
+
+func request(r http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestScrapeTrigger(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	updates, cancel := a.Hub.Subscribe(testBot, stream.Filter{}, "")
+	defer cancel()
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	result := scrapers.ScrapeResult{}
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	assert.Equal(t, 2, result.UpdateCount, "Unexpected count of updates")
+	assert.Equal(t, "102", result.NextUpdateOffset, "Unexpected offset")
+
+	assert.Equal(t, 2, len(broker.published), "Expected each update published")
+	for i, text := range []string{"hello", "world"} {
+		assert.Equal(t, "amq.topic", broker.published[i].Exchange)
+		assert.Equal(t, testBot+".updates", broker.published[i].Topic)
+		assert.Equal(t, text, string(broker.published[i].Msg.Body))
+	}
+	assert.Equal(t, "100", (<-updates).UpdtID.String(), "Stream subscribers should get what the broker gets")
+	assert.Equal(t, rec.Header().Get(logging.RequestIDHeader), broker.published[0].RequestID, "Expected the request id carried on to the broker")
+
+	// dry run scrapes but does not publish
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0?dry_run=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 2, len(broker.published), "Dry run should not publish")
+}
+
+// copyProcessor : sends the update on as is, and a copy of it under the topic <bot>.copies
+type copyProcessor struct{}
+
+func (copyProcessor) Process(ctx context.Context, env pipeline.Env, item pipeline.Item) ([]pipeline.Item, error) {
+	cp := item
+	cp.Topic = env.Bot + ".copies"
+	return []pipeline.Item{item, cp}, nil
+}
+
+func init() {
+	pipeline.Register("copy", func(params pipeline.Params) (pipeline.Processor, error) { return copyProcessor{}, nil })
+}
+
+func TestStreamOncePerUpdate(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	var err error
+	a.Profiles, err = profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    processors:
+      - type: copy
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+	updates, cancel := a.Hub.Subscribe(testBot, stream.Filter{}, "")
+	defer cancel()
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 4, len(broker.published), "Expected each update published twice")
+	got := []string{}
+	for len(updates) > 0 {
+		got = append(got, (<-updates).UpdtID.String())
+	}
+	assert.Equal(t, []string{"100", "101"}, got, "Expected each update streamed once")
+}
+
+func TestStreamOrigins(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, _, r := newTestApp(t, srv.URL)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/bots/" + testBot + "/stream/ws"
+	dial := func(origin string) int {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Unexpected error dialling the websocket: %s", err)
+			}
+			return resp.StatusCode
+		}
+		conn.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, dial(""), "Expected clients without an origin let through")
+	assert.Equal(t, http.StatusSwitchingProtocols, dial(ts.URL), "Expected the same origin let through")
+	assert.Equal(t, http.StatusForbidden, dial("https://evil.example.com"), "Expected other origins refused")
+	a.Config.StreamOrigins = []string{"https://dash.example.com/"}
+	assert.Equal(t, http.StatusSwitchingProtocols, dial("https://dash.example.com"), "Expected the configured origin let through")
+	assert.Equal(t, http.StatusForbidden, dial("https://evil.example.com"))
+	a.Config.StreamOrigins = []string{"*"}
+	assert.Equal(t, http.StatusSwitchingProtocols, dial("https://evil.example.com"), "Expected any origin with *")
+}
+
+func TestScrapeTriggerErrors(t *testing.T) {
+	srv := fakeTelegram() // refuses all tokens
+	defer srv.Close()
+	_, broker, r := newTestApp(t, srv.URL)
+
+	envelope := func(rec *httptest.ResponseRecorder) api.Error {
+		e := api.Error{}
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		return e
+	}
+	rec := request(r, "POST", "/v1/bots/1111111111/scrape/0", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, api.CodeBotNotFound, envelope(rec).Code)
+	// ids from the url that arent registered dont get series of their own
+	rec = request(r, "GET", "/metrics", "")
+	assert.NotContains(t, rec.Body.String(), `bot="1111111111"`)
+	assert.Contains(t, rec.Body.String(), `tgramscraper_scrape_errors_total{bot="unknown",type="bot_not_registered"}`)
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Expected refused token to be revoked")
+	assert.Equal(t, api.CodeTokenRevoked, envelope(rec).Code)
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/abc", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, api.CodeInvalidRequest, envelope(rec).Code)
+
+	// telegram is good now, but the broker is down
+	srv2 := fakeTelegram(testToken)
+	defer srv2.Close()
+	_, broker, r = newTestApp(t, srv2.URL)
+	broker.down = true
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, api.CodeGatewayFailed, envelope(rec).Code)
+
+	// telegram is unreachable, the url of the failed call carries the token
+	srv3 := fakeTelegram(testToken)
+	srv3.Close()
+	_, _, r = newTestApp(t, srv3.URL)
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, api.CodeUpstreamFailed, envelope(rec).Code)
+	assert.NotContains(t, rec.Body.String(), testToken, "Unexpected token in the error response")
+	assert.Equal(t, "telegram server call failed: unreachable", envelope(rec).Message)
+
+	// telegram too slow, the message is fixed whatever the error
+	srv4 := fakeTelegram(testToken)
+	defer srv4.Close()
+	srv4.Fail("getUpdates", telegramtest.Slow(time.Second))
+	a, _, r := newTestApp(t, srv4.URL)
+	var err error
+	a.Profiles, err = profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    request_timeout: 100ms
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, "telegram server did not respond in time", envelope(rec).Message)
+	assert.NotContains(t, rec.Body.String(), testToken, "Unexpected token in the error response")
+}
+
+func TestTokenRotation(t *testing.T) {
+	srv := fakeTelegram(testToken, testPending)
+	defer srv.Close()
+	a, _, r := newTestApp(t, srv.URL)
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/token/rotate", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Nothing staged to rotate")
+
+	rec = request(r, "PUT", "/v1/bots/"+testBot+"/token", fmt.Sprintf(`{"token":"%s"}`, testPending))
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	st := tokens.BotStatus{}
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	assert.True(t, st.HasPending, "Expected the token staged")
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/token/rotate", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	tok, _ := a.Registry.Find(testBot)
+	assert.Equal(t, testPending, tok, "Expected pending token promoted")
+
+	rec = request(r, "GET", "/v1/bots", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, strings.Contains(rec.Body.String(), testPending), "Tokens should never be in the response")
+}
+
+func TestBatchScrape(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	_, broker, r := newTestApp(t, srv.URL)
+	rec := request(r, "POST", "/v1/scrape", `{"bots":[{"bot":"`+testBot+`","offset":"0"},{"bot":"1111111111","offset":"0"}]}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	resp := batchScrapeResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.Equal(t, 1, resp.Succeeded)
+	assert.Equal(t, 1, resp.Failed)
+	assert.Equal(t, api.CodeBotNotFound, resp.Results[1].Error.Code)
+	assert.Equal(t, 2, len(broker.published), "Expected updates of the registered bot published")
+
+	// errors of the bots never have the token, which is in the url of the failed calls
+	srv.Close()
+	rec = request(r, "POST", "/v1/scrape", `{"bots":[{"bot":"`+testBot+`","offset":"0"}]}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	resp = batchScrapeResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if assert.Equal(t, 1, resp.Failed) {
+		assert.Equal(t, api.CodeUpstreamFailed, resp.Results[0].Error.Code)
+	}
+	assert.NotRegexp(t, `bot\d+:`, rec.Body.String(), "Unexpected token in the batch response")
+}
+
+func TestLease(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	// another poller has the bot
+	held, err := a.Leases.Acquire(context.Background(), testBot)
+	assert.Nil(t, err, "Unexpected error acquiring the lease")
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "Unexpected status: %s", rec.Body.String())
+	e := api.Error{}
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	assert.Equal(t, api.CodeBotBusy, e.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	rec = request(r, "GET", "/v1/bots/"+testBot+"/updates", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, "Peek polls the bot too")
+
+	rec = request(r, "POST", "/v1/scrape", `{"bots":[{"bot":"`+testBot+`","offset":"0"}]}`)
+	resp := batchScrapeResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.Equal(t, 1, resp.Failed, "Expected the leased bot skipped in the batch")
+	assert.Equal(t, api.CodeBotBusy, resp.Results[0].Error.Code)
+	assert.Equal(t, 0, len(broker.published), "Nothing should be polled or published while the lease is held elsewhere")
+
+	held.Release()
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Expected scrape once the lease is released: %s", rec.Body.String())
+	_, err = a.Leases.Acquire(context.Background(), testBot)
+	assert.Nil(t, err, "Expected the lease released once the request is done")
+}
+
+func TestPeekUpdates(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	srv.AddBot(testToken).Push(
+		models.Update{Message: &models.UpdateMessage{MsgId: "1", Text: "hello", Chat: models.Chat{ChatID: "1"}}},
+		models.Update{Message: &models.UpdateMessage{MsgId: "2", Text: "world", Chat: models.Chat{ChatID: "2"}}},
+		models.Update{CallbackQuery: &models.CallbackQuery{ID: "9", Data: "ok"}},
+	)
+	a, broker, r := newTestApp(t, srv.URL)
+	var err error
+	a.Profiles, err = profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    chats: [2]
+    allowed_updates: [message]
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+
+	rec := request(r, "GET", "/v1/bots/"+testBot+"/updates", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	resp := peekResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.Equal(t, 2, len(resp.Updates), "Expected all chats, only the kinds the profile allows")
+	assert.Equal(t, "3", resp.NextOffset)
+	assert.Equal(t, 0, len(broker.published), "Peek does not publish")
+}
+
+func TestStoreMedia(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	bot := srv.AddBot(testToken)
+	bot.AddFile("doc1", []byte("report"))
+	bot.Push(models.Update{Message: &models.UpdateMessage{MsgId: "1", Chat: models.Chat{ChatID: "1"}, Document: &models.Document{FileID: "doc1"}}})
+	a, broker, r := newTestApp(t, srv.URL)
+	var err error
+	a.Media, err = media.NewStore(t.TempDir())
+	assert.Nil(t, err, "Unexpected error creating the media store")
+	a.Profiles, err = profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    store_media: true
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0?dry_run=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 0, srv.Calls("getFile"), "Dry run should not download media")
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 1, srv.Calls("getFile"), "Expected the document downloaded when publishing")
+	sum := sha256.Sum256([]byte("report"))
+	f, err := a.Media.Open(hex.EncodeToString(sum[:]))
+	if assert.Nil(t, err, "Expected the document in the media store") {
+		f.Close()
+	}
+	assert.Equal(t, 1, len(broker.published))
+}
+
+func TestSchedules(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	a.Offsets = offsets.NewFileStore(filepath.Join(t.TempDir(), "offsets.json"))
+	defer a.Schedules.Stop()
+
+	rec := request(r, "PUT", "/v1/schedules/morning", `{"bot":"`+testBot+`","spec":"0 9 * * *","jitter":"30s"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	st := schedule.Status{}
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	assert.Equal(t, "30s", st.Jitter)
+	assert.NotNil(t, st.NextRun, "Expected the next fire time")
+
+	rec = request(r, "PUT", "/v1/schedules/broken", `{"bot":"`+testBot+`","spec":"every now and then"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "Expected bad spec refused")
+	rec = request(r, "PUT", "/v1/schedules/other", `{"bot":"1111111111","spec":"@hourly"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Expected schedule for a bot not registered refused")
+	rec = request(r, "GET", "/v1/schedules", "")
+	list := []schedule.Status{}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	assert.Equal(t, 1, len(list))
+
+	// a run publishes from the stored offset and moves it on
+	job := schedule.Job{Name: "morning", Bot: testBot, Spec: "0 9 * * *"}
+	assert.Nil(t, a.runSchedule(context.Background(), job), "Unexpected error running the schedule")
+	assert.Equal(t, 2, len(broker.published))
+	offset, _, _ := a.Offsets.Get(testBot)
+	assert.Equal(t, "102", offset)
+	held, _ := a.Leases.Acquire(context.Background(), testBot)
+	err := a.runSchedule(context.Background(), job)
+	assert.ErrorIs(t, err, schedule.ErrSkip, "Expected the run skipped while the bot is leased")
+	assert.Equal(t, "bot is being polled elsewhere", scheduleReason(err))
+	held.Release()
+
+	// the schedules api has only the reason of a failed run, never the error
+	broker.down = true
+	err = a.runSchedule(context.Background(), job)
+	assert.NotNil(t, err, "Expected the run failed while the broker is down")
+	assert.Equal(t, "run failed, see the logs", scheduleReason(err))
+	broker.down = false
+	srv.Close()
+	err = a.runSchedule(context.Background(), job)
+	assert.Equal(t, "scrape failed: unreachable", scheduleReason(err))
+
+	rec = request(r, "DELETE", "/v1/schedules/morning", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = request(r, "GET", "/v1/schedules/morning", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestProcessors(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	var err error
+	a.Profiles, err = profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    processors:
+      - type: filter
+        params: {text: "world", invert: true}
+      - type: enrich
+        params: {fields: {env: test}}
+      - type: route
+        params: {kinds: [message], topic: "{{.Bot}}.chat.{{.ChatID}}"}
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0?dry_run=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	report := dryRunReport{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	assert.Equal(t, 2, len(report.Routes))
+	assert.Equal(t, testBot+".chat.1", report.Routes[0].Topic, "Expected the topic from the processor")
+	assert.True(t, report.Routes[1].Dropped, "Expected the update left out by the processor reported")
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 1, len(broker.published), "Expected only what the processors let through published")
+	assert.Equal(t, testBot+".chat.1", broker.published[0].Topic)
+	assert.Equal(t, "test", broker.published[0].Msg.Headers["env"], "Expected the enriched field in the headers")
+	result := scrapers.ScrapeResult{}
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	assert.Equal(t, []string{"hello"}, result.AllMessages)
+	assert.Equal(t, "102", result.NextUpdateOffset, "Offset should not change for the dropped updates")
+}
+
+func TestBotCommands(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	group := models.Chat{ChatID: "-1", Typ: "group"}
+	srv.AddBot(testToken).Push(
+		models.Update{Message: &models.UpdateMessage{Text: "/arm@bot6425245255_bot zone2 \"back door\"", Chat: group,
+			Entities: []models.Entity{{Type: "bot_command", Offset: 0, Length: 22}}}},
+		models.Update{Message: &models.UpdateMessage{Text: "/arm@other_bot zone1", Chat: group,
+			Entities: []models.Entity{{Type: "bot_command", Offset: 0, Length: 14}}}},
+		models.Update{Message: &models.UpdateMessage{Text: "hello", Chat: group}},
+	)
+	a, broker, r := newTestApp(t, srv.URL)
+	var err error
+	a.Profiles, err = profiles.Parse([]byte(`
+defaults:
+  encoder: json
+  processors: [{type: commands}]
+`))
+	assert.Nil(t, err, "Unexpected error parsing the profiles")
+
+	// getMe failing, the command with a mention cannot be told apart & nothing is published
+	srv.Fail("getMe", telegramtest.Failure{Status: http.StatusInternalServerError, Description: "Internal Server Error"})
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 0, len(broker.published), "Expected nothing published when the username isnt known")
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 2, len(broker.published), "Expected the command for the other bot dropped")
+	assert.Equal(t, testBot+".commands.arm", broker.published[0].Topic)
+	assert.Equal(t, testBot+".updates", broker.published[1].Topic, "Expected what isnt a command routed as per the profile")
+	updt := models.Update{}
+	assert.Nil(t, json.Unmarshal(broker.published[0].Msg.Body, &updt))
+	assert.Equal(t, &models.Command{Name: "arm", Args: []string{"zone2", "back door"}, RawArgs: `zone2 "back door"`, Mention: "bot6425245255_bot"}, updt.Command)
+	assert.Equal(t, "arm", broker.published[0].Msg.Headers["command"])
+
+	request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, 2, srv.Calls("getMe"), "Expected the username of the bot looked up once it was found")
+}
+
+func TestDefaultCommands(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	srv.AddBot(testToken).Push(
+		models.Update{Message: &models.UpdateMessage{Text: "/status", Chat: models.Chat{ChatID: "1", Typ: "private"}}},
+		models.Update{Message: &models.UpdateMessage{Text: "hello", Chat: models.Chat{ChatID: "1", Typ: "private"}}},
+	)
+	_, broker, r := newTestApp(t, srv.URL) // no profiles file, all the defaults
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 2, len(broker.published))
+	assert.Equal(t, testBot+".commands.status", broker.published[0].Topic, "Expected the command routed without any profile")
+	assert.Equal(t, testBot+".updates", broker.published[1].Topic)
+}
+
+func TestBotUsername(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	srv.Fail("getMe", telegramtest.Failure{Delay: 200 * time.Millisecond})
+	a, _, _ := newTestApp(t, srv.URL)
+
+	var wg sync.WaitGroup
+	names := make([]string, 5)
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names[i], _ = a.botUsername(context.Background(), testBot)
+		}(i)
+	}
+	// lookup of another bot does not wait on the slow getMe
+	start := time.Now()
+	_, err := a.botUsername(context.Background(), "6133190482")
+	assert.NotNil(t, err, "Expected error for a bot that isnt registered")
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "Expected lookups of other bots not blocked")
+	wg.Wait()
+	assert.Equal(t, []string{"bot6425245255_bot", "bot6425245255_bot", "bot6425245255_bot", "bot6425245255_bot", "bot6425245255_bot"}, names)
+	assert.Equal(t, 1, srv.Calls("getMe"), "Expected the lookups at the same time to share one getMe")
+}
+
+func TestDedupe(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	_, broker, r := newTestApp(t, srv.URL)
+
+	rec := request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 2, len(broker.published))
+	assert.Equal(t, testBot+".100", broker.published[0].Msg.MessageId, "Expected the message id from the bot & the update")
+	assert.Equal(t, testBot+".100", broker.published[0].Msg.Headers["x-deduplication-header"])
+
+	// caller did not get the response & retries from the same offset
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	assert.Equal(t, 2, len(broker.published), "Expected the updates published earlier skipped")
+	result := scrapers.ScrapeResult{}
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	assert.Equal(t, 2, result.Duplicates)
+	assert.Equal(t, 0, result.UpdateCount)
+	assert.Equal(t, "102", result.NextUpdateOffset, "Offset should move on past the duplicates")
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0?dry_run=true", "")
+	report := dryRunReport{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	assert.Equal(t, 2, len(report.Routes))
+	assert.True(t, report.Routes[0].Dropped, "Expected the duplicates reported as dropped")
+}
+
+func TestAccess(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	srv.AddBot(testToken).Push(
+		models.Update{Message: &models.UpdateMessage{Text: "hello", Chat: models.Chat{ChatID: "5157350442", Typ: "private"}, From: models.Sender{SenderID: "5157350442", UName: "alice"}}},
+		models.Update{Message: &models.UpdateMessage{Text: "spam", Chat: models.Chat{ChatID: "7002", Typ: "private"}, From: models.Sender{SenderID: "7002", UName: "mallory"}}},
+		models.Update{Message: &models.UpdateMessage{Text: "hi all", Chat: models.Chat{ChatID: "-1001", Typ: "group"}, From: models.Sender{SenderID: "5157350442", UName: "alice"}}},
+		models.Update{Message: &models.UpdateMessage{Text: "spam again", Chat: models.Chat{ChatID: "7002", Typ: "private"}, From: models.Sender{SenderID: "7002", UName: "mallory"}}},
+	)
+	_, broker, r := newTestApp(t, srv.URL)
+
+	rec := request(r, "GET", "/v1/bots/"+testBot+"/access", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	view := accessView{}
+	json.Unmarshal(rec.Body.Bytes(), &view)
+	assert.Equal(t, "none", view.Source, "Expected no rules by default")
+	assert.Nil(t, view.Rules)
+	rec = request(r, "GET", "/v1/bots/6133190482/access", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Expected 404 for a bot that isnt registered")
+
+	rules := `{"private_only": true, "deny": [{"username": "@Mallory"}], "on_reject": "route", "reply": "This bot is private"}`
+	rec = request(r, "PUT", "/v1/bots/6133190482/access", rules)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Expected 404 for a bot that isnt registered")
+	rec = request(r, "PUT", "/v1/bots/"+testBot+"/access", `{"allow": [{}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "Expected 400 for an empty match")
+	rec = request(r, "PUT", "/v1/bots/"+testBot+"/access", rules)
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	json.Unmarshal(rec.Body.Bytes(), &view)
+	assert.Equal(t, "api", view.Source)
+
+	rec = request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+	topics := map[string][]string{}
+	for _, p := range broker.published {
+		topics[p.Topic] = append(topics[p.Topic], string(p.Msg.Body))
+	}
+	assert.Equal(t, []string{"hello"}, topics[testBot+".updates"])
+	assert.Equal(t, []string{"spam", "hi all", "spam again"}, topics[testBot+".rejected"], "Expected the rejected updates routed")
+	assert.Equal(t, "denied", broker.published[1].Msg.Headers["rejected_reason"])
+	assert.Equal(t, 2, len(topics[testBot+".outbox"]), "Expected a reply queued for each chat, once")
+	assert.Contains(t, topics[testBot+".outbox"][0], `"text":"This bot is private"`)
+
+	rec = request(r, "DELETE", "/v1/bots/"+testBot+"/access", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = request(r, "DELETE", "/v1/bots/"+testBot+"/access", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Expected 404 when the bot follows its profile")
+}
+
+func TestReadyz(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	readyz := func(a *App) (int, health.Report) {
+		r, err := a.Router()
+		assert.Nil(t, err)
+		rec := request(r, "GET", "/readyz", "")
+		report := health.Report{}
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, report
+	}
+	a, _, _ := newTestApp(t, srv.URL)
+	code, report := readyz(a)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusUp, report.Status)
+
+	// every token revoked, the pod stays in the service so the replacement token can be staged
+	a, _, _ = newTestApp(t, srv.URL)
+	a.Registry.Revoke(testBot, testToken)
+	code, report = readyz(a)
+	assert.Equal(t, http.StatusOK, code, "Expected ready without active tokens: %+v", report)
+	assert.Equal(t, health.StatusDegraded, report.Status)
+	r, _ := a.Router()
+	rec := request(r, "PUT", "/v1/bots/"+testBot+"/token", fmt.Sprintf(`{"token":"%s"}`, testPending))
+	assert.Equal(t, http.StatusOK, rec.Code, "Expected the replacement token staged: %s", rec.Body.String())
+
+	// telegram unreachable degrades, the report has only the reason
+	down := fakeTelegram(testToken)
+	down.Close()
+	a, _, _ = newTestApp(t, down.URL)
+	r, _ = a.Router()
+	rec = request(r, "GET", "/readyz", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "getMe failed: unreachable")
+	assert.NotContains(t, rec.Body.String(), testToken, "Unexpected token in the readiness report")
+
+	// broker down, or draining takes the pod out of the service
+	a, broker, _ := newTestApp(t, srv.URL)
+	broker.down = true
+	code, report = readyz(a)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusDown, report.Status)
+	a, _, _ = newTestApp(t, srv.URL)
+	close(a.draining)
+	code, _ = readyz(a)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestAlerts(t *testing.T) {
+	srv := fakeTelegram() // refuses all tokens
+	defer srv.Close()
+	a, broker, r := newTestApp(t, srv.URL)
+	var mu sync.Mutex
+	sent := []string{}
+	a.Alerts.Notify = func(text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, text)
+		return nil
+	}
+	a.Alerts.DownAfter = 0 // broker down is alerted on the first failure
+
+	request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	request(r, "POST", "/v1/bots/"+testBot+"/scrape/0", "")
+	a.Alerts.Wait()
+	assert.Equal(t, 1, len(sent), "Expected revoked token alerted once: %v", sent)
+	assert.Contains(t, sent[0], string(alerts.KindTokenRevoked))
+
+	r.GET("/boom", func(ctx *gin.Context) { panic("boom") })
+	rec := request(r, "GET", "/boom", "")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "Expected panic recovered as 500")
+	e := api.Error{}
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	assert.Equal(t, api.CodeInternal, e.Code, "Expected the error envelope")
+	a.Alerts.Wait()
+	assert.Equal(t, 2, len(sent), "Expected panic alerted: %v", sent)
+	assert.Contains(t, sent[1], "boom")
+
+	broker.down = true
+	a.Broker.Open()
+	a.Alerts.Wait()
+	assert.Equal(t, 3, len(sent), "Expected broker down alerted: %v", sent)
+	assert.Contains(t, sent[2], string(alerts.KindBrokerDown))
+	broker.down = false
+	a.Broker.Open()
+	a.Alerts.Wait()
+	assert.Equal(t, 4, len(sent), "Expected broker recovery sent: %v", sent)
+
+	// "GET /long: " is 11 bytes, the 3 byte runes after it have the 1000th byte in the middle of one
+	r.GET("/long", func(ctx *gin.Context) { panic(strings.Repeat("€", 400)) })
+	request(r, "GET", "/long", "")
+	a.Alerts.Wait()
+	assert.Equal(t, 5, len(sent), "Expected panic alerted: %v", sent)
+	assert.True(t, utf8.ValidString(sent[4]), "Expected the truncated alert valid utf-8")
+	assert.Contains(t, sent[4], strings.Repeat("€", 329))
+}
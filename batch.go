@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/tracing"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batchBot : bot and the offset from which to get the updates
+type batchBot struct {
+	Bot    string `json:"bot"`
+	Offset string `json:"offset"`
+}
+
+// batchScrapeRequest : payload for the batch scrape, either a list of bots or all the registered bots
+type batchScrapeRequest struct {
+	Bots    []batchBot `json:"bots"`
+	All     bool       `json:"all"`     // all registered bots are scraped, offsets from Bots are used where given, else 0
+	Workers int        `json:"workers"` // concurrent scrapes, cannot be more than a.Config.BatchWorkers
+}
+
+// batchBotResult : outcome for a single bot, either the result or the error
+type batchBotResult struct {
+	Bot    string                 `json:"bot"`
+	Offset string                 `json:"offset"` // offset that was requested
+	Result *scrapers.ScrapeResult `json:"result,omitempty"`
+	Error  *api.Error             `json:"error,omitempty"`
+}
+
+type batchScrapeResponse struct {
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []batchBotResult `json:"results"`
+}
+
+// batchBots : bots for the batch in the order requested, or sorted by bot id when all bots are requested
+func (a *App) batchBots(req batchScrapeRequest) []batchBot {
+	if !req.All {
+		return req.Bots
+	}
+	offsets := map[string]string{}
+	for _, b := range req.Bots {
+		offsets[b.Bot] = b.Offset
+	}
+	result := []batchBot{}
+	for _, st := range a.Registry.Statuses() {
+		offset, ok := offsets[st.UID]
+		if !ok {
+			offset = "0"
+		}
+		result = append(result, batchBot{Bot: st.UID, Offset: offset})
+	}
+	return result
+}
+
+// HndlBatchScrape : scrapes many bots concurrently and publishes each result.
+// Response has the result or the error for each of the bots, status is 200 even when some of the bots have failed.
+func (a *App) HndlBatchScrape(ctx *gin.Context) {
+	req := batchScrapeRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil || (!req.All && len(req.Bots) == 0) {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid payload, expected list of bots or all", nil)
+		return
+	}
+	workers := req.Workers
+	if workers <= 0 || workers > a.Config.BatchWorkers {
+		workers = a.Config.BatchWorkers
+	}
+	conn, err := a.Broker.Open()
+	if err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"server": a.Config.AMQP.Server,
+			"err":    err,
+		}).Error("failed HndlBatchScrape: unsuccessful rabbit dial connection")
+		api.Abort(ctx, http.StatusBadGateway, api.CodeGatewayFailed, "One or more gateway connections have failed", nil)
+		return
+	}
+	defer conn.Close()
+
+	bots := a.batchBots(req)
+	reqCtx, span := tracing.Tracer().Start(ctx.Request.Context(), "batch scrape", trace.WithAttributes(attribute.Int("batch.bots", len(bots))))
+	defer span.End()
+	// bots that are polled elsewhere arent scraped, they are reported busy
+	jobs := []scrapers.BatchJob{}
+	unleased := map[int]error{} // by index, a bot may be in the batch more than once
+	for i, b := range bots {
+		l, err := a.acquireLease(reqCtx, b.Bot)
+		if err != nil {
+			unleased[i] = err
+			continue
+		}
+		defer releaseLease(reqCtx, b.Bot, l)
+		job := a.newScrapeJob(b.Bot, b.Offset)
+		job.Config.Context = reqCtx
+		jobs = append(jobs, job)
+	}
+	var publishMu sync.Mutex // publishing is over a single channel, one worker at a time
+	results := scrapers.ScrapeBatch(jobs, workers, func(sr *scrapers.ScrapeResult) error {
+		publishMu.Lock()
+		defer publishMu.Unlock()
+		return a.publishResult(reqCtx, conn, sr)
+	})
+	resp := batchScrapeResponse{Results: []batchBotResult{}}
+	next := 0
+	for i, b := range bots {
+		br := batchBotResult{Bot: b.Bot, Offset: b.Offset}
+		if err, ok := unleased[i]; ok {
+			resp.Failed++
+			_, envelope := scrapeErrEnvelope(err)
+			br.Error = &envelope
+			resp.Results = append(resp.Results, br)
+			continue
+		}
+		r := results[next]
+		next++
+		if r.Err != nil {
+			resp.Failed++
+			logging.From(reqCtx).WithFields(log.Fields{
+				"bot":    b.Bot,
+				"offset": b.Offset,
+				"err":    r.Err,
+			}).Error("failed HndlBatchScrape: bot not scraped")
+			_, envelope := scrapeErrEnvelope(r.Err)
+			if r.Result != nil {
+				// scrape was a success, its the publishing that failed
+				envelope = api.Error{Code: api.CodeGatewayFailed, Message: "failed to publish the updates"}
+			}
+			br.Error = &envelope
+		} else {
+			resp.Succeeded++
+			br.Result = r.Result
+		}
+		resp.Results = append(resp.Results, br)
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"bots":      len(jobs),
+		"workers":   workers,
+		"succeeded": resp.Succeeded,
+		"failed":    resp.Failed,
+	}).Debug("batch scrape done")
+	ctx.AbortWithStatusJSON(http.StatusOK, resp)
+}
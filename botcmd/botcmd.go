@@ -0,0 +1,98 @@
+// Parses the bot command a message starts with, /name@bot args - so that consumers dont have to parse the raw text.
+
+// Telegram marks the command with a bot_command entity, messages without entities are parsed from the text.
+// Arguments are split on white space, quoted arguments are kept together - with straight or curly quotes since phones send both.
+package botcmd
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/eensymachines/tgramscraper/models"
+)
+
+// names as telegram allows them for the bot commands
+var rgxName = regexp.MustCompile(`^[A-Za-z0-9_]{1,32}$`)
+
+// quotes : closing quote for each of the opening quotes
+var quotes = map[rune]rune{'"': '"', '\'': '\'', '“': '”', '‘': '’'}
+
+// Parse : command the message starts with, false if the message isnt a command
+func Parse(m *models.UpdateMessage) (*models.Command, bool) {
+	if m == nil || !strings.HasPrefix(m.Text, "/") {
+		return nil, false
+	}
+	head, rest := "", ""
+	if len(m.Entities) > 0 {
+		// telegram has marked the command, if it hasnt then the text only looks like one
+		found := false
+		units := utf16.Encode([]rune(m.Text))
+		for _, e := range m.Entities {
+			if e.Type == "bot_command" && e.Offset == 0 && e.Length > 0 && e.Length <= len(units) {
+				head, rest = string(utf16.Decode(units[:e.Length])), string(utf16.Decode(units[e.Length:]))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	} else {
+		head, rest = m.Text, ""
+		if i := strings.IndexFunc(m.Text, unicode.IsSpace); i >= 0 {
+			head, rest = m.Text[:i], m.Text[i:]
+		}
+	}
+	name, mention, _ := strings.Cut(strings.TrimPrefix(head, "/"), "@")
+	if !rgxName.MatchString(name) {
+		return nil, false
+	}
+	raw := strings.TrimSpace(rest)
+	return &models.Command{Name: strings.ToLower(name), Args: SplitArgs(raw), RawArgs: raw, Mention: mention}, true
+}
+
+// For : true if the command is for the bot with the username, commands without a mention are for all the bots in the chat
+func For(cmd *models.Command, username string) bool {
+	return cmd.Mention == "" || strings.EqualFold(strings.TrimPrefix(username, "@"), cmd.Mention)
+}
+
+// SplitArgs : arguments separated by white space, quoted arguments are one each without the quotes.
+// Backslash escapes the next character other than within single quotes, a quote that isnt closed runs till the end
+func SplitArgs(s string) []string {
+	result := []string{}
+	arg := strings.Builder{}
+	inArg, escaped := false, false
+	var closing rune // closing quote of the quote we are in, 0 when not in a quote
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && closing != '\'' && closing != '’':
+			inArg, escaped = true, true
+		case closing != 0:
+			if r == closing {
+				closing = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case quotes[r] != 0:
+			inArg, closing = true, quotes[r]
+		case unicode.IsSpace(r):
+			if inArg {
+				result = append(result, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			arg.WriteRune(r)
+		}
+	}
+	if inArg {
+		result = append(result, arg.String())
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package botcmd
+
+import (
+	"testing"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, notCmd := range []*models.UpdateMessage{
+		nil,
+		{Text: "just chatting"},
+		{Text: "/"},
+		{Text: "/usr/bin is where it is"},
+		{Text: "/status", Entities: []models.Entity{{Type: "url", Offset: 0, Length: 7}}}, // telegram didnt mark it a command
+		{Text: "see /status", Entities: []models.Entity{{Type: "bot_command", Offset: 4, Length: 7}}},
+	} {
+		_, ok := Parse(notCmd)
+		assert.False(t, ok, "Expected not a command: %v", notCmd)
+	}
+	cmd, ok := Parse(&models.UpdateMessage{Text: "/Arm@Home_bot zone2 \"back door\"", Entities: []models.Entity{{Type: "bot_command", Offset: 0, Length: 13}}})
+	assert.True(t, ok)
+	assert.Equal(t, &models.Command{Name: "arm", Args: []string{"zone2", "back door"}, RawArgs: "zone2 \"back door\"", Mention: "Home_bot"}, cmd)
+	cmd, ok = Parse(&models.UpdateMessage{Text: "/status"})
+	assert.True(t, ok, "Messages without entities are parsed from the text")
+	assert.Equal(t, &models.Command{Name: "status", Args: []string{}}, cmd)
+	// offsets are in utf-16, emoji take 2 units
+	cmd, ok = Parse(&models.UpdateMessage{Text: "/say\n😀 hi", Entities: []models.Entity{{Type: "bot_command", Offset: 0, Length: 4}, {Type: "mention", Offset: 8, Length: 2}}})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"😀", "hi"}, cmd.Args)
+
+	assert.True(t, For(&models.Command{Name: "status"}, "home_bot"), "Commands without mention are for all bots")
+	assert.True(t, For(&models.Command{Name: "status", Mention: "Home_Bot"}, "@home_bot"), "Usernames are case insensitive")
+	assert.False(t, For(&models.Command{Name: "status", Mention: "other_bot"}, "home_bot"))
+}
+
+func TestSplitArgs(t *testing.T) {
+	for in, want := range map[string][]string{
+		"":                        {},
+		"  zone2   now ":          {"zone2", "now"},
+		`"back door" 'it''s' x`:   {"back door", "its", "x"},
+		`“smart quotes” ‘too’`:    {"smart quotes", "too"},
+		`a\ b "say \"hi\"" ''`:    {"a b", `say "hi"`, ""},
+		`'no \escape' "unclosed`:  {`no \escape`, "unclosed"},
+		"multi\nline\targs":       {"multi", "line", "args"},
+		`mixed"quo ted"parts end`: {"mixedquo tedparts", "end"},
+	} {
+		assert.Equal(t, want, SplitArgs(in), "Unexpected args for %q", in)
+	}
+}
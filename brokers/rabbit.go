@@ -1,23 +1,40 @@
 package brokers
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/tracing"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Payload sent back by RabbitConnDial that holds pointers to functions for operating on the broker further.
 // Is the context object that can provide for further functions to call in the context of the given connection.
 type RabbitConnResult struct {
 	Publish func(message []byte, excName, topic string) error // publishing messages to exchanges
+	// publishing with the content type, headers and other properties set by the caller
+	PublishMessage func(excName, topic string, msg amqp.Publishing) error
+	// publishing under a span, child of the span in ctx if any. Trace context is injected in the message headers
+	PublishContext func(ctx context.Context, excName, topic string, msg amqp.Publishing) error
 	// A queue per listener.
 	// A single listener can have 2 queues bound to the same exchange, but most probably with distinct topics
 	// trying to call this function with identical names for the same exchange and topic will do nothing
 	// 2 or more listeners cannot have a single queue, fan in isnt allowed.
 	BindAQueue    func(name, excName, topic string) error // binds a queue with a name to an exchange under a specific topic
 	ListenOnQueue func(name string) (<-chan amqp.Delivery, error)
-	CloseConn     func() // closes the connection
+	// ConsumeQueue : unlike ListenOnQueue deliveries have to be acked, and only one unacked delivery at a time
+	ConsumeQueue func(name string) (<-chan amqp.Delivery, error)
+	QueueDepth   func(name string) (int, error) // count of messages ready in the queue, queue has to exist
+	// DeclareExchange : durable exchange of the kind (topic, direct, fanout..), does nothing if it exists with the same kind
+	DeclareExchange func(name, kind string) error
+	// ListenTemporary : messages on the exchange under any of the topics, over a queue that is deleted when the connection closes
+	ListenTemporary func(excName string, topics ...string) (<-chan amqp.Delivery, error)
+	CloseConn       func() // closes the connection
 }
 
 // RabbitConnDial is a closure around amqp.Connection, that lets you do publishing and listening on a exchange and queue
@@ -37,13 +54,41 @@ func RabbitConnDial(user, passwd, server string) (*RabbitConnResult, error) {
 	log.WithFields(log.Fields{
 		"channel_isnotnil": conn != nil,
 	}).Debug("established channel to rabbitmq broker")
+	publish := func(ctx context.Context, excName, topic string, msg amqp.Publishing) error {
+		ctx, span := tracing.Tracer().Start(ctx, fmt.Sprintf("%s publish", excName), trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "rabbitmq"),
+				attribute.String("messaging.destination.name", excName),
+				attribute.String("messaging.rabbitmq.destination.routing_key", topic),
+				attribute.Int("messaging.message.body.size", len(msg.Body)),
+			))
+		defer span.End()
+		tracing.InjectAMQP(ctx, &msg) // headers are a copy from here on
+		if id := logging.RequestID(ctx); id != "" {
+			msg.Headers[logging.RequestIDAMQP] = id
+		}
+		if err := ch.Publish(excName, topic, false, false, msg); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to publish")
+			return err
+		}
+		logging.From(ctx).WithFields(log.Fields{
+			"exchange": excName,
+			"topic":    topic,
+		}).Debug("published")
+		return nil
+	}
 	return &RabbitConnResult{
 		Publish: func(message []byte, excName, topic string) error {
-			return ch.Publish(excName, topic, false, false, amqp.Publishing{
+			return publish(context.Background(), excName, topic, amqp.Publishing{
 				ContentType: "text/plain",
 				Body:        message,
 			})
 		},
+		PublishMessage: func(excName, topic string, msg amqp.Publishing) error {
+			return publish(context.Background(), excName, topic, msg)
+		},
+		PublishContext: publish,
 		BindAQueue: func(name, excName, topic string) error {
 			// Binding 2 queues with the same name to the same exchange subscribing to the same topic will do nothing.
 			// Will NOT create a new queue.
@@ -57,6 +102,35 @@ func RabbitConnDial(user, passwd, server string) (*RabbitConnResult, error) {
 		ListenOnQueue: func(name string) (<-chan amqp.Delivery, error) {
 			return ch.Consume(name, "", true, false, false, false, nil)
 		},
+		ConsumeQueue: func(name string) (<-chan amqp.Delivery, error) {
+			if err := ch.Qos(1, 0, false); err != nil {
+				return nil, err
+			}
+			return ch.Consume(name, "", false, false, false, false, nil)
+		},
+		QueueDepth: func(name string) (int, error) {
+			q, err := ch.QueueInspect(name)
+			if err != nil {
+				return 0, err
+			}
+			return q.Messages, nil
+		},
+		DeclareExchange: func(name, kind string) error {
+			return ch.ExchangeDeclare(name, kind, true, false, false, false, nil)
+		},
+		ListenTemporary: func(excName string, topics ...string) (<-chan amqp.Delivery, error) {
+			// server named, exclusive & auto deleted - nothing is left behind on the broker
+			q, err := ch.QueueDeclare("", false, true, true, false, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, topic := range topics {
+				if err := ch.QueueBind(q.Name, topic, excName, false, nil); err != nil {
+					return nil, err
+				}
+			}
+			return ch.Consume(q.Name, "", true, true, false, false, nil)
+		},
 		CloseConn: func() {
 			ch.Close()
 			conn.Close()
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/eensymachines/tgramscraper/access"
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/offsets"
+	"github.com/eensymachines/tgramscraper/profiles"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/senders"
+	log "github.com/sirupsen/logrus"
+)
+
+// command : subcommand of the binary, args are what follow the name of the command on the command line
+type command struct {
+	name  string
+	usage string
+	run   func(cfg *config.Config, args []string, out io.Writer) error
+}
+
+// commands : serve is what runs when there isnt any command, as it always did
+var commands = []command{
+	{"serve", "runs the http server, the default", cmdServe},
+	{"scrape", "scrape -bot X [-offset N] [-publish] : one-shot scrape, without the http hop", cmdScrape},
+	{"bots", "bots list|check : registered bots as getMe has them, check fails if any token is refused", cmdBots},
+	{"topology", "topology apply : declares the exchanges of the bot profiles and binds the outbox queues", cmdTopology},
+	{"offsets", "offsets get [-bot X] | set -bot X -offset N : offsets the one-shot scrapes pick up from", cmdOffsets},
+	{"tail", "tail -bot X [-topics a,b] : prints the updates of the bot as they are published on the broker, commands and rejected included", cmdTail},
+}
+
+// runCommand : runs the command from cfg.Args, serve when there isnt one
+func runCommand(cfg *config.Config, out io.Writer) error {
+	name, args := "serve", []string{}
+	if len(cfg.Args) > 0 {
+		name, args = cfg.Args[0], cfg.Args[1:]
+	}
+	if name == "help" {
+		printCommands(out)
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(cfg, args, out)
+		}
+	}
+	printCommands(os.Stderr)
+	return fmt.Errorf("unknown command %s", name)
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	tw.Flush()
+}
+
+// commandFlags : flagset for the command, errors are printed with the usage of the command
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// subcommand : first of the args is the subcommand, has to be one of the expected
+func subcommand(cmd string, args []string, expected ...string) (string, []string, error) {
+	if len(args) > 0 {
+		for _, e := range expected {
+			if args[0] == e {
+				return args[0], args[1:], nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("%s needs one of %s", cmd, strings.Join(expected, ", "))
+}
+
+// cmdScrape : scrapes the bot once, from the offset given or the stored offset.
+// With -publish the updates go to the broker, same as the scrape trigger, and the next offset is stored
+func cmdScrape(cfg *config.Config, args []string, out io.Writer) error {
+	fs := commandFlags("scrape")
+	bot := fs.String("bot", "", "id of the bot to scrape, required")
+	offset := fs.String("offset", "", "update offset to scrape from, the stored offset of the bot when not given")
+	publish := fs.Bool("publish", false, "publishes the updates and stores the next offset, else the updates are only printed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *bot == "" {
+		return fmt.Errorf("scrape needs -bot")
+	}
+	a, err := loadApp(cfg)
+	if err != nil {
+		return err
+	}
+	return a.scrapeOnce(*bot, *offset, *publish, out)
+}
+
+func (a *App) scrapeOnce(bot, offset string, publish bool, out io.Writer) error {
+	result, err := a.scrapeStored(context.Background(), bot, offset, publish)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// scrapeStored : scrapes the bot from the offset, or its stored offset when empty.
+// When publishing, the next offset is stored once the updates are with the broker - the one-shot scrapes & the schedules pick up from there
+func (a *App) scrapeStored(ctx context.Context, bot, offset string, publish bool) (*scrapers.ScrapeResult, error) {
+	// the stored offset is read & moved under the lease, a replica polling the bot alongside would read it twice
+	l, err := a.acquireLease(ctx, bot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease bot %s: %w", bot, err)
+	}
+	defer releaseLease(ctx, bot, l)
+	if offset == "" {
+		stored, ok, err := a.Offsets.Get(bot)
+		if err != nil {
+			return nil, err
+		}
+		offset = "0"
+		if ok {
+			offset = stored
+		}
+	}
+	job := a.newScrapeJob(bot, offset)
+	job.Config.Context = ctx
+	result, err := job.Scraper.Scrape(job.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape bot %s: %w", bot, err)
+	}
+	if !publish {
+		return result, nil
+	}
+	conn, err := a.Broker.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMQP server %s: %s", a.Config.AMQP.Server, err)
+	}
+	defer conn.Close()
+	if err := a.publishResult(ctx, conn, result); err != nil {
+		return nil, err
+	}
+	// offset only moves on once the updates are safely with the broker, updates that were all dropped move it on too
+	if len(result.Updates)+len(result.Dropped) > 0 {
+		if err := a.Offsets.Set(bot, result.NextUpdateOffset); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// cmdBots : getMe for each of the registered bots
+func cmdBots(cfg *config.Config, args []string, out io.Writer) error {
+	sub, _, err := subcommand("bots", args, "list", "check")
+	if err != nil {
+		return err
+	}
+	a, err := loadApp(cfg)
+	if err != nil {
+		return err
+	}
+	return a.listBots(out, sub == "check")
+}
+
+// listBots : id, state and username of each bot. When strict, any bot that fails getMe is an error
+func (a *App) listBots(out io.Writer, strict bool) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BOT\tSTATE\tUSERNAME\tGETME")
+	failed := 0
+	statuses := a.Registry.Statuses()
+	for _, st := range statuses {
+		me, err := a.telegram(st.UID, "").GetMe(scrapers.ScrapeConfig{RequestTimeout: a.Profiles.For(st.UID).RequestTimeout, Transport: a.Transport})
+		if err != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\t%s\t-\t%s\n", st.UID, st.State, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t@%s\tok\n", st.UID, st.State, me.UName)
+	}
+	tw.Flush()
+	if strict && failed > 0 {
+		return fmt.Errorf("%d of %d bots failed getMe", failed, len(statuses))
+	}
+	return nil
+}
+
+// cmdTopology : exchanges & queues the service expects on the broker
+func cmdTopology(cfg *config.Config, args []string, out io.Writer) error {
+	if _, _, err := subcommand("topology", args, "apply"); err != nil {
+		return err
+	}
+	a, err := loadApp(cfg)
+	if err != nil {
+		return err
+	}
+	return a.applyTopology(out)
+}
+
+// applyTopology : exchanges from the bot profiles are declared as durable topic exchanges, amq.* are built into the broker.
+// Outbox queue of each bot is bound the same as the outbox consumer binds it
+func (a *App) applyTopology(out io.Writer) error {
+	conn, err := a.Broker.Dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to AMQP server %s: %s", a.Config.AMQP.Server, err)
+	}
+	defer conn.CloseConn()
+	exchanges := map[string]bool{}
+	for _, st := range a.Registry.Statuses() {
+		exchanges[a.Profiles.For(st.UID).Exchange] = true
+	}
+	names := make([]string, 0, len(exchanges))
+	for name := range exchanges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, "amq.") {
+			fmt.Fprintf(out, "exchange %s: built in, skipped\n", name)
+			continue
+		}
+		if err := conn.DeclareExchange(name, "topic"); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %s", name, err)
+		}
+		fmt.Fprintf(out, "exchange %s: declared\n", name)
+	}
+	for _, st := range a.Registry.Statuses() {
+		queue := senders.OutboxQueue(st.UID)
+		if err := conn.BindAQueue(queue, "amq.topic", queue); err != nil {
+			return fmt.Errorf("failed to bind outbox queue %s: %s", queue, err)
+		}
+		fmt.Fprintf(out, "queue %s: bound to amq.topic\n", queue)
+	}
+	return nil
+}
+
+// cmdOffsets : reads or corrects the stored offsets
+func cmdOffsets(cfg *config.Config, args []string, out io.Writer) error {
+	sub, args, err := subcommand("offsets", args, "get", "set")
+	if err != nil {
+		return err
+	}
+	fs := commandFlags("offsets " + sub)
+	bot := fs.String("bot", "", "id of the bot, all bots when getting and not given")
+	offset := fs.String("offset", "", "offset to set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store := offsets.NewFileStore(cfg.OffsetsFile) // neither the registry nor the broker is needed here
+	if sub == "set" {
+		if *bot == "" || *offset == "" {
+			return fmt.Errorf("offsets set needs -bot and -offset")
+		}
+		return store.Set(*bot, *offset)
+	}
+	return printOffsets(store, *bot, out)
+}
+
+// printOffsets : offset of the bot, or of all the bots when bot is empty
+func printOffsets(store offsets.Store, bot string, out io.Writer) error {
+	all, err := store.All()
+	if err != nil {
+		return err
+	}
+	if bot != "" {
+		offset, ok := all[bot]
+		if !ok {
+			return fmt.Errorf("no offset stored for bot %s", bot)
+		}
+		all = map[string]string{bot: offset}
+	}
+	bots := make([]string, 0, len(all))
+	for b := range all {
+		bots = append(bots, b)
+	}
+	sort.Strings(bots)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BOT\tOFFSET")
+	for _, b := range bots {
+		fmt.Fprintf(tw, "%s\t%s\n", b, all[b])
+	}
+	return tw.Flush()
+}
+
+// tailPatterns : binding keys for all that is published for the bot - the updates as the profile routes them,
+// the commands and the rejected updates, and the extra patterns for topics of the route processors
+func tailPatterns(profile profiles.Profile, bot string, extra []string) ([]string, error) {
+	pattern, err := profile.TopicPattern(bot)
+	if err != nil {
+		return nil, err
+	}
+	patterns, seen := []string{}, map[string]bool{}
+	for _, p := range append([]string{pattern, bot + ".commands.*", access.RejectedTopic(bot)}, extra...) {
+		if p != "" && !seen[p] {
+			patterns = append(patterns, p)
+			seen[p] = true
+		}
+	}
+	return patterns, nil
+}
+
+// cmdTail : updates of the bot off the broker till interrupted, routing key and body each
+func cmdTail(cfg *config.Config, args []string, out io.Writer) error {
+	fs := commandFlags("tail")
+	bot := fs.String("bot", "", "id of the bot, required")
+	topics := fs.String("topics", "", "comma separated extra binding keys, for topics the route processors of the bot publish under")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *bot == "" {
+		return fmt.Errorf("tail needs -bot")
+	}
+	a, err := loadApp(cfg)
+	if err != nil {
+		return err
+	}
+	profile := a.Profiles.For(*bot)
+	patterns, err := tailPatterns(profile, *bot, strings.Split(*topics, ","))
+	if err != nil {
+		return err
+	}
+	conn, err := a.Broker.Dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to AMQP server %s: %s", cfg.AMQP.Server, err)
+	}
+	defer conn.CloseConn()
+	deliveries, err := conn.ListenTemporary(profile.Exchange, patterns...)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for %s: %s", profile.Exchange, strings.Join(patterns, ", "), err)
+	}
+	log.WithFields(log.Fields{
+		"exchange": profile.Exchange,
+		"topics":   patterns,
+	}).Info("tailing, ctrl+c to stop")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return fmt.Errorf("broker closed the channel")
+			}
+			fmt.Fprintf(out, "%s\t%s\n", d.RoutingKey, d.Body)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eensymachines/tgramscraper/offsets"
+	"github.com/eensymachines/tgramscraper/profiles"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeOnce(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, broker, _ := newTestApp(t, srv.URL)
+	a.Offsets = offsets.NewFileStore(filepath.Join(t.TempDir(), "offsets.json"))
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, a.scrapeOnce(testBot, "", false, out), "Unexpected error scraping without publishing")
+	result := scrapers.ScrapeResult{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &result), "Expected the result printed as json")
+	assert.Equal(t, 2, result.UpdateCount)
+	assert.Equal(t, 0, len(broker.published), "Expected nothing published without -publish")
+	_, ok, _ := a.Offsets.Get(testBot)
+	assert.False(t, ok, "Offset should not move without -publish")
+
+	assert.Nil(t, a.scrapeOnce(testBot, "", true, &bytes.Buffer{}), "Unexpected error scraping & publishing")
+	assert.Equal(t, 2, len(broker.published), "Expected updates published")
+	offset, ok, _ := a.Offsets.Get(testBot)
+	assert.True(t, ok, "Expected the next offset stored")
+	assert.Equal(t, "102", offset)
+
+	broker.down = true
+	assert.NotNil(t, a.scrapeOnce(testBot, "", true, &bytes.Buffer{}), "Expected error when the broker is down")
+	assert.NotNil(t, a.scrapeOnce("1111111111", "", false, &bytes.Buffer{}), "Expected error for a bot not registered")
+}
+
+func TestListBots(t *testing.T) {
+	srv := fakeTelegram(testToken)
+	defer srv.Close()
+	a, _, _ := newTestApp(t, srv.URL)
+	out := &bytes.Buffer{}
+	assert.Nil(t, a.listBots(out, true), "Unexpected error checking the bots")
+	assert.Contains(t, out.String(), testBot)
+	assert.False(t, strings.Contains(out.String(), testToken), "Tokens should never be printed")
+
+	refusing := fakeTelegram()
+	defer refusing.Close()
+	a, _, _ = newTestApp(t, refusing.URL)
+	assert.Nil(t, a.listBots(&bytes.Buffer{}, false), "list should not fail for a refused token")
+	assert.NotNil(t, a.listBots(&bytes.Buffer{}, true), "check should fail for a refused token")
+}
+
+func TestCommands(t *testing.T) {
+	a, _, _ := newTestApp(t, "http://localhost")
+	a.Config.Args = []string{"nosuchcommand"}
+	assert.NotNil(t, runCommand(a.Config, &bytes.Buffer{}), "Expected error for an unknown command")
+	a.Config.Args = []string{"bots", "remove"}
+	assert.NotNil(t, runCommand(a.Config, &bytes.Buffer{}), "Expected error for an unknown subcommand")
+
+	a.Config.OffsetsFile = filepath.Join(t.TempDir(), "offsets.json")
+	a.Config.Args = []string{"offsets", "set", "-bot", testBot, "-offset", "500"}
+	assert.Nil(t, runCommand(a.Config, &bytes.Buffer{}), "Unexpected error setting the offset")
+	out := &bytes.Buffer{}
+	a.Config.Args = []string{"offsets", "get"}
+	assert.Nil(t, runCommand(a.Config, out), "Unexpected error getting the offsets")
+	assert.Contains(t, out.String(), "500")
+}
+
+func TestTailPatterns(t *testing.T) {
+	patterns, err := tailPatterns(profiles.Default(), testBot, strings.Split("", ","))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testBot + ".updates", testBot + ".commands.*", testBot + ".rejected"}, patterns, "Expected the commands and the rejected updates tailed too")
+
+	p, err := profiles.Parse([]byte(`
+bots:
+  "` + testBot + `":
+    routing: "{{.Bot}}.{{.Kind}}.{{.ChatID}}"
+`))
+	assert.Nil(t, err)
+	patterns, err = tailPatterns(p.For(testBot), testBot, []string{"alerts.#", testBot + ".rejected"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testBot + ".*.*", testBot + ".commands.*", testBot + ".rejected", "alerts.#"}, patterns)
+}
@@ -0,0 +1,505 @@
+// Configuration of the service, layered - defaults < config file < environment < command line flags.
+
+// Each layer only overrides what it sets. Everything is validated at once so all the problems are reported together,
+// and nothing here touches the broker or the telegram server - loading the configuration has no side effects.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "******"
+
+// AMQP : broker connection, credentials from env or from the mounted secret files
+type AMQP struct {
+	Server      string `yaml:"server"`       // host:port of the rabbitmq server
+	User        string `yaml:"user"`         // empty to read from SecretMount/user
+	Password    string `yaml:"password"`     // empty to read from SecretMount/password
+	SecretMount string `yaml:"secret_mount"` // directory with the user and password files, as mounted on kubernetes
+}
+
+// Alerts : operational alerts to the admin chat, sent through the admin bot
+type Alerts struct {
+	AdminBot        string        `yaml:"admin_bot"`         // id of the registered bot the alerts are sent through, empty to only log the alerts
+	Cooldown        time.Duration `yaml:"cooldown"`          // same alert is not sent again within this
+	BrokerDownAfter time.Duration `yaml:"broker_down_after"` // broker unreachable for this long is alerted
+}
+
+// Lease : per bot lease, only the holder polls the bot
+type Lease struct {
+	Backend string        `yaml:"backend"` // memory, file or amqp - memory only guards a single replica
+	Dir     string        `yaml:"dir"`     // lock files for the file backend, on a volume shared by the replicas
+	Wait    time.Duration `yaml:"wait"`    // how long the amqp backend waits for the lease before it is taken as held
+}
+
+// Dedupe : update ids that were published are remembered, so re-scrapes from a stale offset do not publish them again
+type Dedupe struct {
+	Backend string        `yaml:"backend"` // memory, file or off - file remembers across restarts
+	Path    string        `yaml:"path"`    // database of the file backend, per replica - it is locked while open
+	TTL     time.Duration `yaml:"ttl"`     // how long each update id is remembered
+	Size    int           `yaml:"size"`    // most update ids remembered, least recently seen are forgotten first
+}
+
+// Schedule : named scrape schedule of a bot, the service runs these itself
+type Schedule struct {
+	Name   string        `yaml:"name"`
+	Bot    string        `yaml:"bot"`
+	Spec   string        `yaml:"spec"`   // cron expression, @hourly & the like, or @every <duration>
+	Jitter time.Duration `yaml:"jitter"` // each run is delayed by a random duration up to this
+}
+
+// LogRotation : limits for the log file, beyond which it is rotated. Applies only when logging to file
+type LogRotation struct {
+	MaxSizeMB  int  `yaml:"max_size_mb"`  // rotated when the file grows beyond this
+	MaxAgeDays int  `yaml:"max_age_days"` // rotated files older than this are removed, 0 to keep them all
+	MaxBackups int  `yaml:"max_backups"`  // count of rotated files kept, 0 to keep them all
+	Compress   bool `yaml:"compress"`     // rotated files are gzipped
+}
+
+// Config is the effective configuration of the service
+type Config struct {
+	Verbose          bool   `yaml:"verbose"`            // debug level logging
+	LogToFile        bool   `yaml:"log_to_file"`        // logs go to LogFile instead of stdout
+	LogFile          string `yaml:"log_file"`           // path of the log file, required when LogToFile
+	LogFormat        string `yaml:"log_format"`         // text or json
+	Seed             bool   `yaml:"seed"`               // seed flag, carried over from the earlier command line
+	Listen           string `yaml:"listen"`             // address the http server listens on
+	BaseURL          string `yaml:"base_url"`           // telegram server
+	NirChatID        string `yaml:"nir_chat_id"`        // chat id of the admin, alerts are sent here
+	AMQP             AMQP   `yaml:"amqp"`               // broker connection
+	TokensFile       string `yaml:"tokens_file"`        // bot tokens, space separated, as mounted on kubernetes
+	ProfilesPath     string `yaml:"profiles_path"`      // per bot profiles, all bots get defaults when the file isnt there
+	BatchWorkers     int    `yaml:"batch_workers"`      // max concurrent scrapes for a batch
+	MediaStore       string `yaml:"media_store"`        // root directory of the media store
+	OutboxBacklogMax int    `yaml:"outbox_backlog_max"` // outbox depth beyond which the service is degraded
+	OffsetsFile      string `yaml:"offsets_file"`       // where the one-shot scrapes keep the next offset of each bot
+
+	StreamOrigins []string `yaml:"stream_origins"` // origins of the pages allowed on the websocket stream, besides the same origin - * for any
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // in-flight scrapes, publishes & outbox sends get this long to finish on shutdown
+	LogRotation     LogRotation   `yaml:"log_rotation"`     // rotation of LogFile
+	Alerts          Alerts        `yaml:"alerts"`           // alerts to NirChatID
+	Lease           Lease         `yaml:"lease"`            // which replica polls which bot
+	Dedupe          Dedupe        `yaml:"dedupe"`           // updates already published are not published again
+	Schedules       []Schedule    `yaml:"schedules"`        // scrapes the service runs on its own, only from the config file
+
+	File        string   `yaml:"-"` // config file that was read, empty if none
+	PrintConfig bool     `yaml:"-"` // print the effective config and exit
+	Args        []string `yaml:"-"` // command line after the flags, the subcommand and its own flags
+}
+
+// Default : configuration as it was before the config package, paths as mounted on kubernetes
+func Default() Config {
+	return Config{
+		LogFile:          "/var/log/tgramscraper/scraper.log",
+		LogFormat:        "text",
+		Listen:           ":8080",
+		AMQP:             AMQP{SecretMount: "/run/secrets/vol-amqpsecrets/"},
+		TokensFile:       "/run/secrets/vol-tgramsecrets/bottoks",
+		ProfilesPath:     "/run/config/bot-profiles.yml",
+		BatchWorkers:     4,
+		MediaStore:       "/var/lib/tgramscraper/media",
+		OutboxBacklogMax: 1000,
+		OffsetsFile:      "/var/lib/tgramscraper/offsets.json",
+		ShutdownTimeout:  25 * time.Second, // kubernetes kills the pod 30s after SIGTERM
+		LogRotation:      LogRotation{MaxSizeMB: 100, MaxAgeDays: 28, MaxBackups: 5, Compress: true},
+		Alerts:           Alerts{Cooldown: 15 * time.Minute, BrokerDownAfter: time.Minute},
+		Lease:            Lease{Backend: "memory", Dir: "/var/lib/tgramscraper/leases", Wait: 2 * time.Second},
+		Dedupe:           Dedupe{Backend: "memory", Path: "/var/lib/tgramscraper/published.db", TTL: 24 * time.Hour, Size: 100000}, // telegram keeps updates for 24h
+	}
+}
+
+// Load : layers the defaults, the config file, the env and the flags in that order, then validates.
+// Config file is from the -config flag or env CONFIG_FILE, not reading any file when neither is set.
+// getenv is os.Getenv except in tests. flag.ErrHelp is returned as is when -h is asked for
+func Load(name string, args []string, getenv func(string) string) (*Config, error) {
+	// first pass only to know where the config file is, flags are applied again after the env
+	first := flag.NewFlagSet(name, flag.ContinueOnError)
+	first.SetOutput(io.Discard)
+	scratch := Default()
+	bind(first, &scratch)
+	if err := first.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			usage(name)
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid command line: %s", err)
+	}
+	cfg := Default()
+	cfg.File = getenv("CONFIG_FILE")
+	if scratch.File != "" {
+		cfg.File = scratch.File
+	}
+	if cfg.File != "" {
+		if err := cfg.readFile(cfg.File); err != nil {
+			return nil, err
+		}
+	}
+	problems := cfg.applyEnv(getenv)
+	// flags are bound with the layered values as defaults, so only the flags that are set override
+	second := flag.NewFlagSet(name, flag.ContinueOnError)
+	second.SetOutput(io.Discard)
+	bind(second, &cfg)
+	second.Parse(args) // errors, if any, were caught in the first pass
+	cfg.Args = second.Args()
+	problems = append(problems, cfg.check()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return &cfg, nil
+}
+
+// origins : comma separated list flag, setting it replaces the list
+type origins []string
+
+func (o *origins) String() string {
+	if o == nil {
+		return ""
+	}
+	return strings.Join(*o, ",")
+}
+
+func (o *origins) Set(val string) error {
+	*o = splitList(val)
+	return nil
+}
+
+// splitList : comma separated values, trimmed, empty ones left out
+func splitList(val string) []string {
+	result := []string{}
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// bind : all the flags, bound to the fields of the config with their current values as defaults
+func bind(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.File, "config", cfg.File, "path of the yaml config file, env CONFIG_FILE")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "prints the effective configuration, secrets redacted, and exits")
+	fs.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "debug level logging, env VERBOSE")
+	fs.BoolVar(&cfg.LogToFile, "flog", cfg.LogToFile, "logs to the log file instead of stdout, env FLOG")
+	fs.StringVar(&cfg.LogFile, "logf", cfg.LogFile, "path of the log file, env LOGF")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "text or json, env LOG_FORMAT")
+	fs.IntVar(&cfg.LogRotation.MaxSizeMB, "log-max-size", cfg.LogRotation.MaxSizeMB, "log file is rotated beyond this size in MB, env LOG_MAX_SIZE_MB")
+	fs.IntVar(&cfg.LogRotation.MaxAgeDays, "log-max-age", cfg.LogRotation.MaxAgeDays, "rotated log files older than these days are removed, 0 keeps all, env LOG_MAX_AGE_DAYS")
+	fs.IntVar(&cfg.LogRotation.MaxBackups, "log-max-backups", cfg.LogRotation.MaxBackups, "count of rotated log files kept, 0 keeps all, env LOG_MAX_BACKUPS")
+	fs.BoolVar(&cfg.LogRotation.Compress, "log-compress", cfg.LogRotation.Compress, "rotated log files are gzipped, env LOG_COMPRESS")
+	fs.BoolVar(&cfg.Seed, "seed", cfg.Seed, "unused for now, carried over from the earlier command line, env SEED")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address the http server listens on, env LISTEN_ADDR")
+	fs.StringVar(&cfg.BaseURL, "baseurl", cfg.BaseURL, "base url of the telegram server, env BASEURL")
+	fs.StringVar(&cfg.NirChatID, "nirchatid", cfg.NirChatID, "chat id of the admin, env NIRCHATID")
+	fs.StringVar(&cfg.Alerts.AdminBot, "alert-bot", cfg.Alerts.AdminBot, "id of the bot alerts are sent through to the admin chat, env ALERT_BOT")
+	fs.DurationVar(&cfg.Alerts.Cooldown, "alert-cooldown", cfg.Alerts.Cooldown, "same alert is not sent again within this, env ALERT_COOLDOWN")
+	fs.DurationVar(&cfg.Alerts.BrokerDownAfter, "alert-broker-down", cfg.Alerts.BrokerDownAfter, "broker unreachable for this long is alerted, env ALERT_BROKER_DOWN_AFTER")
+	fs.StringVar(&cfg.AMQP.Server, "amqp-server", cfg.AMQP.Server, "host:port of the rabbitmq server, env AMQP_SERVER")
+	fs.StringVar(&cfg.AMQP.SecretMount, "amqp-secrets", cfg.AMQP.SecretMount, "directory with the amqp user & password files, env AMQP_SECRET_MOUNT")
+	fs.StringVar(&cfg.TokensFile, "tokens", cfg.TokensFile, "file with the bot tokens, env TGRAM_SECRET_FILE")
+	fs.StringVar(&cfg.ProfilesPath, "profiles", cfg.ProfilesPath, "per bot profiles yaml, env BOT_PROFILES")
+	fs.IntVar(&cfg.BatchWorkers, "batch-workers", cfg.BatchWorkers, "max concurrent scrapes for a batch, env BATCH_WORKERS")
+	fs.StringVar(&cfg.MediaStore, "media-store", cfg.MediaStore, "root directory of the media store, env MEDIA_STORE")
+	fs.IntVar(&cfg.OutboxBacklogMax, "outbox-backlog-max", cfg.OutboxBacklogMax, "outbox depth beyond which the service is degraded, env OUTBOX_BACKLOG_MAX")
+	fs.StringVar(&cfg.OffsetsFile, "offsets", cfg.OffsetsFile, "file the one-shot scrapes keep the offsets in, env OFFSETS_FILE")
+	fs.Var((*origins)(&cfg.StreamOrigins), "stream-origins", "comma separated origins allowed on the websocket stream besides the same origin, * for any, env STREAM_ORIGINS")
+	fs.StringVar(&cfg.Lease.Backend, "lease-backend", cfg.Lease.Backend, "memory, file or amqp - who polls which bot across the replicas, env LEASE_BACKEND")
+	fs.StringVar(&cfg.Lease.Dir, "lease-dir", cfg.Lease.Dir, "directory of the lock files for the file lease backend, env LEASE_DIR")
+	fs.DurationVar(&cfg.Lease.Wait, "lease-wait", cfg.Lease.Wait, "how long the amqp lease backend waits for a lease, env LEASE_WAIT")
+	fs.StringVar(&cfg.Dedupe.Backend, "dedupe-backend", cfg.Dedupe.Backend, "memory, file or off - where the published update ids are remembered, env DEDUPE_BACKEND")
+	fs.StringVar(&cfg.Dedupe.Path, "dedupe-path", cfg.Dedupe.Path, "database of the file dedupe backend, one per replica, env DEDUPE_PATH")
+	fs.DurationVar(&cfg.Dedupe.TTL, "dedupe-ttl", cfg.Dedupe.TTL, "how long the published update ids are remembered, env DEDUPE_TTL")
+	fs.IntVar(&cfg.Dedupe.Size, "dedupe-size", cfg.Dedupe.Size, "most published update ids remembered, env DEDUPE_SIZE")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time given to in-flight work to finish on shutdown, env SHUTDOWN_TIMEOUT")
+}
+
+// usage : flags with their defaults, on stderr
+func usage(name string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg := Default()
+	bind(fs, &cfg)
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command], %s help lists the commands\n\nFlags:\n", name, name)
+	fs.PrintDefaults()
+}
+
+// readFile : config file over the defaults, unknown keys are an error so typos dont go unnoticed
+func (c *Config) readFile(path string) error {
+	byt, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %s", path, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(byt))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// applyEnv : env variables over the file, problems are for the values that could not be parsed
+func (c *Config) applyEnv(getenv func(string) string) []string {
+	problems := []string{}
+	str := func(key string, dst *string) {
+		if val := getenv(key); val != "" {
+			*dst = val
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if val := getenv(key); val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("env %s: expected true or false, got %q", key, val))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(key string, dst *int) {
+		if val := getenv(key); val != "" {
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("env %s: expected a number, got %q", key, val))
+				return
+			}
+			*dst = i
+		}
+	}
+	list := func(key string, dst *[]string) {
+		if val := getenv(key); val != "" {
+			*dst = splitList(val)
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if val := getenv(key); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("env %s: expected a duration like 25s, got %q", key, val))
+				return
+			}
+			*dst = d
+		}
+	}
+	boolean("VERBOSE", &c.Verbose)
+	boolean("FLOG", &c.LogToFile)
+	str("LOGF", &c.LogFile)
+	str("LOG_FORMAT", &c.LogFormat)
+	integer("LOG_MAX_SIZE_MB", &c.LogRotation.MaxSizeMB)
+	integer("LOG_MAX_AGE_DAYS", &c.LogRotation.MaxAgeDays)
+	integer("LOG_MAX_BACKUPS", &c.LogRotation.MaxBackups)
+	boolean("LOG_COMPRESS", &c.LogRotation.Compress)
+	boolean("SEED", &c.Seed)
+	str("LISTEN_ADDR", &c.Listen)
+	str("BASEURL", &c.BaseURL)
+	str("NIRCHATID", &c.NirChatID)
+	str("ALERT_BOT", &c.Alerts.AdminBot)
+	duration("ALERT_COOLDOWN", &c.Alerts.Cooldown)
+	duration("ALERT_BROKER_DOWN_AFTER", &c.Alerts.BrokerDownAfter)
+	str("AMQP_SERVER", &c.AMQP.Server)
+	str("AMQP_USER", &c.AMQP.User)
+	str("AMQP_PASSWD", &c.AMQP.Password)
+	str("AMQP_SECRET_MOUNT", &c.AMQP.SecretMount)
+	str("TGRAM_SECRET_FILE", &c.TokensFile)
+	str("BOT_PROFILES", &c.ProfilesPath)
+	integer("BATCH_WORKERS", &c.BatchWorkers)
+	str("MEDIA_STORE", &c.MediaStore)
+	integer("OUTBOX_BACKLOG_MAX", &c.OutboxBacklogMax)
+	str("OFFSETS_FILE", &c.OffsetsFile)
+	list("STREAM_ORIGINS", &c.StreamOrigins)
+	str("LEASE_BACKEND", &c.Lease.Backend)
+	str("LEASE_DIR", &c.Lease.Dir)
+	duration("LEASE_WAIT", &c.Lease.Wait)
+	str("DEDUPE_BACKEND", &c.Dedupe.Backend)
+	str("DEDUPE_PATH", &c.Dedupe.Path)
+	duration("DEDUPE_TTL", &c.Dedupe.TTL)
+	integer("DEDUPE_SIZE", &c.Dedupe.Size)
+	duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	return problems
+}
+
+// check : problems with the effective configuration, empty when all is well
+func (c *Config) check() []string {
+	problems := []string{}
+	if c.BaseURL == "" {
+		problems = append(problems, "base_url: telegram server is required, env BASEURL or -baseurl")
+	} else if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("base_url: %q is not an absolute url", c.BaseURL))
+	}
+	if c.NirChatID == "" {
+		problems = append(problems, "nir_chat_id: admin chat id is required, env NIRCHATID or -nirchatid")
+	} else if _, err := strconv.ParseInt(c.NirChatID, 10, 64); err != nil {
+		problems = append(problems, fmt.Sprintf("nir_chat_id: %q is not a chat id", c.NirChatID))
+	}
+	if c.Alerts.AdminBot != "" {
+		if _, err := strconv.ParseInt(c.Alerts.AdminBot, 10, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("alerts.admin_bot: %q is not a bot id", c.Alerts.AdminBot))
+		}
+	}
+	if c.Alerts.Cooldown <= 0 || c.Alerts.BrokerDownAfter <= 0 {
+		problems = append(problems, "alerts: cooldown and broker_down_after have to be more than 0")
+	}
+	if c.AMQP.Server == "" {
+		problems = append(problems, "amqp.server: broker is required, env AMQP_SERVER or -amqp-server")
+	}
+	if (c.AMQP.User == "" || c.AMQP.Password == "") && c.AMQP.SecretMount == "" {
+		problems = append(problems, "amqp: either user & password or the secret mount is required")
+	}
+	if c.Listen == "" {
+		problems = append(problems, "listen: address is required")
+	}
+	if c.TokensFile == "" {
+		problems = append(problems, "tokens_file: file with the bot tokens is required")
+	}
+	if c.LogToFile && c.LogFile == "" {
+		problems = append(problems, "log_file: required when logging to file")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log_format: expected text or json, got %q", c.LogFormat))
+	}
+	if c.LogToFile && c.LogRotation.MaxSizeMB <= 0 {
+		problems = append(problems, fmt.Sprintf("log_rotation.max_size_mb: has to be more than 0, got %d", c.LogRotation.MaxSizeMB))
+	}
+	if c.LogRotation.MaxAgeDays < 0 || c.LogRotation.MaxBackups < 0 {
+		problems = append(problems, "log_rotation: max_age_days and max_backups cannot be negative")
+	}
+	if c.BatchWorkers <= 0 {
+		problems = append(problems, fmt.Sprintf("batch_workers: has to be more than 0, got %d", c.BatchWorkers))
+	}
+	if c.OutboxBacklogMax <= 0 {
+		problems = append(problems, fmt.Sprintf("outbox_backlog_max: has to be more than 0, got %d", c.OutboxBacklogMax))
+	}
+	for i, o := range c.StreamOrigins {
+		if o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Sprintf("stream_origins[%d]: %q is not an origin like https://dashboard.example.com", i, o))
+		}
+	}
+	switch c.Lease.Backend {
+	case "memory", "amqp":
+	case "file":
+		if c.Lease.Dir == "" {
+			problems = append(problems, "lease.dir: required for the file backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("lease.backend: expected memory, file or amqp, got %q", c.Lease.Backend))
+	}
+	if c.Lease.Wait <= 0 {
+		problems = append(problems, fmt.Sprintf("lease.wait: has to be more than 0, got %s", c.Lease.Wait))
+	}
+	switch c.Dedupe.Backend {
+	case "memory", "off":
+	case "file":
+		if c.Dedupe.Path == "" {
+			problems = append(problems, "dedupe.path: required for the file backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("dedupe.backend: expected memory, file or off, got %q", c.Dedupe.Backend))
+	}
+	if c.Dedupe.TTL <= 0 || c.Dedupe.Size <= 0 {
+		problems = append(problems, "dedupe: ttl and size have to be more than 0")
+	}
+	names := map[string]bool{}
+	for i, sch := range c.Schedules {
+		if sch.Name == "" || names[sch.Name] {
+			problems = append(problems, fmt.Sprintf("schedules[%d]: name is required and has to be unique, got %q", i, sch.Name))
+		}
+		names[sch.Name] = true
+		if _, err := strconv.ParseInt(sch.Bot, 10, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("schedules[%d].bot: %q is not a bot id", i, sch.Bot))
+		}
+		if sch.Spec == "" || sch.Jitter < 0 {
+			problems = append(problems, fmt.Sprintf("schedules[%d]: spec is required and jitter cannot be negative", i))
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("shutdown_timeout: has to be more than 0, got %s", c.ShutdownTimeout))
+	}
+	return problems
+}
+
+// Validate : all the problems with the configuration together, nil when valid
+func (c *Config) Validate() error {
+	if problems := c.check(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidationError has all the problems found with the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (ve *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration, %d problem(s):\n  - %s", len(ve.Problems), strings.Join(ve.Problems, "\n  - "))
+}
+
+// Redacted : copy of the config safe to print or log, secrets are masked
+func (c Config) Redacted() Config {
+	if c.AMQP.User != "" {
+		c.AMQP.User = redacted
+	}
+	if c.AMQP.Password != "" {
+		c.AMQP.Password = redacted
+	}
+	return c
+}
+
+// String : effective configuration as yaml, secrets redacted
+func (c Config) String() string {
+	byt, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("failed to marshal config: %s", err)
+	}
+	if c.File != "" {
+		return fmt.Sprintf("# config file: %s\n%s", c.File, byt)
+	}
+	return string(byt)
+}
+
+// AMQPCredentials : user and password for the broker, from the config if set else from the secret files
+func (c *Config) AMQPCredentials() (string, string, error) {
+	user, pass := c.AMQP.User, c.AMQP.Password
+	var err error
+	if user == "" {
+		if user, err = readSecret(c.AMQP.SecretMount, "user"); err != nil {
+			return "", "", err
+		}
+	}
+	if pass == "" {
+		if pass, err = readSecret(c.AMQP.SecretMount, "password"); err != nil {
+			return "", "", err
+		}
+	}
+	return user, pass, nil
+}
+
+// BotTokens : distinct tokens from the tokens file, space separated
+func (c *Config) BotTokens() ([]string, error) {
+	byt, err := os.ReadFile(c.TokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the bottokens from secrets %s", err)
+	}
+	return strings.Fields(string(byt)), nil
+}
+
+// readSecret : contents of the secret file, trailing newline removed
+func readSecret(dir, name string) (string, error) {
+	byt, err := os.ReadFile(strings.TrimSuffix(dir, "/") + "/" + name)
+	if err != nil {
+		return "", fmt.Errorf("error reading the amqp secrets %s", err)
+	}
+	return strings.TrimSuffix(string(byt), "\n"), nil
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// env : getenv over a map, so the tests dont depend on the environment they run in
+func env(vals map[string]string) func(string) string {
+	return func(key string) string {
+		return vals[key]
+	}
+}
+
+var requiredEnv = map[string]string{
+	"BASEURL":     "https://api.telegram.org",
+	"NIRCHATID":   "5157350442",
+	"AMQP_SERVER": "svc-rabbit:5672",
+}
+
+func TestLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scraper.yml")
+	os.WriteFile(path, []byte(`
+listen: ":9090"
+batch_workers: 8
+media_store: /data/media
+shutdown_timeout: 10s
+log_rotation:
+  max_size_mb: 10
+amqp:
+  server: file-rabbit:5672
+schedules:
+  - name: morning
+    bot: "6425245255"
+    spec: "0 9 * * *"
+    jitter: 30s
+`), 0644)
+
+	vals := map[string]string{"CONFIG_FILE": path, "BATCH_WORKERS": "6"}
+	for k, v := range requiredEnv {
+		vals[k] = v
+	}
+	cfg, err := Load("scraper", []string{"-batch-workers", "2", "-verbose"}, env(vals))
+	assert.Nil(t, err, "Unexpected error loading the config")
+	assert.Equal(t, path, cfg.File, "Unexpected config file")
+	assert.Equal(t, ":9090", cfg.Listen, "file should override the default")
+	assert.Equal(t, "/data/media", cfg.MediaStore, "file should override the default")
+	assert.Equal(t, 10*time.Second, cfg.ShutdownTimeout, "Unexpected shutdown timeout from the file")
+	assert.Equal(t, 10, cfg.LogRotation.MaxSizeMB, "file should override the default")
+	assert.Equal(t, Default().LogRotation.MaxBackups, cfg.LogRotation.MaxBackups, "default should hold for the rest of the block")
+	assert.Equal(t, "svc-rabbit:5672", cfg.AMQP.Server, "env should override the file")
+	assert.Equal(t, 2, cfg.BatchWorkers, "flag should override the env")
+	assert.True(t, cfg.Verbose, "flag should be settable")
+	assert.Equal(t, Default().TokensFile, cfg.TokensFile, "default should hold when not set anywhere")
+	assert.Equal(t, []Schedule{{Name: "morning", Bot: "6425245255", Spec: "0 9 * * *", Jitter: 30 * time.Second}}, cfg.Schedules, "Unexpected schedules from the file")
+
+	// flag for the config file wins over the env
+	other := filepath.Join(dir, "other.yml")
+	os.WriteFile(other, []byte("listen: \":7070\"\n"), 0644)
+	cfg, err = Load("scraper", []string{"-config", other}, env(vals))
+	assert.Nil(t, err, "Unexpected error loading the config")
+	assert.Equal(t, ":7070", cfg.Listen, "Unexpected listen address from the flagged config file")
+	assert.Equal(t, 6, cfg.BatchWorkers, "Unexpected batch workers from the env")
+
+	// whatever follows the flags is the command
+	cfg, err = Load("scraper", []string{"-verbose", "scrape", "-bot", "6425245255"}, env(vals))
+	assert.Nil(t, err, "Unexpected error loading the config")
+	assert.Equal(t, []string{"scrape", "-bot", "6425245255"}, cfg.Args, "Unexpected command")
+}
+
+func TestValidation(t *testing.T) {
+	_, err := Load("scraper", []string{}, env(map[string]string{"BATCH_WORKERS": "many", "NIRCHATID": "admin"}))
+	verr := &ValidationError{}
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 4, len(verr.Problems), "Expected all the problems together: %s", err)
+	for _, expected := range []string{"BATCH_WORKERS", "base_url", "nir_chat_id", "amqp.server"} {
+		assert.Contains(t, err.Error(), expected, "Expected problem not reported")
+	}
+
+	_, err = Load("scraper", []string{"-batch-workers", "0", "-baseurl", "api.telegram.org"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 2, len(verr.Problems), "Unexpected problems: %s", err)
+
+	_, err = Load("scraper", []string{"-alert-bot", "admin", "-alert-cooldown", "0s"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 2, len(verr.Problems), "Expected bad admin bot and cooldown reported: %s", err)
+
+	_, err = Load("scraper", []string{"-log-format", "xml"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Contains(t, err.Error(), "log_format", "Expected unknown log format reported")
+
+	_, err = Load("scraper", []string{"-lease-backend", "etcd", "-lease-wait", "0s"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 2, len(verr.Problems), "Expected bad lease backend and wait reported: %s", err)
+
+	_, err = Load("scraper", []string{"-dedupe-backend", "redis", "-dedupe-size", "0"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 2, len(verr.Problems), "Expected bad dedupe backend and size reported: %s", err)
+	withDedupe := map[string]string{"DEDUPE_BACKEND": "file", "DEDUPE_TTL": "1h"}
+	for k, v := range requiredEnv {
+		withDedupe[k] = v
+	}
+	cfg, err := Load("scraper", nil, env(withDedupe))
+	assert.Nil(t, err)
+	assert.Equal(t, Dedupe{Backend: "file", Path: "/var/lib/tgramscraper/published.db", TTL: time.Hour, Size: 100000}, cfg.Dedupe, "Expected the dedupe from the env")
+
+	_, err = Load("scraper", []string{"-stream-origins", "https://dash.example.com, dash.example.com/page"}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 1, len(verr.Problems), "Expected only the origin that isnt one reported: %s", err)
+	withOrigins := map[string]string{"STREAM_ORIGINS": "https://dash.example.com,*"}
+	for k, v := range requiredEnv {
+		withOrigins[k] = v
+	}
+	cfg, err = Load("scraper", nil, env(withOrigins))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://dash.example.com", "*"}, cfg.StreamOrigins, "Expected the origins from the env")
+	cfg, err = Load("scraper", []string{"-stream-origins", "http://localhost:3000"}, env(withOrigins))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://localhost:3000"}, cfg.StreamOrigins, "Expected the flag to replace the origins from the env")
+
+	_, err = Load("scraper", []string{"-nosuchflag"}, env(requiredEnv))
+	assert.NotNil(t, err, "Expected error for an unknown flag")
+	_, err = Load("scraper", []string{"-h"}, env(requiredEnv))
+	assert.True(t, errors.Is(err, flag.ErrHelp), "Expected help to be returned as is")
+
+	path := filepath.Join(t.TempDir(), "schedules.yml")
+	os.WriteFile(path, []byte("schedules:\n  - {name: a, bot: \"6425245255\", spec: \"@hourly\"}\n  - {name: a, bot: bot, spec: \"\"}\n"), 0644)
+	_, err = Load("scraper", []string{"-config", path}, env(requiredEnv))
+	assert.True(t, errors.As(err, &verr), "Expected a validation error")
+	assert.Equal(t, 3, len(verr.Problems), "Expected duplicate name, bad bot and missing spec reported: %s", err)
+
+	path = filepath.Join(t.TempDir(), "typo.yml")
+	os.WriteFile(path, []byte("lsten: \":9090\"\n"), 0644)
+	_, err = Load("scraper", []string{"-config", path}, env(requiredEnv))
+	assert.NotNil(t, err, "Expected error for an unknown key in the config file")
+}
+
+func TestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "user"), []byte("scraper\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "bottoks"), []byte("1:abc 2:def\n"), 0600)
+	vals := map[string]string{"AMQP_SECRET_MOUNT": dir, "TGRAM_SECRET_FILE": filepath.Join(dir, "bottoks")}
+	for k, v := range requiredEnv {
+		vals[k] = v
+	}
+	cfg, err := Load("scraper", nil, env(vals))
+	assert.Nil(t, err, "Unexpected error loading the config")
+	user, pass, err := cfg.AMQPCredentials()
+	assert.Nil(t, err, "Unexpected error reading the credentials")
+	assert.Equal(t, "scraper", user)
+	assert.Equal(t, "s3cr3t", pass)
+	toks, err := cfg.BotTokens()
+	assert.Nil(t, err, "Unexpected error reading the tokens")
+	assert.Equal(t, []string{"1:abc", "2:def"}, toks)
+
+	// credentials from env take precedence, and are never printed
+	vals["AMQP_PASSWD"] = "fromenv"
+	cfg, _ = Load("scraper", nil, env(vals))
+	_, pass, _ = cfg.AMQPCredentials()
+	assert.Equal(t, "fromenv", pass)
+	printed := cfg.String()
+	assert.False(t, strings.Contains(printed, "fromenv"), "Password should be redacted")
+	assert.Contains(t, printed, redacted)
+	assert.Equal(t, "fromenv", cfg.AMQP.Password, "Redacting should not change the config")
+}
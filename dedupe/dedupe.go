@@ -0,0 +1,119 @@
+// Update ids that were published, so that the same update is not published twice.
+
+// Re-scrapes from a stale offset get updates that were already published - the caller retries from the same offset when the publish fails midway.
+// Ids are remembered per bot for a while, telegram does not send an update again once the offset has moved past it.
+// Memory forgets on restart, File keeps the ids in a bolt database on disk that is read back when the service starts.
+package dedupe
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	BackendOff    = "off" // nothing is remembered, every update is published
+)
+
+// Store : update ids of each bot that were published
+type Store interface {
+	Seen(bot, updateID string) (bool, error) // true if the update was published within the TTL
+	Mark(bot, updateID string) error         // update was published
+	Close() error
+}
+
+func key(bot, updateID string) string {
+	return bot + "/" + updateID
+}
+
+type entry struct {
+	key string
+	at  time.Time // when the update was marked
+}
+
+// Memory : update ids in memory, forgotten after the TTL or beyond the size - least recently seen first
+type Memory struct {
+	TTL  time.Duration
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of entry, most recently seen in the front
+	now     func() time.Time
+}
+
+// NewMemory : store that remembers upto size update ids, each for the ttl
+func NewMemory(ttl time.Duration, size int) *Memory {
+	return &Memory{TTL: ttl, Size: size, entries: map[string]*list.Element{}, lru: list.New(), now: time.Now}
+}
+
+func (m *Memory) Seen(bot, updateID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key(bot, updateID)]
+	if !ok {
+		return false, nil
+	}
+	if m.now().Sub(el.Value.(entry).at) >= m.TTL {
+		m.remove(el)
+		return false, nil
+	}
+	m.lru.MoveToFront(el)
+	return true, nil
+}
+
+func (m *Memory) Mark(bot, updateID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(key(bot, updateID), m.now())
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Len : count of update ids remembered, including the ones past the TTL that are yet to be forgotten
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// put : key marked at the time, the least recently seen are forgotten beyond the size. Called with the lock held
+func (m *Memory) put(k string, at time.Time) {
+	if el, ok := m.entries[k]; ok {
+		el.Value = entry{key: k, at: at}
+		m.lru.MoveToFront(el)
+	} else {
+		m.entries[k] = m.lru.PushFront(entry{key: k, at: at})
+	}
+	for m.lru.Len() > m.Size {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *Memory) remove(el *list.Element) {
+	delete(m.entries, el.Value.(entry).key)
+	m.lru.Remove(el)
+}
+
+// live : entries within the TTL, least recently seen first. Called with the lock held
+func (m *Memory) live() []entry {
+	now, result := m.now(), []entry{}
+	for el := m.lru.Back(); el != nil; el = el.Prev() {
+		if e := el.Value.(entry); now.Sub(e.at) < m.TTL {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Off : store that remembers nothing, when dedupe is turned off
+type Off struct{}
+
+func (Off) Seen(bot, updateID string) (bool, error) { return false, nil }
+func (Off) Mark(bot, updateID string) error         { return nil }
+func (Off) Close() error                            { return nil }
@@ -0,0 +1,97 @@
+package dedupe
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+const bot = "6425245255"
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(time.Minute, 2)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	seen := func(id string) bool {
+		ok, err := m.Seen(bot, id)
+		assert.Nil(t, err)
+		return ok
+	}
+	assert.False(t, seen("100"))
+	assert.Nil(t, m.Mark(bot, "100"))
+	assert.True(t, seen("100"))
+	ok, _ := m.Seen("6133190482", "100")
+	assert.False(t, ok, "Update ids are per bot")
+
+	now = now.Add(time.Minute)
+	assert.False(t, seen("100"), "Expected forgotten after the ttl")
+	assert.Equal(t, 0, m.Len())
+
+	m.Mark(bot, "101")
+	m.Mark(bot, "102")
+	assert.True(t, seen("101")) // 102 is now the least recently seen
+	m.Mark(bot, "103")
+	assert.False(t, seen("102"), "Expected the least recently seen forgotten beyond the size")
+	assert.True(t, seen("101"))
+	assert.True(t, seen("103"))
+
+	var off Store = Off{}
+	off.Mark(bot, "100")
+	ok, _ = off.Seen(bot, "100")
+	assert.False(t, ok)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "published.db")
+	fs, err := NewFile(path, time.Hour, 3)
+	assert.Nil(t, err, "Unexpected error opening the store")
+	for _, id := range []string{"100", "101", "102"} {
+		assert.Nil(t, fs.Mark(bot, id))
+	}
+
+	// file is per replica, a second store on the same path cant open it
+	openTimeout = 50 * time.Millisecond
+	_, err = NewFile(path, time.Hour, 3)
+	assert.NotNil(t, err, "Expected the database locked while the store is open")
+	assert.Nil(t, fs.Close())
+
+	// as after a restart
+	fs, err = NewFile(path, time.Hour, 3)
+	assert.Nil(t, err, "Unexpected error reopening the store")
+	for _, id := range []string{"100", "101", "102"} {
+		ok, _ := fs.Seen(bot, id)
+		assert.True(t, ok, "Expected %s remembered across the restart", id)
+	}
+	ok, _ := fs.Seen(bot, "103")
+	assert.False(t, ok)
+
+	// database is pruned at twice the size, only what is remembered is kept
+	for _, id := range []string{"103", "104", "105"} {
+		assert.Nil(t, fs.Mark(bot, id))
+	}
+	count := 0
+	fs.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	assert.Equal(t, 3, count, "Expected the database pruned")
+	fs.Close()
+	fs, _ = NewFile(path, time.Hour, 3)
+	ok, _ = fs.Seen(bot, "100")
+	assert.False(t, ok, "Expected forgotten beyond the size")
+	ok, _ = fs.Seen(bot, "105")
+	assert.True(t, ok)
+	fs.Close()
+
+	// past the ttl nothing is read back
+	later := &File{Memory: NewMemory(time.Hour, 3), Path: path}
+	later.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	later.db, err = bolt.Open(path, 0644, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, later.load())
+	assert.Equal(t, 0, later.Len(), "Expected the expired ids not read back")
+	later.Close()
+}
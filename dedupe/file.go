@@ -0,0 +1,141 @@
+package dedupe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucket : in the database, update ids to when they were marked
+var bucket = []byte("published")
+
+// openTimeout : how long opening waits for the lock on the database before it fails
+var openTimeout = 5 * time.Second
+
+// File : Memory backed by a bolt database on disk, each mark is written through before it returns.
+// Database is read back when the store is opened, and pruned to only what is remembered once it holds twice the size.
+// Bolt holds an exclusive lock on the file for as long as the store is open - the file is per replica.
+// Replicas that run together each need a path of their own, a second store on the same path fails to open.
+type File struct {
+	*Memory
+	Path string
+
+	db   *bolt.DB
+	keys int // in the bucket, live or not
+}
+
+// NewFile : store over the database at path, created if it isnt there
+func NewFile(path string, ttl time.Duration, size int) (*File, error) {
+	fs := &File{Memory: NewMemory(ttl, size), Path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for the dedupe database: %s", err)
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedupe database %s, is another replica using it? %s", path, err)
+	}
+	fs.db = db
+	if err := fs.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// load : database into memory, the bucket is created if it isnt there
+func (fs *File) load() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := fs.now()
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		fs.keys = 0
+		return b.ForEach(func(k, v []byte) error {
+			fs.keys++
+			if len(v) != 8 {
+				return nil
+			}
+			if at := time.Unix(0, int64(binary.BigEndian.Uint64(v))); now.Sub(at) < fs.TTL {
+				fs.put(string(k), at)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read dedupe database %s: %s", fs.Path, err)
+	}
+	return nil
+}
+
+func (fs *File) Mark(bot, updateID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	k, at := key(bot, updateID), fs.now()
+	fs.put(k, at)
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(at.UnixNano()))
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(k), v)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write dedupe database %s: %s", fs.Path, err)
+	}
+	fs.keys++
+	if fs.keys >= 2*fs.Size {
+		return fs.prune()
+	}
+	return nil
+}
+
+// prune : ids that arent remembered anymore are deleted from the database. Called with the lock held
+func (fs *File) prune() error {
+	live := map[string]bool{}
+	for _, e := range fs.live() {
+		live[e.key] = true
+	}
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		b, stale := tx.Bucket(bucket), []string{}
+		b.ForEach(func(k, v []byte) error {
+			if !live[string(k)] {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+		// deleting while iterating skips keys, hence after
+		for _, k := range stale {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prune dedupe database %s: %s", fs.Path, err)
+	}
+	fs.keys = len(live)
+	return nil
+}
+
+func (fs *File) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.db == nil {
+		return nil
+	}
+	err := fs.db.Close()
+	fs.db = nil
+	return err
+}
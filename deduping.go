@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/dedupe"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	log "github.com/sirupsen/logrus"
+)
+
+// dedupeHeader : header the rabbitmq message deduplication plugin reads the id of the message from
+const dedupeHeader = "x-deduplication-header"
+
+// newDedupe : store of the published update ids as configured
+func newDedupe(cfg *config.Config) (dedupe.Store, error) {
+	switch cfg.Dedupe.Backend {
+	case dedupe.BackendFile:
+		return dedupe.NewFile(cfg.Dedupe.Path, cfg.Dedupe.TTL, cfg.Dedupe.Size)
+	case dedupe.BackendOff:
+		return dedupe.Off{}, nil
+	}
+	return dedupe.NewMemory(cfg.Dedupe.TTL, cfg.Dedupe.Size), nil
+}
+
+// skipPublished : updates of the result that were published earlier are moved over to Dropped, before the processors get them.
+// Errors from the store are only logged and the update is kept - publishing it again is better than losing it
+func (a *App) skipPublished(ctx context.Context, result *scrapers.ScrapeResult, dryRun bool) {
+	kept := []models.Update{}
+	for _, updt := range result.Updates {
+		seen, err := a.Dedupe.Seen(result.ForBot, updt.UpdtID.String())
+		if err != nil {
+			logging.From(ctx).WithFields(log.Fields{
+				"bot":       result.ForBot,
+				"update_id": updt.UpdtID,
+				"err":       err,
+			}).Warn("failed to check if the update was published earlier")
+		}
+		if !seen {
+			kept = append(kept, updt)
+			continue
+		}
+		result.Dropped = append(result.Dropped, updt)
+		result.Duplicates++
+		if !dryRun {
+			metrics.Duplicate(result.ForBot)
+		}
+	}
+	if result.Duplicates > 0 {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot":        result.ForBot,
+			"duplicates": result.Duplicates,
+		}).Info("skipped updates published earlier, scraped from a stale offset")
+	}
+	result.Updates = kept
+}
+
+// markPublished : update is not published again, errors are only logged
+func (a *App) markPublished(ctx context.Context, botid string, updt models.Update) {
+	if err := a.Dedupe.Mark(botid, updt.UpdtID.String()); err != nil {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot":       botid,
+			"update_id": updt.UpdtID,
+			"err":       err,
+		}).Warn("failed to remember the published update")
+	}
+}
+
+// messageID : of the amqp message for the update, n is the count of messages published earlier for the same update - when the processors split it
+func messageID(botid string, updt models.Update, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%s.%s", botid, updt.UpdtID)
+	}
+	return fmt.Sprintf("%s.%s.%d", botid, updt.UpdtID, n)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/media"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileErrEnvelope : maps the errors from resolving & downloading the files
+func fileErrEnvelope(err error) (int, api.Error) {
+	if errors.Is(err, scrapers.ErrFileTooLarge) {
+		return http.StatusRequestEntityTooLarge, api.Error{Code: api.CodeInvalidRequest, Message: err.Error()}
+	}
+	return scrapeErrEnvelope(err)
+}
+
+// HndlGetFile : resolves the file id with getFile and streams the file from the telegram server.
+// Consumers get only the file id in the updates, this is how they download it without the bot token.
+func (a *App) HndlGetFile(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	profile := a.Profiles.For(botid)
+	scraper := a.telegram(botid, "")
+	body, resp, file, err := scraper.OpenFile(ctx.Param("file_id"), profile.MaxFileSize, scrapers.ScrapeConfig{RequestTimeout: profile.RequestTimeout, Transport: a.Transport, Context: ctx.Request.Context()})
+	if err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid":   botid,
+			"file_id": ctx.Param("file_id"),
+		}).Errorf("failed HndlGetFile: %s", err)
+		status, envelope := fileErrEnvelope(err)
+		ctx.AbortWithStatusJSON(status, envelope)
+		return
+	}
+	defer body.Close()
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.FilePath)))
+	if resp.ContentLength > 0 {
+		ctx.Header("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	ctx.Header("Content-Type", contentType)
+	ctx.Status(http.StatusOK)
+	if _, err := io.Copy(ctx.Writer, body); err != nil {
+		// headers are already sent, nothing more can be done than to cut the response short
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid":   botid,
+			"file_id": ctx.Param("file_id"),
+			"err":     err,
+		}).Error("failed HndlGetFile: streaming the file was cut short")
+	}
+	ctx.Abort()
+}
+
+// HndlGetMedia : serves the file from the local media store, by the hash in the reference attached to the update
+func (a *App) HndlGetMedia(ctx *gin.Context) {
+	if a.Media == nil {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, "media store is not enabled", nil)
+		return
+	}
+	f, err := a.Media.Open(ctx.Param("sha256"))
+	if err != nil {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, "no such media in the store", nil)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "failed to read media from store", nil)
+		return
+	}
+	ctx.Header("Cache-Control", "public, max-age=31536000, immutable") // content addressed, never changes
+	http.ServeContent(ctx.Writer, ctx.Request, ctx.Param("sha256"), stat.ModTime(), f)
+	ctx.Abort()
+}
+
+// storeMedia : downloads the files of the updates to the media store and attaches the references to the updates.
+// Files that fail to download are logged and left out, the scrape goes on. Downloads are cancelled along with ctx.
+func (a *App) storeMedia(ctx context.Context, result *scrapers.ScrapeResult) {
+	if a.Media == nil {
+		return
+	}
+	profile := a.Profiles.For(result.ForBot)
+	scraper := a.telegram(result.ForBot, "")
+	for i := range result.Updates {
+		for _, fileID := range result.Updates[i].FileIDs() {
+			ref, err := func() (*models.MediaRef, error) {
+				body, resp, _, err := scraper.OpenFile(fileID, profile.MaxFileSize, scrapers.ScrapeConfig{RequestTimeout: profile.RequestTimeout, Transport: a.Transport, Context: ctx})
+				if err != nil {
+					return nil, err
+				}
+				defer body.Close()
+				hash, size, err := a.Media.Put(body)
+				if err != nil {
+					return nil, err
+				}
+				return &models.MediaRef{FileID: fileID, SHA256: hash, Size: size, MimeType: resp.Header.Get("Content-Type"), Ref: fmt.Sprintf("/v1/media/%s", hash)}, nil
+			}()
+			if err != nil {
+				logging.From(ctx).WithFields(log.Fields{
+					"bot":     result.ForBot,
+					"file_id": fileID,
+					"err":     err,
+				}).Warn("storeMedia: file not stored")
+				continue
+			}
+			result.Updates[i].Media = append(result.Updates[i].Media, *ref)
+		}
+	}
+}
+
+// openMediaStore : store at a.Config.MediaStore, storing media is disabled if the store cant be created
+func (a *App) openMediaStore() {
+	root := a.Config.MediaStore
+	store, err := media.NewStore(root)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"root": root,
+			"err":  err,
+		}).Warn("media store not available, media will not be stored")
+		return
+	}
+	a.Media = store
+}
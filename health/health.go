@@ -0,0 +1,98 @@
+// Health checks for the liveness & readiness probes
+
+// Readiness is made up of named component checks, each cached for a while so probes dont hammer the dependencies.
+// Failing critical components make the service not ready, failing others only degrade it.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusUp       Status = "up"
+	StatusDegraded Status = "degraded" // non critical components are down, service can still do its job
+	StatusDown     Status = "down"
+)
+
+// CheckFunc : checks a single component, detail is sent back in the report as is
+type CheckFunc func(ctx context.Context) (detail interface{}, err error)
+
+// Component : result of a single check
+type Component struct {
+	Name      string      `json:"name"`
+	Status    Status      `json:"status"`
+	Critical  bool        `json:"critical"`
+	Detail    interface{} `json:"detail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+// Report : overall status and the status of each component
+type Report struct {
+	Status     Status      `json:"status"`
+	Components []Component `json:"components"`
+}
+
+type check struct {
+	name     string
+	ttl      time.Duration // result is cached for this long
+	critical bool
+	fn       CheckFunc
+
+	mu   sync.Mutex
+	last *Component
+}
+
+// run : cached result if its fresh, else runs the check afresh
+func (c *check) run(ctx context.Context) Component {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil && time.Since(c.last.CheckedAt) < c.ttl {
+		return *c.last
+	}
+	detail, err := c.fn(ctx)
+	comp := Component{Name: c.name, Status: StatusUp, Critical: c.critical, Detail: detail, CheckedAt: time.Now()}
+	if err != nil {
+		comp.Status, comp.Error = StatusDown, err.Error()
+	}
+	c.last = &comp
+	return comp
+}
+
+// Checker : runs all the component checks for readiness
+type Checker struct {
+	checks []*check
+}
+
+// Add : registers the check for the component, critical components failing make the service not ready
+func (ch *Checker) Add(name string, ttl time.Duration, critical bool, fn CheckFunc) {
+	ch.checks = append(ch.checks, &check{name: name, ttl: ttl, critical: critical, fn: fn})
+}
+
+// Run : runs all the checks concurrently, report is in the order the checks were added
+func (ch *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusUp, Components: make([]Component, len(ch.checks))}
+	var wg sync.WaitGroup
+	for i, c := range ch.checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			report.Components[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, comp := range report.Components {
+		if comp.Status == StatusDown {
+			if comp.Critical {
+				report.Status = StatusDown
+			} else if report.Status == StatusUp {
+				report.Status = StatusDegraded
+			}
+		}
+	}
+	return report
+}
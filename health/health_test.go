@@ -0,0 +1,54 @@
+package health_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	calls := 0
+	brokerUp, telegramUp := true, true
+	checker := &health.Checker{}
+	checker.Add("broker", time.Hour, true, func(ctx context.Context) (interface{}, error) {
+		calls++
+		if !brokerUp {
+			return nil, fmt.Errorf("broker down")
+		}
+		return "connected", nil
+	})
+	checker.Add("telegram", 0, false, func(ctx context.Context) (interface{}, error) {
+		if !telegramUp {
+			return nil, fmt.Errorf("telegram down")
+		}
+		return nil, nil
+	})
+
+	report := checker.Run(context.Background())
+	assert.Equal(t, health.StatusUp, report.Status, "Unexpected status when all components are up")
+	assert.Equal(t, "broker", report.Components[0].Name, "Unexpected order of components")
+	assert.Equal(t, "connected", report.Components[0].Detail, "Unexpected detail")
+
+	// TEST: non critical component down only degrades
+	telegramUp = false
+	report = checker.Run(context.Background())
+	assert.Equal(t, health.StatusDegraded, report.Status, "Unexpected status when non critical component is down")
+
+	// TEST: cached result is used till the ttl
+	brokerUp = false
+	report = checker.Run(context.Background())
+	assert.Equal(t, health.StatusDegraded, report.Status, "Unexpected status, broker result should have been cached")
+	assert.Equal(t, 1, calls, "Unexpected count of calls for cached check")
+
+	checker = &health.Checker{}
+	checker.Add("broker", 0, true, func(ctx context.Context) (interface{}, error) {
+		return nil, fmt.Errorf("broker down")
+	})
+	report = checker.Run(context.Background())
+	assert.Equal(t, health.StatusDown, report.Status, "Unexpected status when critical component is down")
+	assert.Equal(t, "broker down", report.Components[0].Error, "Unexpected error in component")
+}
@@ -0,0 +1,56 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// File : leases are flocks on <Dir>/<key>.lock, Dir has to be on a volume shared by the replicas.
+// The lock goes with the process, a replica that dies lets go of its leases right away.
+// Holder of the lease is written in the file, for the others to know who has it
+type File struct {
+	Dir    string
+	Holder string
+}
+
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lease directory %s: %s", dir, err)
+	}
+	return &File{Dir: dir, Holder: Holder()}, nil
+}
+
+func (f *File) Acquire(ctx context.Context, key string) (Lease, error) {
+	path := filepath.Join(f.Dir, key+".lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease file %s: %s", path, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder, _ := os.ReadFile(path)
+			return nil, fmt.Errorf("%s held by %s: %w", key, strings.TrimSpace(string(holder)), ErrHeld)
+		}
+		return nil, fmt.Errorf("failed to lock lease file %s: %s", path, err)
+	}
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%s since %s\n", f.Holder, time.Now().Format(time.RFC3339))), 0)
+	return &fileLease{file: file}, nil
+}
+
+type fileLease struct {
+	file *os.File
+}
+
+// Release : closing the file lets go of the lock, the file stays for the next holder
+func (fl *fileLease) Release() error {
+	fl.file.Truncate(0)
+	return fl.file.Close()
+}
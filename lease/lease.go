@@ -0,0 +1,115 @@
+// Leases make sure only one replica polls a bot at a time.
+
+// Two replicas calling getUpdates for the same bot either get a 409 from the telegram server or publish the same updates twice.
+// The replica that holds the lease of the bot polls it, the others are refused till the lease is released.
+// Backends: in-process for a single replica, file locks on a shared volume, and RabbitMQ single active consumer.
+// Leases of a replica that dies are released by the backend - the OS drops the file lock, the broker the consumer.
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	BackendMemory = "memory" // in-process, only guards against concurrent polls within the replica
+	BackendFile   = "file"   // lock files on a volume shared by the replicas
+	BackendAMQP   = "amqp"   // single active consumer on a queue per bot
+)
+
+// ErrHeld is returned when the lease is held by another replica, or another request within the replica
+var ErrHeld = errors.New("lease is held by another poller")
+
+// Lease : held till released
+type Lease interface {
+	Release() error
+}
+
+// Locker : backend for the leases, keys are the bot ids
+type Locker interface {
+	// Acquire : lease on the key, error wraps ErrHeld when some one else holds it.
+	// Never waits longer than ctx allows
+	Acquire(ctx context.Context, key string) (Lease, error)
+}
+
+// Holder : identifies this replica to the others, hostname is the pod name on kubernetes
+func Holder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// Memory : in-process leases
+type Memory struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{held: map[string]bool{}}
+}
+
+func (m *Memory) Acquire(ctx context.Context, key string) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held[key] {
+		return nil, fmt.Errorf("%s: %w", key, ErrHeld)
+	}
+	m.held[key] = true
+	return &memoryLease{m: m, key: key}, nil
+}
+
+type memoryLease struct {
+	m    *Memory
+	key  string
+	once sync.Once
+}
+
+func (ml *memoryLease) Release() error {
+	ml.once.Do(func() {
+		ml.m.mu.Lock()
+		delete(ml.m.held, ml.key)
+		ml.m.mu.Unlock()
+	})
+	return nil
+}
+
+// Local : leases within the process first, then with the backend - requests in the same replica dont have to go to the backend
+type Local struct {
+	memory  *Memory
+	Backend Locker
+}
+
+// NewLocal : backend guarded by in-process leases
+func NewLocal(backend Locker) *Local {
+	return &Local{memory: NewMemory(), Backend: backend}
+}
+
+func (l *Local) Acquire(ctx context.Context, key string) (Lease, error) {
+	local, err := l.memory.Acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := l.Backend.Acquire(ctx, key)
+	if err != nil {
+		local.Release()
+		return nil, err
+	}
+	return &both{local: local, remote: remote}, nil
+}
+
+type both struct {
+	local, remote Lease
+}
+
+// Release : backend first, so the other replicas can have it as soon as this replica lets go
+func (b *both) Release() error {
+	err := b.remote.Release()
+	b.local.Release()
+	return err
+}
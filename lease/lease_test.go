@@ -0,0 +1,77 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	l, err := m.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "Unexpected error acquiring a free lease")
+	_, err = m.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Expected the lease held, got %v", err)
+	_, err = m.Acquire(context.Background(), "6133190482")
+	assert.Nil(t, err, "Leases of other bots are independent")
+
+	l.Release()
+	l.Release() // releasing twice does not let go of some one elses lease
+	l2, err := m.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "Expected the lease free once released")
+	l.Release()
+	_, err = m.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Stale release should not free the new holder's lease")
+	l2.Release()
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "leases")
+	// two replicas on the same volume, flocks of separate opens conflict even within a process
+	one, err := NewFile(dir)
+	assert.Nil(t, err, "Unexpected error creating the lease dir")
+	two, _ := NewFile(dir)
+	two.Holder = "replica-two"
+
+	l, err := one.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "Unexpected error acquiring a free lease")
+	_, err = two.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Expected the lease held, got %v", err)
+	assert.Contains(t, err.Error(), one.Holder, "Expected the holder named in the error")
+
+	assert.Nil(t, l.Release(), "Unexpected error releasing")
+	l, err = two.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "Expected the lease free once released")
+	content, _ := os.ReadFile(filepath.Join(dir, "6425245255.lock"))
+	assert.True(t, strings.HasPrefix(string(content), "replica-two"), "Expected the new holder in the lock file")
+	l.Release()
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	file, _ := NewFile(dir)
+	local := NewLocal(file)
+	other, _ := NewFile(dir)
+
+	l, err := local.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "Unexpected error acquiring a free lease")
+	_, err = local.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Expected the lease held within the process")
+	_, err = other.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Expected the lease held on the backend")
+	l.Release()
+
+	// held on the backend, in-process lease is not kept either
+	held, _ := other.Acquire(context.Background(), "6425245255")
+	_, err = local.Acquire(context.Background(), "6425245255")
+	assert.True(t, errors.Is(err, ErrHeld), "Expected the lease held on the backend")
+	held.Release()
+	l, err = local.Acquire(context.Background(), "6425245255")
+	assert.Nil(t, err, "In-process lease should have been let go when the backend refused")
+	l.Release()
+}
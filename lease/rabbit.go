@@ -0,0 +1,100 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Rabbit : leases as single active consumers. Each key has a durable queue lease.<key> with a token message in it,
+// of all the consumers on the queue the broker delivers only to the one that is active, the holder.
+// Release cancels the consumer & the token goes back to the queue. When a replica dies, so does its connection and the broker
+// hands the token over - no expiry to wait for.
+type Rabbit struct {
+	URL    string
+	Wait   time.Duration // how long to wait for the token before the lease is taken as held
+	Holder string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+}
+
+// NewRabbit : connection is dialled on the first acquire, and again if it drops
+func NewRabbit(user, passwd, server string, wait time.Duration) *Rabbit {
+	return &Rabbit{URL: fmt.Sprintf("amqp://%s:%s@%s/", user, passwd, server), Wait: wait, Holder: Holder()}
+}
+
+// LeaseQueue : queue that carries the lease of the key
+func LeaseQueue(key string) string {
+	return fmt.Sprintf("lease.%s", key)
+}
+
+func (r *Rabbit) channel() (*amqp.Channel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil || r.conn.IsClosed() {
+		conn, err := amqp.Dial(r.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial lease broker: %s", err)
+		}
+		r.conn = conn
+	}
+	return r.conn.Channel()
+}
+
+func (r *Rabbit) Acquire(ctx context.Context, key string) (Lease, error) {
+	ch, err := r.channel()
+	if err != nil {
+		return nil, err
+	}
+	queue := LeaseQueue(key)
+	q, err := ch.QueueDeclare(queue, true, false, false, false, amqp.Table{"x-single-active-consumer": true})
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to declare lease queue %s: %s", queue, err)
+	}
+	if q.Consumers == 0 && q.Messages == 0 {
+		// first ever lease on the key, token isnt there yet
+		// two replicas racing here leave two tokens, which is harmless - only the active consumer gets deliveries
+		if err := ch.Publish("", queue, false, false, amqp.Publishing{DeliveryMode: amqp.Persistent, Body: []byte(key)}); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("failed to publish lease token %s: %s", queue, err)
+		}
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to set qos on lease channel: %s", err)
+	}
+	tokens, err := ch.Consume(queue, r.Holder, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to consume lease queue %s: %s", queue, err)
+	}
+	timer := time.NewTimer(r.Wait)
+	defer timer.Stop()
+	select {
+	case _, ok := <-tokens:
+		if !ok {
+			ch.Close()
+			return nil, fmt.Errorf("lease channel closed for %s", queue)
+		}
+		// token stays unacked for as long as the lease is held
+		return &rabbitLease{ch: ch}, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	ch.Close()
+	return nil, fmt.Errorf("%s: %w", key, ErrHeld)
+}
+
+type rabbitLease struct {
+	ch *amqp.Channel
+}
+
+// Release : closing the channel requeues the unacked token for the next consumer
+func (rl *rabbitLease) Release() error {
+	return rl.ch.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/lease"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// leaseRetryAfter : seconds a refused caller is asked to wait, polls are over well within this
+const leaseRetryAfter = 5
+
+// newLocker : lease backend as configured, file & amqp leases are guarded in-process first
+func newLocker(cfg *config.Config, user, passwd string) (lease.Locker, error) {
+	switch cfg.Lease.Backend {
+	case lease.BackendFile:
+		file, err := lease.NewFile(cfg.Lease.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return lease.NewLocal(file), nil
+	case lease.BackendAMQP:
+		return lease.NewLocal(lease.NewRabbit(user, passwd, cfg.AMQP.Server, cfg.Lease.Wait)), nil
+	}
+	return lease.NewMemory(), nil
+}
+
+// acquireLease : lease on the bot, only the holder polls the telegram server for it
+func (a *App) acquireLease(ctx context.Context, botid string) (lease.Lease, error) {
+	l, err := a.Leases.Acquire(ctx, botid)
+	if err != nil {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot":     botid,
+			"backend": a.Config.Lease.Backend,
+			"err":     err,
+		}).Warn("bot lease not acquired")
+		return nil, err
+	}
+	return l, nil
+}
+
+// releaseLease : errors are only logged, the backend lets go of the lease anyway when the connection or the file is gone
+func releaseLease(ctx context.Context, botid string, l lease.Lease) {
+	if err := l.Release(); err != nil {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot": botid,
+			"err": err,
+		}).Warn("failed to release bot lease")
+	}
+}
+
+// HndlLease : bot in the url is leased for the rest of the chain, released once the chain is done.
+// When another replica or another request is polling the bot, the request is refused with 409 - caller retries after a while
+func (a *App) HndlLease(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	reqCtx := ctx.Request.Context()
+	l, err := a.acquireLease(reqCtx, botid)
+	if err != nil {
+		if errors.Is(err, lease.ErrHeld) {
+			ctx.Header("Retry-After", strconv.Itoa(leaseRetryAfter))
+			api.Abort(ctx, http.StatusConflict, api.CodeBotBusy, fmt.Sprintf("bot %s is being polled elsewhere, try again", botid), gin.H{"retry_after": leaseRetryAfter})
+			return
+		}
+		api.Abort(ctx, http.StatusServiceUnavailable, api.CodeUnavailable, "failed to lease the bot, try again", nil)
+		return
+	}
+	defer releaseLease(reqCtx, botid, l)
+	ctx.Next()
+}
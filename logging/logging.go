@@ -0,0 +1,100 @@
+// Log formatting, rotation of the log file and the request id that ties the log lines of a request together.
+
+// Request id travels in the context - from the http request to the scraper, the broker and on into the AMQP headers.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	FormatText = "text" // human readable, colored only on a terminal
+	FormatJSON = "json" // one json object per line, for log shippers
+
+	RequestIDHeader = "X-Request-ID" // http header the request id is read from and sent back in
+	RequestIDAMQP   = "x-request-id" // AMQP message header the request id is published in
+	RequestIDField  = "request_id"   // log field
+)
+
+// Formatter : formatter for the format, colors are forced only when logging to a terminal
+func Formatter(format string, terminal bool) (log.Formatter, error) {
+	switch format {
+	case FormatJSON:
+		return &log.JSONFormatter{}, nil
+	case FormatText, "":
+		return &log.TextFormatter{
+			ForceColors:   terminal,
+			DisableColors: !terminal,
+			FullTimestamp: !terminal, // files are read later, when the time matters
+			PadLevelText:  true,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %s, expected text or json", format)
+}
+
+// Rotation : limits for the log file, beyond which it is rotated
+type Rotation struct {
+	MaxSizeMB  int  // rotated when the file grows beyond this
+	MaxAgeDays int  // rotated files older than this are removed, 0 to keep them all
+	MaxBackups int  // count of rotated files kept, 0 to keep them all
+	Compress   bool // rotated files are gzipped
+}
+
+// RotatingFile : log file that rotates itself as per the limits, close it on exit
+func RotatingFile(path string, r Rotation) io.WriteCloser {
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    r.MaxSizeMB,
+		MaxAge:     r.MaxAgeDays,
+		MaxBackups: r.MaxBackups,
+		Compress:   r.Compress,
+		LocalTime:  true,
+	}
+}
+
+type ctxKey struct{}
+
+// validID : ids from the callers are taken as is only if they are sane, else a new one is made
+var validID = regexp.MustCompile(`^[\w\-.:]{1,128}$`)
+
+// NewRequestID : random id, 16 bytes hex
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID : true when the id from the caller can be used as is
+func ValidRequestID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// WithRequestID : context carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// RequestID : request id in the context, empty if none
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// From : log entry with the request id from the context, plain entry when there isnt one
+func From(ctx context.Context) *log.Entry {
+	if id := RequestID(ctx); id != "" {
+		return log.WithField(RequestIDField, id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
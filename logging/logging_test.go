@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatter(t *testing.T) {
+	f, err := Formatter(FormatJSON, false)
+	assert.Nil(t, err, "Unexpected error for json")
+	assert.IsType(t, &log.JSONFormatter{}, f)
+
+	f, err = Formatter(FormatText, false)
+	assert.Nil(t, err, "Unexpected error for text")
+	assert.True(t, f.(*log.TextFormatter).DisableColors, "Expected no colors when not on a terminal")
+	f, _ = Formatter(FormatText, true)
+	assert.True(t, f.(*log.TextFormatter).ForceColors, "Expected colors on a terminal")
+
+	_, err = Formatter("xml", false)
+	assert.NotNil(t, err, "Expected error for unknown format")
+}
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "", RequestID(context.Background()), "Expected no id on a plain context")
+	assert.Equal(t, "", RequestID(nil), "Expected no id on nil context")
+
+	id := NewRequestID()
+	assert.True(t, ValidRequestID(id), "Generated id should be valid")
+	assert.NotEqual(t, id, NewRequestID(), "Expected distinct ids")
+	for _, bad := range []string{"", "has space", "new\nline", string(make([]byte, 129))} {
+		assert.False(t, ValidRequestID(bad), "Expected %q to be invalid", bad)
+	}
+
+	// log lines from the context carry the id as a field
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	out, formatter := logger.Out, logger.Formatter
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+	}()
+	logger.SetOutput(buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	From(WithRequestID(context.Background(), id)).Info("hello")
+	line := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line), "Unexpected log line %s", buf.String())
+	assert.Equal(t, id, line[RequestIDField], "Expected request id in the log line")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scraper.log")
+	lf := RotatingFile(path, Rotation{MaxSizeMB: 1, MaxBackups: 1})
+	_, err := lf.Write([]byte("first line\n"))
+	assert.Nil(t, err, "Unexpected error writing to the log file")
+	assert.Nil(t, lf.Close())
+	byt, err := os.ReadFile(path)
+	assert.Nil(t, err, "Expected log file created on first write")
+	assert.Equal(t, "first line\n", string(byt))
+}
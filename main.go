@@ -11,77 +11,37 @@ author 		:kneerunjun@gmail.com
 date		:01-NOV-2023
 ===========================*/
 import (
-	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"reflect"
 	"regexp"
 	"strings"
-	"time"
 
-	"github.com/eensymachines/tgramscraper/brokers"
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/config"
+	"github.com/eensymachines/tgramscraper/lease"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"github.com/eensymachines/tgramscraper/profiles"
 	"github.com/eensymachines/tgramscraper/scrapers"
-	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/eensymachines/tgramscraper/tracing"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	FVerbose, FLogF, FSeed bool
-	logFile                string
-	RabbitConn             *amqp.Connection // app wide connection used to broadcast the messages received from telegram server
-	BotsRegistry           tokens.TokenRegistry
-)
-
-var (
-	AMQP_USER, AMQP_PASSWD, AMQP_SERVER string
-	BASEURL, NIRCHATID                  string
-
-	SECRET_MOUNT = "/run/secrets/vol-tgramsecrets/" // this is where the secrets are mounted
-	TGRAM_SECRET = "bottoks"                        // when configured on kubernetes this is the name of the secret you want to access
-
-	AMQP_SECRET_MOUNT = "/run/secrets/vol-amqpsecrets/"
-	AMQP_SECRET       = "user password"
-)
-
-// loadBotTokenSecrets : from the mounted secrets this can split get all the distinct tokens
-func loadBotTokenSecrets() ([]string, error) {
-	filepath := fmt.Sprintf("%s%s", SECRET_MOUNT, TGRAM_SECRET)
-	byt, err := os.ReadFile(filepath)
-	if err != nil || byt == nil {
-		// Unable to read file - secrets not loaded
-		return []string{}, fmt.Errorf("error reading the bottokens from secrets %s", err)
-	}
-	if bytes.HasSuffix(byt, []byte("\n")) { //often file read in will have this as a suffix
-		byt, _ = bytes.CutSuffix(byt, []byte("\n"))
-	}
-	return strings.Split(string(byt), " "), nil
-}
-func loadAMQPCredentials() (string, string, error) {
-	var user, pass string
-	secrets := strings.Split(AMQP_SECRET, " ")
-	for _, s := range secrets {
-		filepath := fmt.Sprintf("%s%s", AMQP_SECRET_MOUNT, s)
-		byt, err := os.ReadFile(filepath)
-		if err != nil || byt == nil {
-			// Unable to read file - secrets not loaded
-			return "", "", fmt.Errorf("error reading the amqp secrets %s", err)
-		}
-		if bytes.HasSuffix(byt, []byte("\n")) { //often file read in will have this as a suffix
-			byt, _ = bytes.CutSuffix(byt, []byte("\n"))
-		}
-		if s == "user" {
-			user = string(byt)
-		}
-		if s == "password" {
-			pass = string(byt)
-		}
-	}
-	return user, pass, nil
-}
 func init() {
 	/* -------------
 	Setting up log configuration for the api
@@ -91,146 +51,183 @@ func init() {
 		FullTimestamp: false,
 		ForceColors:   true,
 		PadLevelText:  true,
-	})
+	}) // cfg.LogFormat will set it main
 	log.SetReportCaller(false)
 	// By default the log output is stdout and the level is info
-	log.SetOutput(os.Stdout)     // FLogF will set it main, but dfault is stdout
-	log.SetLevel(log.DebugLevel) // default level info debug but FVerbose will set it main
-	logFile = os.Getenv("LOGF")
+	log.SetOutput(os.Stdout)    // cfg.LogToFile will set it main, but dfault is stdout
+	log.SetLevel(log.InfoLevel) // cfg.Verbose will set it main
+}
 
-	/* -------------
-	Environment variables || default values
-	----------------*/
-	AMQP_SERVER = os.Getenv("AMQP_SERVER")
-	NIRCHATID = os.Getenv("NIRCHATID")
-	BASEURL = os.Getenv("BASEURL")
-	if AMQP_SERVER == "" || NIRCHATID == "" || BASEURL == "" {
-		log.WithFields(log.Fields{
-			"server":    AMQP_SERVER,
-			"nirchatid": NIRCHATID,
-			"baseurl":   BASEURL,
-		}).Panic("failed to load one or more environment veairbles")
+// routeItem : topic and the encoded body for the update, as per the bot profile.
+// Topic the processors have set takes precedence over the routing of the profile
+func routeItem(profile profiles.Profile, botid string, item pipeline.Item) (string, amqp.Publishing, error) {
+	topic := item.Topic
+	if topic == "" {
+		var err error
+		if topic, err = profile.Topic(botid, item.Update); err != nil {
+			return "", amqp.Publishing{}, err
+		}
 	}
-	log.Debug("Environment vars loadeed..")
-
-	var err error
-	AMQP_USER, AMQP_PASSWD, err = loadAMQPCredentials()
+	body, contentType, err := profile.Encode(item.Update)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"user":     AMQP_USER,
-			"password": AMQP_PASSWD,
-			"err":      err,
-		}).Panic("failed to read secret amqo credentials")
+		return "", amqp.Publishing{}, err
 	}
-	log.WithFields(log.Fields{
-		"user":     AMQP_USER,
-		"password": AMQP_PASSWD,
-	}).Debug("AMQP credentials read in..")
+	msg := amqp.Publishing{ContentType: contentType, Body: body}
+	if len(item.Headers) > 0 {
+		msg.Headers = amqp.Table{}
+		for k, v := range item.Headers {
+			msg.Headers[k] = v
+		}
+	}
+	return topic, msg, nil
+}
 
-	/* -------------
-	Loading telegram bot secrets
-	------------- */
-	toks, err := loadBotTokenSecrets()
+// publishResult : publishes each of the updates in the scrape result, exchange, topic and encoding as per the bot profile
+// Updates go through the processors of the bot first, what comes out of the processors is published.
+// Each update is remembered once published, re-scrapes from a stale offset skip it.
+// Each publish is a span under the trace in reqCtx, trace context goes along in the message headers
+func (a *App) publishResult(reqCtx context.Context, conn Publisher, botUpdate *scrapers.ScrapeResult) error {
+	profile := a.Profiles.For(botUpdate.ForBot) // exchange, topic and encoding of the messages is per bot
+	items, err := a.processResult(reqCtx, botUpdate, false)
 	if err != nil {
-		log.Panic(err)
+		logging.From(reqCtx).WithFields(log.Fields{
+			"err": err,
+			"bot": botUpdate.ForBot,
+		}).Error("failed publishResult: processors of the bot failed")
+		return fmt.Errorf("failed to process the updates: %s", err)
 	}
-	for _, t := range toks {
-		log.WithFields(log.Fields{
-			"tok": t,
-		}).Debug("token")
+	pending := map[string]int{} // items of each update yet to be published, update is marked published once all are
+	for _, item := range items {
+		pending[item.Update.UpdtID.String()]++
 	}
-	BotsRegistry = tokens.NewSimpleTokenRegistry(toks...)
-	log.WithFields(log.Fields{
-		"count": BotsRegistry.Count(),
-	}).Debug("botsregistry read in")
+	published := map[string]int{}
+	for _, item := range items {
+		updt := item.Update
+		id := updt.UpdtID.String()
+		// NOTE: the broker gets each message published independently, not as an slice
+		// incase there arent any results, no publications
+		// conn.BindAQueue("test.listener", "amq.topic", publishTopic) // this is only for testing purposes
+		publishTopic, msg, err := routeItem(profile, botUpdate.ForBot, item)
+		if err == nil {
+			// broker side dedup gets the same id for the same update, however many times it is scraped
+			msg.MessageId = messageID(botUpdate.ForBot, updt, published[id])
+			if msg.Headers == nil {
+				msg.Headers = amqp.Table{}
+			}
+			msg.Headers[dedupeHeader] = msg.MessageId
+			err = conn.Publish(reqCtx, profile.Exchange, publishTopic, msg)
+			metrics.Published(profile.Exchange, err)
+		}
+		if err != nil {
+			logging.From(reqCtx).WithFields(log.Fields{
+				"err":      err,
+				"exchange": profile.Exchange,
+				"topic":    publishTopic,
+			}).Error("failed publishResult: failed to publish to rabbit broker")
+			return fmt.Errorf("failed to publish to exchange %s under topic %s", profile.Exchange, publishTopic)
+		}
+		if m := updt.Msg(); m != nil {
+			metrics.PublishLag(botUpdate.ForBot, m.Date)
+		}
+		if published[id]++; published[id] == pending[id] {
+			a.markPublished(reqCtx, botUpdate.ForBot, updt)
+			a.Hub.Publish(botUpdate.ForBot, updt) // stream subscribers get each update once, however many messages the processors made of it
+		}
+	}
+	a.replyRejected(reqCtx, conn, botUpdate)
+	return nil
+}
 
-	// Testing amqp connection , and aborting early
-	_, err = brokers.RabbitConnDial(AMQP_USER, AMQP_PASSWD, AMQP_SERVER)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"user":   AMQP_USER,
-			"server": AMQP_SERVER,
-			"err":    err,
-		}).Panic("failed to connect to AMQP server")
+// newScrapeJob : scraper and the scrape configuration for the bot, as per its profile
+func (a *App) newScrapeJob(botid, offset string) scrapers.BatchJob {
+	profile := a.Profiles.For(botid)
+	return scrapers.BatchJob{
+		BotID: botid,
+		Scraper: &observedScraper{
+			BotID:   botid,
+			Scraper: a.Scrapers(botid, offset),
+		},
+		Config: scrapers.ScrapeConfig{
+			RequestTimeout: profile.RequestTimeout,
+			Transport:      a.Transport,
+			AllowedUpdates: profile.AllowedUpdates,
+			Filter: func(u models.Update) bool {
+				id, _ := u.Chat().ChatID.Int64()
+				return profile.AllowsChat(id)
+			},
+		},
 	}
 }
 
 // HndlRabbitPublish : message received in context from the previous handlers is published to the rabbit broker
-func HndlRabbitPublish(ctx *gin.Context) {
-	conn, err := brokers.RabbitConnDial(AMQP_USER, AMQP_PASSWD, AMQP_SERVER)
-	if err != nil || conn == nil {
-		log.WithFields(log.Fields{
-			"user":   AMQP_USER,
-			"server": AMQP_SERVER,
+func (a *App) HndlRabbitPublish(ctx *gin.Context) {
+	conn, err := a.Broker.Open()
+	if err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"server": a.Config.AMQP.Server,
 			"err":    err,
 		}).Error("failed HndlRabbitPublish: unsuccessful rabbit dial connection")
-		ctx.AbortWithStatusJSON(http.StatusBadGateway, gin.H{
-			"err": "One or more gateway connections have failed",
-		})
+		api.Abort(ctx, http.StatusBadGateway, api.CodeGatewayFailed, "One or more gateway connections have failed", nil)
 		return
 	}
-	log.Debug("rabbit connected..")
-	defer conn.CloseConn()
+	logging.From(ctx.Request.Context()).Debug("rabbit connected..")
+	defer conn.Close()
 	val, ok := ctx.Get("scrape_result")
 	if !ok {
-		log.WithFields(log.Fields{
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
 			"scrape_result": val,
 		}).Error("failed HndlRabbitPublish: invalid or empty scrape result")
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"err": "One ",
-		})
+		api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "No scrape result to publish", nil)
 		return
 	}
 	botUpdate, ok := val.(*scrapers.ScrapeResult)
 	if !ok || botUpdate == nil {
-		log.WithFields(log.Fields{
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
 			"update_type": reflect.TypeOf(botUpdate).String(),
 		}).Error("failed HndlRabbitPublish: Invalid type of scrape result, expected *scrapers.ScrapeResult")
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+		api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "Invalid scrape result, cannot publish", nil)
 		return
 	}
-	publishTopic := fmt.Sprintf("%s.updates", botUpdate.ForBot) // fixing the topic under which the message is published.
-	for _, updt := range botUpdate.AllMessages {
-		// NOTE: the broker gets each message published independently, not as an slice
-		// incase there arent any results, no publications
-		// conn.BindAQueue("test.listener", "amq.topic", publishTopic) // this is only for testing purposes
-		err = conn.Publish([]byte(updt), "amq.topic", publishTopic)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("failed HndlRabbitPublish: failed to publish to rabbit broker")
-			ctx.AbortWithStatusJSON(http.StatusBadGateway, gin.H{
-				"err": "Received updates, but failed to publish",
-			})
-			return
-		}
+	if err := a.publishResult(ctx.Request.Context(), conn, botUpdate); err != nil {
+		api.Abort(ctx, http.StatusBadGateway, api.CodeGatewayFailed, "Received updates, but failed to publish", err.Error())
+		return
 	}
-
 	ctx.AbortWithStatusJSON(http.StatusOK, botUpdate)
 }
 
-func HndlScrapeTrigger(ctx *gin.Context) {
+// HndlScrapeTrigger : scrapes the bot from the offset, result is set in the context for the handlers downstream.
+// Span for the trigger covers the handlers downstream too, the trace is continued if the caller sends traceparent
+func (a *App) HndlScrapeTrigger(ctx *gin.Context) {
+	reqCtx := otel.GetTextMapPropagator().Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+	reqCtx, span := tracing.Tracer().Start(reqCtx, "scrape trigger", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("bot.id", ctx.Param("botid")),
+		attribute.String("http.route", ctx.FullPath()),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", ctx.Writer.Status()))
+		if ctx.Writer.Status() >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, http.StatusText(ctx.Writer.Status()))
+		}
+		span.End()
+	}()
+	ctx.Request = ctx.Request.WithContext(reqCtx)
 	rgx := regexp.MustCompile(`^[0-9]+$`)     // url params checked
 	if !rgx.MatchString(ctx.Param("botid")) { // always numerical id
 		errMsg := fmt.Errorf("invalid bot chat id in url, check & send again")
-		log.WithFields(log.Fields{
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
 			"err-msg": errMsg,
 			"botid":   ctx.Param("botid"),
 		}).Error(errMsg)
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"err": errMsg,
-		})
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, errMsg.Error(), gin.H{"botid": ctx.Param("botid")})
 		return
 	}
 	if !rgx.MatchString(ctx.Param("updtid")) { // validating updtid
 		errMsg := fmt.Errorf("invalid bot update offset in url, check & send again")
-		log.WithFields(log.Fields{
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
 			"err-msg":   errMsg,
 			"update-id": ctx.Param("updtid"),
 		}).Error(errMsg)
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"err": errMsg,
-		})
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, errMsg.Error(), gin.H{"updtid": ctx.Param("updtid")})
 		return
 	}
 	// Preparing the broker to be consumed by the scraper
@@ -238,57 +235,211 @@ func HndlScrapeTrigger(ctx *gin.Context) {
 	// TODO: access rabbit broker and post the mesasge
 
 	// Response writer
-	scraper := scrapers.Scraper(&scrapers.TelegramScraper{UID: ctx.Param("botid"), BaseUrl: BASEURL, Offset: ctx.Param("updtid"), Registry: BotsRegistry})
-	resp, err := scraper.Scrape(scrapers.ScrapeConfig{RequestTimeout: 6 * time.Second})
+	job := a.newScrapeJob(ctx.Param("botid"), ctx.Param("updtid"))
+	job.Config.Context = reqCtx
+	resp, err := job.Scraper.Scrape(job.Config)
 	if err != nil {
-		log.WithFields(log.Fields{
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
 			"botid":          ctx.Param("botid"),
 			"offset":         ctx.Param("updtid"),
-			"count_reg_bots": BotsRegistry.Count(),
-			"broker_nil":     fmt.Sprintf("%t", BotsRegistry.Count() > 0),
+			"count_reg_bots": a.Registry.Count(),
+			"broker_nil":     fmt.Sprintf("%t", a.Registry.Count() > 0),
 		}).Errorf("failed to scrape/TelegramScraper: %s", err)
+		abortScrapeErr(ctx, err)
+		return
 	}
-	log.WithFields(log.Fields{
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
 		"count": resp.UpdateCount,
 	}).Debug("received updates from telegram server")
 	ctx.Set("scrape_result", resp) // downstreaming processing of the scrape
 	ctx.Next()
 }
 
+// scrapeErrEnvelope : maps the errors from the scraper to the status code and the error envelope.
+// Messages are fixed for each kind of error, the errors themselves are only for the logs - urls of the failed calls carry the bot token
+func scrapeErrEnvelope(err error) (int, api.Error) {
+	switch {
+	case errors.Is(err, scrapers.ErrBotNotRegistered):
+		return http.StatusNotFound, api.Error{Code: api.CodeBotNotFound, Message: scrapers.ErrBotNotRegistered.Error()}
+	case errors.Is(err, scrapers.ErrTokenRevoked):
+		return http.StatusForbidden, api.Error{Code: api.CodeTokenRevoked, Message: scrapers.ErrTokenRevoked.Error()}
+	case errors.Is(err, lease.ErrHeld):
+		return http.StatusConflict, api.Error{Code: api.CodeBotBusy, Message: "bot is being polled elsewhere, try again"}
+	case errors.Is(err, scrapers.ErrTimeout):
+		return http.StatusBadGateway, api.Error{Code: api.CodeUpstreamFailed, Message: "telegram server did not respond in time"}
+	}
+	return http.StatusBadGateway, api.Error{Code: api.CodeUpstreamFailed, Message: fmt.Sprintf("telegram server call failed: %s", scrapers.Reason(err))}
+}
+
+// abortScrapeErr : aborts with the envelope for the scrape error
+func abortScrapeErr(ctx *gin.Context, err error) {
+	status, envelope := scrapeErrEnvelope(err)
+	ctx.AbortWithStatusJSON(status, envelope)
+}
+
+// HndlBotsStatus : state of all the registered bots, tokens are never a part of the response
+func (a *App) HndlBotsStatus(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusOK, a.Registry.Statuses())
+}
+
+// HndlBotStatus : state of a single registered bot
+func (a *App) HndlBotStatus(ctx *gin.Context) {
+	st, ok := a.Registry.Status(ctx.Param("botid"))
+	if !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", ctx.Param("botid")), nil)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, st)
+}
+
+// HndlStageToken : new token is held as pending alongside the current token of the bot
+// Payload is {"token": "<new bot token>"}, token has to belong to the bot in the url
+func (a *App) HndlStageToken(ctx *gin.Context) {
+	payload := struct {
+		Token string `json:"token"`
+	}{}
+	if err := ctx.ShouldBindJSON(&payload); err != nil || !strings.HasPrefix(payload.Token, ctx.Param("botid")+":") {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid payload, expected token of the same bot", nil)
+		return
+	}
+	if err := a.Registry.Stage(payload.Token); err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid": ctx.Param("botid"),
+			"err":   err,
+		}).Error("failed HndlStageToken: could not stage token")
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, err.Error(), nil)
+		return
+	}
+	st, _ := a.Registry.Status(ctx.Param("botid"))
+	ctx.AbortWithStatusJSON(http.StatusOK, st)
+}
+
+// HndlRotateToken : tries the pending token against the telegram server, and switches over to it only if its accepted.
+// Old token is retired on switch over.
+func (a *App) HndlRotateToken(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	curTok, _ := a.Registry.Find(botid)
+	pendTok, ok := a.Registry.Pending(botid)
+	if !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("no pending token staged for bot %s", botid), nil)
+		return
+	}
+	if err := a.telegram(botid, "").VerifyToken(pendTok, scrapers.ScrapeConfig{RequestTimeout: a.Profiles.For(botid).RequestTimeout, Transport: a.Transport}); err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid": botid,
+			"err":   err,
+		}).Error("failed HndlRotateToken: pending token not accepted by telegram server")
+		api.Abort(ctx, http.StatusBadGateway, api.CodeUpstreamFailed, "pending token not accepted by telegram server, current token continues", nil)
+		return
+	}
+	if err := a.Registry.Promote(botid, curTok, pendTok); err != nil {
+		api.Abort(ctx, http.StatusConflict, api.CodeConflict, err.Error(), nil)
+		return
+	}
+	st, _ := a.Registry.Status(botid)
+	ctx.AbortWithStatusJSON(http.StatusOK, st)
+}
+
+// HndlBotProfile : effective profile of the bot, callers can use the polling interval to schedule the scrapes
+func (a *App) HndlBotProfile(ctx *gin.Context) {
+	if _, ok := a.Registry.Find(ctx.Param("botid")); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", ctx.Param("botid")), nil)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, a.Profiles.For(ctx.Param("botid")))
+}
+
+// HndlPing : to check if the service is up
+func HndlPing(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"app":    "Telegram scraper",
+		"author": "kneerunjun@gmail.com",
+		"date":   "November 2023",
+		"msg":    "If you are able to see this, you know the telegram scraper is working fine",
+	})
+}
+
 func main() {
-	defer RabbitConn.Close() // cleaning up the connection when not required
-	flag.Parse()             // command line flags are parsed
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		fmt.Print(cfg)
+		return
+	}
+	formatter, err := logging.Formatter(cfg.LogFormat, !cfg.LogToFile)
+	if err != nil {
+		log.Fatal(err) // config has validated the format, this is not expected
+	}
+	log.SetFormatter(formatter)
+	if len(cfg.Args) > 0 && cfg.Args[0] != "serve" {
+		log.SetOutput(os.Stderr) // output of the commands is on stdout, logs shouldnt get mixed in
+	}
 	log.WithFields(log.Fields{
-		"verbose": FVerbose,
-		"flog":    FLogF,
-		"seed":    FSeed,
+		"verbose": cfg.Verbose,
+		"flog":    cfg.LogToFile,
+		"format":  cfg.LogFormat,
+		"seed":    cfg.Seed,
 	}).Info("Log configuration..")
-	if FVerbose {
+	if cfg.Verbose {
 		log.SetLevel(log.DebugLevel)
 	}
-	if FLogF {
-		lf, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Failed to connect to log file, kindly check the privileges")
-		} else {
-			log.Infof("Check log file for entries @ %s", logFile)
-			log.SetOutput(lf)
-		}
+	if cfg.LogToFile {
+		// file is opened lazily on the first write, and rotated as per the limits
+		lf := logging.RotatingFile(cfg.LogFile, logging.Rotation(cfg.LogRotation))
+		defer lf.Close()
+		log.Infof("Check log file for entries @ %s", cfg.LogFile)
+		log.SetOutput(lf)
+	}
+	log.Debugf("effective configuration:\n%s", cfg)
+	if err := runCommand(cfg, os.Stdout); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// cmdServe : runs the http server and the outbox consumers till SIGINT or SIGTERM
+func cmdServe(cfg *config.Config, args []string, out io.Writer) error {
+	app, err := newAppFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), "tgramscraper")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to setup tracing, continuing without exporting spans")
+		shutdownTracing = func(context.Context) error { return nil }
 	}
+	defer shutdownTracing(context.Background())
+	log.WithFields(log.Fields{
+		"exporting": tracing.Enabled(),
+	}).Info("tracing configured")
 	log.Info("Now starting the telegram scraper microservice")
 	gin.SetMode(gin.DebugMode)
-	r := gin.Default()
-	r.GET("/ping", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"app":    "Telegram scraper",
-			"author": "kneerunjun@gmail.com",
-			"date":   "November 2023",
-			"msg":    "If you are able to see this, you know the telegram scraper is working fine",
-		})
-	})
-	r.POST("/bots/:botid/scrape/:updtid", HndlScrapeTrigger, HndlRabbitPublish)
+	r, err := app.Router()
+	if err != nil {
+		return err
+	}
+
+	if err := app.loadSchedules(); err != nil {
+		return err
+	}
 
-	log.Fatal(r.Run(":8080"))
+	// replies queued by the downstream services are sent from here
+	for _, st := range app.Registry.Statuses() {
+		app.startOutbox(st.UID)
+	}
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: r}
+	if err := app.serve(srv, cfg.ShutdownTimeout); err != nil {
+		return err
+	}
+	log.Info("telegram scraper stopped")
+	return nil
 }
@@ -0,0 +1,71 @@
+// Media is the local store for files from the messages - photos and documents
+
+// Files are addressed by the sha256 of the content, same file sent twice is stored only once.
+// Consumers get a reference to the stored file in the published update and never need the bot token.
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var hashRegx = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Store : content addressed files under the root directory, root/ab/cd/abcd....
+type Store struct {
+	Root string
+}
+
+// NewStore : creates the root directory if not already
+func NewStore(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create media store at %s: %s", root, err)
+	}
+	return &Store{Root: root}, nil
+}
+
+// path : where the file with the hash is in the store
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.Root, hash[0:2], hash[2:4], hash)
+}
+
+// Put : copies the content to the store, sends back the hash & size of the content.
+// Content is first written to a temp file and then moved in place, readers never see half written files.
+func (s *Store) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.Root, ".incoming-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temp file in media store: %s", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	tmp.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write to media store: %w", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	dst := s.path(hash)
+	if _, err := os.Stat(dst); err == nil {
+		return hash, size, nil // already stored
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create directory in media store: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, fmt.Errorf("failed to move file in media store: %s", err)
+	}
+	return hash, size, nil
+}
+
+// Open : stored file by its hash, errors with os.ErrNotExist if its not in the store
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !hashRegx.MatchString(hash) {
+		return nil, fmt.Errorf("invalid hash %s: %w", hash, os.ErrNotExist)
+	}
+	return os.Open(s.path(hash))
+}
@@ -0,0 +1,39 @@
+package media_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/eensymachines/tgramscraper/media"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	store, err := media.NewStore(t.TempDir())
+	assert.Nil(t, err, "Unexpected error creating store")
+
+	hash, size, err := store.Put(strings.NewReader("hello there"))
+	assert.Nil(t, err, "Unexpected error putting in store")
+	assert.Equal(t, int64(11), size, "Unexpected size")
+	assert.Equal(t, "12998c017066eb0d2a70b94e6ed3192985855ce390f321bbdb832022888bd251", hash, "Unexpected hash")
+
+	// TEST: same content is addressed the same
+	again, _, err := store.Put(strings.NewReader("hello there"))
+	assert.Nil(t, err, "Unexpected error putting duplicate in store")
+	assert.Equal(t, hash, again, "Unexpected hash for same content")
+
+	f, err := store.Open(hash)
+	assert.Nil(t, err, "Unexpected error opening stored file")
+	byt, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "hello there", string(byt), "Unexpected stored content")
+
+	// TEST: hashes that arent in the store, or arent hashes at all
+	for _, h := range []string{"../../etc/passwd", strings.Repeat("a", 64)} {
+		_, err = store.Open(h)
+		assert.True(t, errors.Is(err, os.ErrNotExist), "Unexpected error for %s: %s", h, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// newSender : sender for the bot, tokens from the same registry as the scrapers.
+// All the sends are scheduled by a.Limiter to stay within the flood limits of the telegram server
+func (a *App) newSender(botid string) (senders.Sender, senders.SendConfig) {
+	return &senders.LimitedSender{
+			Sender:  &senders.TelegramSender{UID: botid, BaseUrl: a.Config.BaseURL, Registry: a.Registry},
+			BotID:   botid,
+			Limiter: a.Limiter,
+		},
+		senders.SendConfig{RequestTimeout: a.Profiles.For(botid).RequestTimeout, Transport: a.Transport}
+}
+
+// sendErrEnvelope : maps the errors from the sender to the status code and the error envelope
+func sendErrEnvelope(err error) (int, api.Error) {
+	if te, ok := senders.AsTelegramError(err); ok {
+		details := gin.H{"error_code": te.Code, "description": te.Description}
+		if te.Code == http.StatusTooManyRequests {
+			details["retry_after"] = te.RetryAfter
+			return http.StatusTooManyRequests, api.Error{Code: api.CodeRateLimited, Message: te.Error(), Details: details}
+		}
+		if te.Code >= http.StatusInternalServerError {
+			return http.StatusBadGateway, api.Error{Code: api.CodeUpstreamFailed, Message: te.Error(), Details: details}
+		}
+		return http.StatusUnprocessableEntity, api.Error{Code: api.CodeRejected, Message: te.Error(), Details: details}
+	}
+	return scrapeErrEnvelope(err)
+}
+
+// HndlSendMessage : proxies sendMessage for the bot, so downstream services need not hold the bot token
+func (a *App) HndlSendMessage(ctx *gin.Context) {
+	msg := senders.OutboundMessage{}
+	if err := ctx.ShouldBindJSON(&msg); err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid payload, expected sendMessage payload", nil)
+		return
+	}
+	if err := msg.Validate(); err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, err.Error(), nil)
+		return
+	}
+	sender, config := a.newSender(ctx.Param("botid"))
+	config.Context = ctx.Request.Context() // client giving up also takes the message out of the queue
+	result, err := sender.Send(msg, config)
+	if err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid": ctx.Param("botid"),
+			"chat":  msg.ChatID,
+		}).Errorf("failed HndlSendMessage: %s", err)
+		status, envelope := sendErrEnvelope(err)
+		ctx.AbortWithStatusJSON(status, envelope)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, result)
+}
+
+// HndlSendQueue : count of sends waiting for their turn, and if the bot is held back by the telegram server
+func (a *App) HndlSendQueue(ctx *gin.Context) {
+	if _, ok := a.Registry.Find(ctx.Param("botid")); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", ctx.Param("botid")), nil)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, a.Limiter.Status(ctx.Param("botid")))
+}
+
+// runOutbox : consumes the outbox queue of the bot until stop is closed.
+// Broker connection is dialled afresh each time its lost, with a pause in between.
+func (a *App) runOutbox(botid string, stop <-chan struct{}) {
+	for {
+		conn, err := a.Broker.Dial()
+		if err == nil {
+			queue := senders.OutboxQueue(botid)
+			var deliveries <-chan amqp.Delivery
+			if err = conn.BindAQueue(queue, "amq.topic", queue); err == nil {
+				deliveries, err = conn.ConsumeQueue(queue)
+			}
+			if err == nil {
+				log.WithFields(log.Fields{
+					"bot":   botid,
+					"queue": queue,
+				}).Info("outbox consumer started")
+				sender, config := a.newSender(botid)
+				ob := &senders.Outbox{BotID: botid, Sender: sender, Config: config, Exchange: "amq.topic", Publish: conn.PublishMessage, Limiter: a.Limiter}
+				ob.Run(deliveries, stop)
+			}
+			conn.CloseConn()
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"bot": botid,
+				"err": err,
+			}).Error("failed runOutbox: could not consume outbox")
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
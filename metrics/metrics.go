@@ -0,0 +1,154 @@
+// Prometheus metrics for scrapes, updates, publishes and the calls to the telegram server
+
+// All the collectors are registered with the default registry, Handler serves them for the /metrics endpoint.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tgramscraper"
+
+// UnknownBot : bot label for ids that arent registered, ids come in from the urls and would grow the series without bound
+const UnknownBot = "unknown"
+
+var (
+	scrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrapes_total",
+		Help:      "Count of scrapes per bot, successful or not",
+	}, []string{"bot"})
+	scrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scrape_duration_seconds",
+		Help:      "Time taken by the scrape, including the call to the telegram server",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2, 4, 8},
+	}, []string{"bot"})
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_errors_total",
+		Help:      "Failed scrapes per bot by the type of error",
+	}, []string{"bot", "type"})
+	updates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_received_total",
+		Help:      "Updates received from the telegram server per bot and kind of update",
+	}, []string{"bot", "kind"})
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_dropped_total",
+		Help:      "Updates left out before publishing per bot, by the stage that left them out",
+	}, []string{"bot", "stage"})
+	duplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_duplicate_total",
+		Help:      "Updates skipped per bot since they were published earlier, re-scrapes from a stale offset",
+	}, []string{"bot"})
+	publishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publishes_total",
+		Help:      "Messages published to the broker per exchange, by result - success or failure",
+	}, []string{"exchange", "result"})
+	publishLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_lag_seconds",
+		Help:      "Time between the message being sent on telegram and it being published to the broker",
+		Buckets:   []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"bot"})
+	telegramResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_responses_total",
+		Help:      "Http responses from the telegram server by bot api method and status code",
+	}, []string{"method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(scrapes, scrapeDuration, scrapeErrors, updates, dropped, duplicates, publishes, publishLag, telegramResponses)
+}
+
+// Handler : serves the metrics for prometheus to scrape
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveScrape : counts the scrape and its duration, errType is empty for successful scrapes
+func ObserveScrape(bot string, took time.Duration, errType string) {
+	scrapes.WithLabelValues(bot).Inc()
+	scrapeDuration.WithLabelValues(bot).Observe(took.Seconds())
+	if errType != "" {
+		scrapeErrors.WithLabelValues(bot, errType).Inc()
+	}
+}
+
+// UpdateReceived : counts the update by its kind
+func UpdateReceived(bot, kind string) {
+	updates.WithLabelValues(bot, kind).Inc()
+}
+
+// Dropped : counts the update left out by the stage - the chat filter of the profile or one of the processors
+func Dropped(bot, stage string) {
+	dropped.WithLabelValues(bot, stage).Inc()
+}
+
+// Duplicate : counts the update skipped since it was published earlier
+func Duplicate(bot string) {
+	duplicates.WithLabelValues(bot).Inc()
+}
+
+// Published : counts the publish as success or failure
+func Published(exchange string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	publishes.WithLabelValues(exchange, result).Inc()
+}
+
+// PublishLag : observes the lag from the date of the message (unix seconds) till now, messages without date are skipped
+func PublishLag(bot string, date int64) {
+	if date <= 0 {
+		return
+	}
+	publishLag.WithLabelValues(bot).Observe(time.Since(time.Unix(date, 0)).Seconds())
+}
+
+// telegramMethod : bot api method from the url path, never the token. /bot<token>/getUpdates is getUpdates
+func telegramMethod(path string) string {
+	if strings.HasPrefix(path, "/file/") {
+		return "file"
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 2 && strings.HasPrefix(parts[len(parts)-2], "bot") {
+		return parts[len(parts)-1]
+	}
+	return "unknown"
+}
+
+// transport : counts the responses from the telegram server
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	code := "error" // no response at all, timeouts & connection failures
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	telegramResponses.WithLabelValues(telegramMethod(req.URL.Path), code).Inc()
+	return resp, err
+}
+
+// Transport : wraps the round tripper so each response from the telegram server is counted, nil for the default transport
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{next: next}
+}
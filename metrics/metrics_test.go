@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelegramMethod(t *testing.T) {
+	cases := map[string]string{
+		"/bot6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4/getUpdates":        "getUpdates",
+		"/bot6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4/sendMessage":       "sendMessage",
+		"/file/bot6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4/photos/a.jpg": "file",
+		"/":         "unknown",
+		"/whatever": "unknown",
+	}
+	for path, method := range cases {
+		assert.Equal(t, method, telegramMethod(path), "Unexpected method for %s", path)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: Transport(nil)}
+	before := testutil.ToFloat64(telegramResponses.WithLabelValues("getMe", "401"))
+	resp, err := client.Get(fmt.Sprintf("%s/bot123:abc/getMe", srv.URL))
+	assert.Nil(t, err, "Unexpected error from the test server")
+	resp.Body.Close()
+	assert.Equal(t, before+1, testutil.ToFloat64(telegramResponses.WithLabelValues("getMe", "401")), "Unexpected count of responses")
+}
+
+func TestObservations(t *testing.T) {
+	ObserveScrape("bot", time.Second, "")
+	ObserveScrape("bot", time.Second, "revoked")
+	assert.Equal(t, float64(2), testutil.ToFloat64(scrapes.WithLabelValues("bot")), "Unexpected count of scrapes")
+	assert.Equal(t, float64(1), testutil.ToFloat64(scrapeErrors.WithLabelValues("bot", "revoked")), "Unexpected count of errors")
+
+	Published("amq.topic", nil)
+	Published("amq.topic", fmt.Errorf("failed"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(publishes.WithLabelValues("amq.topic", "failure")), "Unexpected count of failed publishes")
+
+	PublishLag("bot", time.Now().Add(-3*time.Second).Unix())
+	PublishLag("bot", 0) // skipped
+	assert.Equal(t, 1, testutil.CollectAndCount(publishLag), "Unexpected count of lag series")
+
+	Dropped("bot", "dedup")
+	assert.Equal(t, float64(1), testutil.ToFloat64(dropped.WithLabelValues("bot", "dedup")), "Unexpected count of dropped updates")
+	Duplicate("bot")
+	assert.Equal(t, float64(1), testutil.ToFloat64(duplicates.WithLabelValues("bot")), "Unexpected count of duplicates")
+
+	UpdateReceived("bot", "message")
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.Contains(rec.Body.String(), `tgramscraper_updates_received_total{bot="bot",kind="message"} 1`), "Unexpected metrics output")
+}
@@ -17,15 +17,169 @@ type Chat struct {
 	Typ    string      `json:"type"`
 }
 type UpdateMessage struct {
-	MsgId json.Number `json:"message_id"`
-	From  Sender      `json:"from"`
-	Chat  Chat        `json:"chat"`
-	Text  string      `json:"text"`
+	MsgId    json.Number `json:"message_id"`
+	From     Sender      `json:"from"`
+	Chat     Chat        `json:"chat"`
+	Date     int64       `json:"date"` // unix time when the message was sent
+	Text     string      `json:"text"`
+	Caption  string      `json:"caption,omitempty"`  // text that comes along with photos & documents
+	Photo    []PhotoSize `json:"photo,omitempty"`    // same photo in different sizes, largest is the last
+	Document *Document   `json:"document,omitempty"` // any file that isnt a photo
+	Entities []Entity    `json:"entities,omitempty"` // special parts of the text - commands, mentions, urls
 }
 
+// Entity : special part of the text of the message.
+// Offset and length are in UTF-16 code units, as telegram counts them
+type Entity struct {
+	Type   string `json:"type"` // bot_command, mention, url, ..
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// Command : bot command the message starts with, /name@bot args.
+// Not a part of the telegram update, parsed by the service before publishing
+type Command struct {
+	Name    string   `json:"name"`              // without the slash and the mention, lower case
+	Args    []string `json:"args"`              // quoted arguments are one each, without the quotes
+	RawArgs string   `json:"raw_args"`          // text after the command as it is
+	Mention string   `json:"mention,omitempty"` // username of the bot the command is addressed to, /name@mention
+}
+
+// PhotoSize is one of the sizes of the photo sent in a message
+type PhotoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Document is a general file sent in a message
+type Document struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// File is what getFile sends back, FilePath is needed to download the file
+type File struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	FilePath     string `json:"file_path,omitempty"`
+}
+
+// MediaRef : reference to a file from the message, downloaded to the local media store.
+// Not a part of the telegram update, attached by the service before publishing
+type MediaRef struct {
+	FileID   string `json:"file_id"`
+	SHA256   string `json:"sha256"` // files in the store are addressed by the hash of the content
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type,omitempty"`
+	Ref      string `json:"ref"` // url path from which the stored file can be fetched
+}
+
+// CallbackQuery is sent when a user presses a button on an inline keyboard
+type CallbackQuery struct {
+	ID      string         `json:"id"`
+	From    Sender         `json:"from"`
+	Message *UpdateMessage `json:"message,omitempty"`
+	Data    string         `json:"data"`
+}
+
+// Update : only one of the optional fields is set in any update, Kind() tells which one
 type Update struct {
-	UpdtID  json.Number   `json:"update_id"` //easier to deal with this as string, since its a big.Int, unless ofcourse you have a math operation on it
-	Message UpdateMessage `json:"message"`
+	UpdtID            json.Number       `json:"update_id"` //easier to deal with this as string, since its a big.Int, unless ofcourse you have a math operation on it
+	Message           *UpdateMessage    `json:"message,omitempty"`
+	EditedMessage     *UpdateMessage    `json:"edited_message,omitempty"`
+	ChannelPost       *UpdateMessage    `json:"channel_post,omitempty"`
+	EditedChannelPost *UpdateMessage    `json:"edited_channel_post,omitempty"`
+	CallbackQuery     *CallbackQuery    `json:"callback_query,omitempty"`
+	Media             []MediaRef        `json:"media,omitempty"`   // not a part of getUpdates, files of the message when stored locally
+	Extra             map[string]string `json:"extra,omitempty"`   // not a part of getUpdates, fields added by the processors of the bot
+	Command           *Command          `json:"command,omitempty"` // not a part of getUpdates, command the message starts with
+}
+
+// Kind : type of the update, same as the names in allowed_updates of getUpdates
+func (u Update) Kind() string {
+	switch {
+	case u.Message != nil:
+		return "message"
+	case u.EditedMessage != nil:
+		return "edited_message"
+	case u.ChannelPost != nil:
+		return "channel_post"
+	case u.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case u.CallbackQuery != nil:
+		return "callback_query"
+	}
+	return "unknown"
+}
+
+// Msg : the message carried by the update irrespective of the kind, nil if the update has none
+func (u Update) Msg() *UpdateMessage {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.EditedMessage != nil:
+		return u.EditedMessage
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	case u.EditedChannelPost != nil:
+		return u.EditedChannelPost
+	case u.CallbackQuery != nil:
+		return u.CallbackQuery.Message
+	}
+	return nil
+}
+
+// Chat : chat the update is from, empty chat if the update has no message
+func (u Update) Chat() Chat {
+	if m := u.Msg(); m != nil {
+		return m.Chat
+	}
+	return Chat{}
+}
+
+// From : sender of the message or the one who pressed the button, empty sender if the update has neither
+func (u Update) From() Sender {
+	if u.CallbackQuery != nil {
+		return u.CallbackQuery.From
+	}
+	if m := u.Msg(); m != nil {
+		return m.From
+	}
+	return Sender{}
+}
+
+// FileIDs : files attached to the message, only the largest size of the photo
+func (u Update) FileIDs() []string {
+	result := []string{}
+	m := u.Msg()
+	if m == nil {
+		return result
+	}
+	if len(m.Photo) > 0 {
+		result = append(result, m.Photo[len(m.Photo)-1].FileID)
+	}
+	if m.Document != nil {
+		result = append(result, m.Document.FileID)
+	}
+	return result
+}
+
+// Text : text of the message, or the data of the callback query
+func (u Update) Text() string {
+	if u.CallbackQuery != nil {
+		return u.CallbackQuery.Data
+	}
+	if m := u.Msg(); m != nil {
+		return m.Text
+	}
+	return ""
 }
 
 type UpdateResponse struct {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/scrapers"
+)
+
+// observedScraper : scraper that records the count, latency and errors of each scrape, and the updates received.
+// Scrapes of bots that arent registered are recorded under metrics.UnknownBot, BotID is what came in the url
+type observedScraper struct {
+	BotID   string
+	Scraper scrapers.Scraper
+}
+
+func (obs *observedScraper) Scrape(c scrapers.ScrapeConfig) (*scrapers.ScrapeResult, error) {
+	start := time.Now()
+	result, err := obs.Scraper.Scrape(c)
+	bot := obs.BotID
+	if errors.Is(err, scrapers.ErrBotNotRegistered) {
+		bot = metrics.UnknownBot
+	}
+	metrics.ObserveScrape(bot, time.Since(start), scrapeErrType(err))
+	if result != nil {
+		// dropped updates were received all the same, only filtered out by the profile
+		for _, updts := range [][]models.Update{result.Updates, result.Dropped} {
+			for _, u := range updts {
+				metrics.UpdateReceived(obs.BotID, u.Kind())
+			}
+		}
+	}
+	return result, err
+}
+
+// scrapeErrType : label for the scrape error, empty when there isnt any error
+func scrapeErrType(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, scrapers.ErrBotNotRegistered):
+		return "bot_not_registered"
+	case errors.Is(err, scrapers.ErrTokenRevoked):
+		return "token_revoked"
+	}
+	return "upstream"
+}
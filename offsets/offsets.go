@@ -0,0 +1,95 @@
+// Offsets are where the next scrape of each bot picks up.
+
+// The http service leaves the offset to the caller, one-shot scrapes from a CronJob have no caller to remember it.
+// Those keep the offsets here, and ops can read or correct them from the command line.
+package offsets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var validOffset = regexp.MustCompile(`^[0-9]+$`)
+
+// Store : next offset of each bot
+type Store interface {
+	Get(bot string) (string, bool, error) // false when there isnt any offset stored for the bot
+	Set(bot, offset string) error
+	All() (map[string]string, error)
+}
+
+// FileStore : offsets in a json file, bot id to offset. Safe for concurrent use within the process.
+// Writes go to a temp file that is renamed over, so a crash mid write does not lose the offsets
+type FileStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NewFileStore : store over the file at path, the file is created on the first Set
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// read : offsets from the file, empty when the file isnt there yet. Caller has to hold the lock
+func (fs *FileStore) read() (map[string]string, error) {
+	all := map[string]string{}
+	byt, err := os.ReadFile(fs.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offsets file %s: %s", fs.Path, err)
+	}
+	if err := json.Unmarshal(byt, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse offsets file %s: %s", fs.Path, err)
+	}
+	return all, nil
+}
+
+func (fs *FileStore) Get(bot string) (string, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	all, err := fs.read()
+	if err != nil {
+		return "", false, err
+	}
+	offset, ok := all[bot]
+	return offset, ok, nil
+}
+
+func (fs *FileStore) All() (map[string]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.read()
+}
+
+// Set : offset has to be numerical, same as the offset in the scrape url
+func (fs *FileStore) Set(bot, offset string) error {
+	if !validOffset.MatchString(offset) {
+		return fmt.Errorf("invalid offset %q, expected a number", offset)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	all, err := fs.read()
+	if err != nil {
+		return err
+	}
+	all[bot] = offset
+	byt, _ := json.MarshalIndent(all, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(fs.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for offsets file: %s", err)
+	}
+	tmp := fs.Path + ".tmp"
+	if err := os.WriteFile(tmp, byt, 0644); err != nil {
+		return fmt.Errorf("failed to write offsets file %s: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, fs.Path); err != nil {
+		return fmt.Errorf("failed to replace offsets file %s: %s", fs.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package offsets
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state", "offsets.json"))
+	_, ok, err := store.Get("6425245255")
+	assert.Nil(t, err, "Missing file should read as empty")
+	assert.False(t, ok, "Unexpected offset before any was set")
+
+	assert.Nil(t, store.Set("6425245255", "100"), "Unexpected error setting the offset")
+	assert.Nil(t, store.Set("6133190482", "7"), "Unexpected error setting the offset")
+	assert.Nil(t, store.Set("6425245255", "102"), "Unexpected error overwriting the offset")
+	assert.NotNil(t, store.Set("6425245255", "abc"), "Expected error for an offset that isnt a number")
+
+	// another store over the same file, as the next run of the cron job would be
+	again := NewFileStore(store.Path)
+	offset, ok, err := again.Get("6425245255")
+	assert.Nil(t, err)
+	assert.True(t, ok, "Expected the offset persisted")
+	assert.Equal(t, "102", offset, "Expected the last offset set")
+	all, err := again.All()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"6425245255": "102", "6133190482": "7"}, all)
+}
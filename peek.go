@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// peekResponse : decoded updates as received from the telegram server, nothing is published
+type peekResponse struct {
+	Bot        string          `json:"bot"`
+	Offset     string          `json:"offset"`      // offset that was requested
+	NextOffset string          `json:"next_offset"` // offset for the updates after these
+	Updates    []models.Update `json:"updates"`
+}
+
+// dryRunRoute : where the update would have gone if it were published
+type dryRunRoute struct {
+	UpdateID    string `json:"update_id"`
+	Kind        string `json:"kind"`
+	Dropped     bool   `json:"dropped"`                // left out by the filters or the processors of the bot, would not be published
+	Exchange    string `json:"exchange,omitempty"`     // exchange it would be published to
+	Topic       string `json:"topic,omitempty"`        // routing key it would be published under
+	ContentType string `json:"content_type,omitempty"` // as per the encoder of the bot profile
+	Size        int    `json:"size"`                   // size of the body in bytes
+	Error       string `json:"error,omitempty"`        // routing or encoding failed for the update
+}
+
+type dryRunReport struct {
+	DryRun bool                   `json:"dry_run"`
+	Result *scrapers.ScrapeResult `json:"result"`
+	Routes []dryRunRoute          `json:"routes"`
+}
+
+// HndlPeekUpdates : gets the updates for the bot and sends them back decoded, without publishing.
+// This isnt read only: telegram server treats the offset as confirmation for all the updates before it, same as the scrape does.
+// Updates confirmed here arent sent to the scrape again, use the same offset the scrape would use and nothing is lost.
+func (a *App) HndlPeekUpdates(ctx *gin.Context) {
+	offset := ctx.DefaultQuery("offset", "0")
+	if !regexp.MustCompile(`^[0-9]+$`).MatchString(offset) {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid offset, expected numerical offset", gin.H{"offset": offset})
+		return
+	}
+	botid := ctx.Param("botid")
+	// same job the scrape runs - allowed_updates of the profile, metrics and cancelled with the request
+	job := a.newScrapeJob(botid, offset)
+	job.Config.Context = ctx.Request.Context()
+	// no chat filters, debugging is when you'd want to see it all
+	job.Config.Filter = nil
+	resp, err := job.Scraper.Scrape(job.Config)
+	if err != nil {
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"botid":  botid,
+			"offset": offset,
+		}).Errorf("failed HndlPeekUpdates: %s", err)
+		abortScrapeErr(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, peekResponse{Bot: botid, Offset: offset, NextOffset: resp.NextUpdateOffset, Updates: resp.Updates})
+}
+
+// HndlDryRun : when the query param dry_run=true, reports where each of the updates would have gone instead of publishing.
+// Sits between HndlScrapeTrigger and HndlRabbitPublish, without dry_run this passes on to publishing.
+func (a *App) HndlDryRun(ctx *gin.Context) {
+	if ctx.Query("dry_run") != "true" {
+		ctx.Next()
+		return
+	}
+	val, _ := ctx.Get("scrape_result")
+	result, ok := val.(*scrapers.ScrapeResult)
+	if !ok || result == nil {
+		api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "No scrape result for the dry run", nil)
+		return
+	}
+	profile := a.Profiles.For(result.ForBot)
+	items, err := a.processResult(ctx.Request.Context(), result, true)
+	if err != nil {
+		api.Abort(ctx, http.StatusInternalServerError, api.CodeInternal, "Processors of the bot failed", err.Error())
+		return
+	}
+	report := dryRunReport{DryRun: true, Result: result, Routes: []dryRunRoute{}}
+	for _, item := range items {
+		updt := item.Update
+		route := dryRunRoute{UpdateID: updt.UpdtID.String(), Kind: updt.Kind(), Exchange: profile.Exchange}
+		topic, msg, err := routeItem(profile, result.ForBot, item)
+		if err != nil {
+			route.Error = err.Error()
+		} else {
+			route.Topic, route.ContentType, route.Size = topic, msg.ContentType, len(msg.Body)
+		}
+		report.Routes = append(report.Routes, route)
+	}
+	for _, updt := range result.Dropped {
+		report.Routes = append(report.Routes, dryRunRoute{UpdateID: updt.UpdtID.String(), Kind: updt.Kind(), Dropped: true})
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, report)
+}
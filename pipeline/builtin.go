@@ -0,0 +1,357 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/botcmd"
+	"github.com/eensymachines/tgramscraper/models"
+)
+
+func init() {
+	Register("filter", newFilter)
+	Register("enrich", newEnrich)
+	Register("dedup", newDedup)
+	Register("route", newRoute)
+	Register("commands", newCommands)
+}
+
+// Data : what the templates of the processors can refer to
+type Data struct {
+	Bot      string
+	UpdateID string
+	Kind     string
+	ChatID   string
+	ChatType string
+	SenderID string
+	Username string
+	Text     string
+	Command  string // name of the command, once the commands processor has parsed it
+}
+
+func dataOf(env Env, u models.Update) Data {
+	from := u.From()
+	cmd := ""
+	if u.Command != nil {
+		cmd = u.Command.Name
+	}
+	return Data{
+		Bot:      env.Bot,
+		UpdateID: u.UpdtID.String(),
+		Kind:     u.Kind(),
+		ChatID:   u.Chat().ChatID.String(),
+		ChatType: u.Chat().Typ,
+		SenderID: from.SenderID.String(),
+		Username: from.UName,
+		Text:     u.Text(),
+		Command:  cmd,
+	}
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %s", text, err)
+	}
+	return tmpl, nil
+}
+
+func execute(tmpl *template.Template, data Data) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// match : criteria shared by filter & route, update matches when it meets all that are set
+type match struct {
+	Kinds []string `yaml:"kinds"` // kinds of updates, as in allowed_updates
+	Chats []int64  `yaml:"chats"`
+	Text  string   `yaml:"text"` // regular expression the text of the update has to match
+
+	text *regexp.Regexp
+}
+
+func (m *match) compile() error {
+	if m.Text == "" {
+		return nil
+	}
+	rgx, err := regexp.Compile(m.Text)
+	if err != nil {
+		return fmt.Errorf("invalid text expression %q: %s", m.Text, err)
+	}
+	m.text = rgx
+	return nil
+}
+
+func (m *match) matches(u models.Update) bool {
+	if len(m.Kinds) > 0 && !contains(m.Kinds, u.Kind()) {
+		return false
+	}
+	if len(m.Chats) > 0 {
+		id, _ := u.Chat().ChatID.Int64()
+		found := false
+		for _, c := range m.Chats {
+			found = found || c == id
+		}
+		if !found {
+			return false
+		}
+	}
+	return m.text == nil || m.text.MatchString(u.Text())
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filter : keeps only the updates that match, or with invert drops the ones that match
+type filter struct {
+	match  `yaml:",inline"`
+	Invert bool `yaml:"invert"`
+}
+
+func newFilter(params Params) (Processor, error) {
+	f := &filter{}
+	if err := params.Decode(f); err != nil {
+		return nil, err
+	}
+	if err := f.compile(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *filter) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	if f.matches(item.Update) == f.Invert {
+		return nil, nil
+	}
+	return []Item{item}, nil
+}
+
+// enrich : adds fields to the update, the json encoder publishes them under extra.
+// Fields go in the message headers too, for the text encoder & consumers that route on headers
+type enrich struct {
+	Fields map[string]string `yaml:"fields"` // name of the field to template over Data
+
+	tmpls map[string]*template.Template
+}
+
+func newEnrich(params Params) (Processor, error) {
+	e := &enrich{}
+	if err := params.Decode(e); err != nil {
+		return nil, err
+	}
+	if len(e.Fields) == 0 {
+		return nil, fmt.Errorf("fields are required")
+	}
+	e.tmpls = map[string]*template.Template{}
+	for name, text := range e.Fields {
+		tmpl, err := parseTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+		e.tmpls[name] = tmpl
+	}
+	return e, nil
+}
+
+func (e *enrich) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	data := dataOf(env, item.Update)
+	// maps are copied, the update may have been split & the other items share them
+	extra := map[string]string{}
+	for k, v := range item.Update.Extra {
+		extra[k] = v
+	}
+	headers := copyHeaders(item)
+	for name, tmpl := range e.tmpls {
+		val, err := execute(tmpl, data)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", name, err)
+		}
+		extra[name], headers[name] = val, val
+	}
+	item.Update.Extra, item.Headers = extra, headers
+	return []Item{item}, nil
+}
+
+// copyHeaders : headers of the item to add to, the update may have been split & the other items share them
+func copyHeaders(item Item) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for k, v := range item.Headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// dedup : drops updates with the same key as an earlier update within the window - double taps, forwarded spam.
+// Keys are remembered per bot in memory, oldest are forgotten first beyond the size
+type dedup struct {
+	Key    string        `yaml:"key"` // template over Data
+	Window time.Duration `yaml:"window"`
+	Size   int           `yaml:"size"`
+
+	key   *template.Template
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []seenKey // in the order seen, oldest first
+	now   func() time.Time
+}
+
+type seenKey struct {
+	key string
+	at  time.Time
+}
+
+func newDedup(params Params) (Processor, error) {
+	d := &dedup{Key: "{{.ChatID}}:{{.SenderID}}:{{.Text}}", Window: time.Minute, Size: 1000}
+	if err := params.Decode(d); err != nil {
+		return nil, err
+	}
+	if d.Window <= 0 || d.Size <= 0 {
+		return nil, fmt.Errorf("window and size have to be more than 0")
+	}
+	tmpl, err := parseTemplate("key", d.Key)
+	if err != nil {
+		return nil, err
+	}
+	d.key, d.seen, d.now = tmpl, map[string]time.Time{}, time.Now
+	return d, nil
+}
+
+func (d *dedup) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	key, err := execute(d.key, dataOf(env, item.Update))
+	if err != nil {
+		return nil, fmt.Errorf("key: %s", err)
+	}
+	key = env.Bot + "/" + key // bots without a profile share the chain of the defaults
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.forget(now)
+	if at, ok := d.seen[key]; ok && now.Sub(at) < d.Window {
+		return nil, nil
+	}
+	if !env.DryRun {
+		d.seen[key] = now
+		d.order = append(d.order, seenKey{key: key, at: now})
+	}
+	return []Item{item}, nil
+}
+
+// forget : keys out of the window, and the oldest beyond the size. Called with the lock held
+func (d *dedup) forget(now time.Time) {
+	for len(d.order) > 0 && (now.Sub(d.order[0].at) >= d.Window || len(d.order) >= d.Size) {
+		oldest := d.order[0]
+		if d.seen[oldest.key] == oldest.at {
+			delete(d.seen, oldest.key)
+		}
+		d.order = d.order[1:]
+	}
+}
+
+// route : updates that match are published under the topic from the template instead of the routing of the profile
+type route struct {
+	match `yaml:",inline"`
+	Topic string `yaml:"topic"` // template over Data
+
+	topic *template.Template
+}
+
+func newRoute(params Params) (Processor, error) {
+	r := &route{}
+	if err := params.Decode(r); err != nil {
+		return nil, err
+	}
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	if r.Topic == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	tmpl, err := parseTemplate("topic", r.Topic)
+	if err != nil {
+		return nil, err
+	}
+	r.topic = tmpl
+	return r, nil
+}
+
+func (r *route) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	if !r.matches(item.Update) {
+		return []Item{item}, nil
+	}
+	topic, err := execute(r.topic, dataOf(env, item.Update))
+	if err != nil {
+		return nil, fmt.Errorf("topic: %s", err)
+	}
+	item.Topic = topic
+	return []Item{item}, nil
+}
+
+// commands : parses the command the message starts with onto the update, and publishes it under a topic of its own.
+// Each command handler can then bind its own queue. Messages that arent commands pass as they are.
+// All the bots in a group get /name@otherbot, commands addressed to other bots are dropped.
+// Chain fails when the username of the bot cant be looked up for a command with a mention, it is never published under the wrong bot
+type commands struct {
+	Topic string `yaml:"topic"` // template over Data, .Command has the name of the command
+
+	topic *template.Template
+}
+
+func newCommands(params Params) (Processor, error) {
+	c := &commands{Topic: "{{.Bot}}.commands.{{.Command}}"}
+	if err := params.Decode(c); err != nil {
+		return nil, err
+	}
+	tmpl, err := parseTemplate("topic", c.Topic)
+	if err != nil {
+		return nil, err
+	}
+	c.topic = tmpl
+	return c, nil
+}
+
+func (c *commands) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	if item.Update.CallbackQuery != nil {
+		return []Item{item}, nil // message of the callback is the one the bot sent
+	}
+	cmd, ok := botcmd.Parse(item.Update.Msg())
+	if !ok {
+		return []Item{item}, nil
+	}
+	if cmd.Mention != "" {
+		// without the username of the bot the command cannot be told apart, the scrape fails & is retried
+		username, err := env.username()
+		if err != nil {
+			return nil, fmt.Errorf("command /%s@%s: %s", cmd.Name, cmd.Mention, err)
+		}
+		if !botcmd.For(cmd, username) {
+			return nil, nil
+		}
+	}
+	item.Update.Command = cmd
+	topic, err := execute(c.topic, dataOf(env, item.Update))
+	if err != nil {
+		return nil, fmt.Errorf("topic: %s", err)
+	}
+	args := make([]interface{}, len(cmd.Args))
+	for i, a := range cmd.Args {
+		args[i] = a
+	}
+	headers := copyHeaders(item)
+	headers["command"], headers["command_args"] = cmd.Name, args
+	item.Topic, item.Headers = topic, headers
+	return []Item{item}, nil
+}
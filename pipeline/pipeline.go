@@ -0,0 +1,150 @@
+// Processors sit between the scrape and the publish, each update goes through the chain of the bot before it is published.
+
+// A processor can drop an update, modify it, split it in many or reroute it to another topic.
+// Chains are configured per bot in the bot profiles, as a list of processor types with their params - in the order they run.
+// Built-in processors are filter, enrich, dedup, route and commands, more can be registered with Register.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Item : update on its way to the broker
+type Item struct {
+	Update  models.Update
+	Topic   string                 // routing key for the update, empty for the routing of the bot profile
+	Headers map[string]interface{} // added to the headers of the message when published
+}
+
+// Env : what the processors get to know of the scrape along with the update
+type Env struct {
+	Bot      string
+	DryRun   bool                   // updates are not going to be published, processors should not remember them
+	Username func() (string, error) // username of the bot as getMe has it, looked up when called
+}
+
+// username : of the bot, error if the env cant look it up
+func (e Env) username() (string, error) {
+	if e.Username == nil {
+		return "", fmt.Errorf("username of the bot %s is not known", e.Bot)
+	}
+	return e.Username()
+}
+
+// Processor : gets each update in turn and sends back what goes on to the next processor.
+// None to drop the update, more than one to split it. Errors fail the publish of the entire scrape
+type Processor interface {
+	Process(ctx context.Context, env Env, item Item) ([]Item, error)
+}
+
+// Spec : processor as configured in the bot profile
+type Spec struct {
+	Type   string `yaml:"type" json:"type"`
+	Params Params `yaml:"params" json:"params,omitempty"`
+}
+
+// Params : parameters of the processor, as they are in the profiles yaml
+type Params map[string]interface{}
+
+// Decode : params into the struct of the processor, unknown params are an error
+func (p Params) Decode(dst interface{}) error {
+	byt, err := yaml.Marshal(map[string]interface{}(p))
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(byt))
+	dec.KnownFields(true)
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("invalid params: %s", err)
+	}
+	return nil
+}
+
+// Factory : processor from its params
+type Factory func(params Params) (Processor, error)
+
+var factories = map[string]Factory{}
+
+// Register : makes the processor type available to the profiles, panics if the type is taken
+func Register(typ string, f Factory) {
+	if _, ok := factories[typ]; ok {
+		panic(fmt.Sprintf("processor type %s registered twice", typ))
+	}
+	factories[typ] = f
+}
+
+// Types : registered processor types, sorted
+func Types() []string {
+	result := make([]string, 0, len(factories))
+	for typ := range factories {
+		result = append(result, typ)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// stage : processor in the chain, with its type for the logs & metrics
+type stage struct {
+	typ  string
+	proc Processor
+}
+
+// Chain : processors of a bot in the order they run. Empty chain passes the updates as they are
+type Chain struct {
+	stages []stage
+}
+
+// Build : chain from the specs, errors for unknown types or params that the processor does not accept
+func Build(specs []Spec) (*Chain, error) {
+	c := &Chain{}
+	for i, spec := range specs {
+		f, ok := factories[spec.Type]
+		if !ok {
+			return nil, fmt.Errorf("processors[%d]: unknown type %q, expected one of %v", i, spec.Type, Types())
+		}
+		proc, err := f(spec.Params)
+		if err != nil {
+			return nil, fmt.Errorf("processors[%d] %s: %s", i, spec.Type, err)
+		}
+		c.stages = append(c.stages, stage{typ: spec.Type, proc: proc})
+	}
+	return c, nil
+}
+
+// Drop : update that did not make it through, and the processor that dropped it
+type Drop struct {
+	Update models.Update
+	Stage  string
+}
+
+// Run : each of the updates through all the processors.
+// Updates that come out of the chain are kept in order, updates that dont are dropped along with the stage that dropped them
+func (c *Chain) Run(ctx context.Context, env Env, updates []models.Update) ([]Item, []Drop, error) {
+	kept, dropped := []Item{}, []Drop{}
+	for _, u := range updates {
+		items := []Item{{Update: u}}
+		for _, st := range c.stages {
+			next := []Item{}
+			for _, item := range items {
+				out, err := st.proc.Process(ctx, env, item)
+				if err != nil {
+					return nil, nil, fmt.Errorf("processor %s failed on update %s: %w", st.typ, u.UpdtID, err)
+				}
+				next = append(next, out...)
+			}
+			items = next
+			if len(items) == 0 {
+				dropped = append(dropped, Drop{Update: u, Stage: st.typ})
+				break
+			}
+		}
+		kept = append(kept, items...)
+	}
+	return kept, dropped, nil
+}
@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func message(id, chat, from, text string) models.Update {
+	return models.Update{UpdtID: json.Number("1" + id), Message: &models.UpdateMessage{
+		MsgId: "1", Text: text, Chat: models.Chat{ChatID: json.Number("-" + chat), Typ: "group"},
+		From: models.Sender{SenderID: json.Number("7" + from), UName: "user" + from},
+	}}
+}
+
+// build : chain from the yaml, as it would be in the bot profile
+func build(t *testing.T, specs string) *Chain {
+	list := []Spec{}
+	assert.Nil(t, yaml.Unmarshal([]byte(specs), &list), "Unexpected error parsing the specs")
+	c, err := Build(list)
+	assert.Nil(t, err, "Unexpected error building the chain")
+	return c
+}
+
+func texts(items []Item) []string {
+	result := []string{}
+	for _, i := range items {
+		result = append(result, i.Update.Text())
+	}
+	return result
+}
+
+func TestBuild(t *testing.T) {
+	for _, bad := range []string{
+		`[{type: nosuch}]`,
+		`[{type: filter, params: {txt: "^/"}}]`, // unknown param
+		`[{type: filter, params: {text: "("}}]`,
+		`[{type: enrich}]`,
+		`[{type: dedup, params: {window: 0s}}]`,
+		`[{type: route, params: {kinds: [message]}}]`,
+		`[{type: route, params: {topic: "{{.Bot"}}]`,
+	} {
+		list := []Spec{}
+		yaml.Unmarshal([]byte(bad), &list)
+		_, err := Build(list)
+		assert.NotNil(t, err, "Expected error building %s", bad)
+	}
+	c, err := Build(nil)
+	assert.Nil(t, err)
+	items, dropped, _ := c.Run(context.Background(), Env{Bot: "6425245255"}, []models.Update{message("1", "1", "1", "hello")})
+	assert.Equal(t, 1, len(items), "Empty chain passes the updates as they are")
+	assert.Equal(t, 0, len(dropped))
+}
+
+func TestBuiltins(t *testing.T) {
+	c := build(t, `
+- type: filter
+  params: {kinds: [message], text: "^/"}
+- type: filter
+  params: {chats: [-99], invert: true}
+- type: enrich
+  params:
+    fields: {source: "{{.Bot}}", who: "{{.Username}}"}
+- type: route
+  params:
+    text: "^/alarm"
+    topic: "{{.Bot}}.alarms"
+- type: dedup
+  params: {window: 1m}
+`)
+	env := Env{Bot: "6425245255"}
+	updates := []models.Update{
+		message("1", "1", "1", "/status"),
+		message("2", "1", "1", "just chatting"), // not a command
+		message("3", "99", "1", "/status"),      // chat excluded
+		message("4", "1", "2", "/alarm on"),
+		message("5", "1", "1", "/status"), // same chat, sender & text
+	}
+	items, dropped, err := c.Run(context.Background(), env, updates)
+	assert.Nil(t, err, "Unexpected error running the chain")
+	assert.Equal(t, []string{"/status", "/alarm on"}, texts(items))
+	assert.Equal(t, []string{"filter", "filter", "dedup"}, []string{dropped[0].Stage, dropped[1].Stage, dropped[2].Stage}, "Expected the stage that dropped each")
+	assert.Equal(t, "", items[0].Topic, "Expected the routing of the profile")
+	assert.Equal(t, "6425245255.alarms", items[1].Topic, "Expected the update rerouted")
+	assert.Equal(t, map[string]string{"source": "6425245255", "who": "user2"}, items[1].Update.Extra)
+	assert.Equal(t, "user2", items[1].Headers["who"], "Expected the fields in the headers too")
+	assert.Nil(t, updates[3].Extra, "Updates given to the chain should not be modified")
+
+	// dry run does not remember, publish after it isnt deduped
+	c = build(t, `[{type: dedup}]`)
+	items, _, _ = c.Run(context.Background(), Env{Bot: "6425245255", DryRun: true}, updates[:1])
+	assert.Equal(t, 1, len(items))
+	items, _, _ = c.Run(context.Background(), env, updates[:1])
+	assert.Equal(t, 1, len(items), "Dry run should not have been remembered")
+	items, _, _ = c.Run(context.Background(), Env{Bot: "6133190482"}, updates[:1])
+	assert.Equal(t, 1, len(items), "Keys are per bot")
+}
+
+func TestDedupWindow(t *testing.T) {
+	proc, err := newDedup(Params{"window": "10s", "size": 2})
+	assert.Nil(t, err)
+	d := proc.(*dedup)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+	env := Env{Bot: "6425245255"}
+	kept := func(u models.Update) bool {
+		out, _ := d.Process(context.Background(), env, Item{Update: u})
+		return len(out) == 1
+	}
+	a, b, c := message("1", "1", "1", "a"), message("2", "1", "1", "b"), message("3", "1", "1", "c")
+	assert.True(t, kept(a))
+	assert.False(t, kept(a), "Same key within the window")
+	now = now.Add(11 * time.Second)
+	assert.True(t, kept(a), "Window is over")
+	assert.True(t, kept(b))
+	assert.True(t, kept(c))
+	assert.True(t, kept(a), "Oldest key should be forgotten beyond the size")
+	assert.LessOrEqual(t, len(d.order), 2)
+}
+
+// splitter : test processor that makes an update of each line
+type splitter struct{}
+
+func (splitter) Process(ctx context.Context, env Env, item Item) ([]Item, error) {
+	result := []Item{}
+	for _, line := range []string{"one", "two"} {
+		u := item.Update
+		m := *u.Message
+		m.Text = line
+		u.Message = &m
+		result = append(result, Item{Update: u})
+	}
+	return result, nil
+}
+
+func TestSplit(t *testing.T) {
+	Register("test-split", func(Params) (Processor, error) { return splitter{}, nil })
+	c := build(t, `[{type: test-split}, {type: filter, params: {text: "^t"}}]`)
+	items, dropped, _ := c.Run(context.Background(), Env{Bot: "6425245255"}, []models.Update{message("1", "1", "1", "one\ntwo")})
+	assert.Equal(t, []string{"two"}, texts(items), "Expected the split items to go through the rest of the chain")
+	assert.Equal(t, 0, len(dropped), "Update is not dropped as long as any of its items is kept")
+	assert.Panics(t, func() { Register("filter", newFilter) }, "Types cannot be registered twice")
+}
+
+func TestCommands(t *testing.T) {
+	c := build(t, `[{type: commands}]`)
+	lookups := 0
+	env := Env{Bot: "6425245255", Username: func() (string, error) { lookups++; return "home_bot", nil }}
+	updates := []models.Update{
+		message("1", "1", "1", `/Status@home_bot`),
+		message("2", "1", "1", `/arm@other_bot zone2`), // for another bot in the group
+		message("3", "1", "1", `/report "last week" all`),
+		message("4", "1", "1", "just chatting"),
+	}
+	items, dropped, err := c.Run(context.Background(), env, updates)
+	assert.Nil(t, err, "Unexpected error running the chain")
+	assert.Equal(t, []string{"/Status@home_bot", `/report "last week" all`, "just chatting"}, texts(items))
+	assert.Equal(t, 1, len(dropped))
+	assert.Equal(t, "commands", dropped[0].Stage)
+	assert.Equal(t, "6425245255.commands.status", items[0].Topic)
+	assert.Equal(t, &models.Command{Name: "report", Args: []string{"last week", "all"}, RawArgs: `"last week" all`}, items[1].Update.Command)
+	assert.Equal(t, "report", items[1].Headers["command"])
+	assert.Equal(t, []interface{}{"last week", "all"}, items[1].Headers["command_args"])
+	assert.Nil(t, items[2].Update.Command, "Not a command")
+	assert.Equal(t, "", items[2].Topic)
+	assert.Equal(t, 2, lookups, "Username is looked up only for the commands with a mention")
+
+	// username not known, mentions cannot be told apart & the chain fails rather than publish them
+	_, _, err = c.Run(context.Background(), Env{Bot: "6425245255"}, updates[1:2])
+	assert.NotNil(t, err, "Expected the chain failed for a mention without the username")
+	failing := Env{Bot: "6425245255", Username: func() (string, error) { return "", fmt.Errorf("getMe failed") }}
+	_, _, err = c.Run(context.Background(), failing, updates[1:2])
+	assert.NotNil(t, err, "Expected the chain failed when the username cant be looked up")
+	items, _, err = c.Run(context.Background(), failing, updates[2:])
+	assert.Nil(t, err, "Commands without a mention need not look up the username")
+	assert.Equal(t, 2, len(items))
+
+	c = build(t, `[{type: commands, params: {topic: "cmd.{{.Command}}.{{.ChatType}}"}}]`)
+	items, _, _ = c.Run(context.Background(), env, updates[:1])
+	assert.Equal(t, "cmd.status.group", items[0].Topic)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/metrics"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	log "github.com/sirupsen/logrus"
+)
+
+// processResult : updates of the result through the processors of the bot, result is left with what is to be published.
+// Updates the processors drop are moved over to Dropped, the offset of the result stays as is - dropped updates are not scraped again.
+// Updates that were published earlier, and the ones the access rules reject are left out before the processors get them.
+// Rejected updates the rules route skip the processors, and go out along with what the processors send back.
+// Media of the updates that are left is stored only when publishing, a dry run has no side effects on the media store.
+// On a dry run the processors are told not to remember the updates, and nothing is counted
+func (a *App) processResult(ctx context.Context, result *scrapers.ScrapeResult, dryRun bool) ([]pipeline.Item, error) {
+	a.skipPublished(ctx, result, dryRun)
+	rejected := a.checkAccess(ctx, result, dryRun)
+	profile := a.Profiles.For(result.ForBot)
+	if !dryRun && profile.StoresMedia() {
+		a.storeMedia(ctx, result)
+	}
+	chain, err := profile.Pipeline()
+	if err != nil {
+		return nil, err
+	}
+	items, drops, err := chain.Run(ctx, pipeline.Env{Bot: result.ForBot, DryRun: dryRun, Username: func() (string, error) {
+		return a.botUsername(ctx, result.ForBot)
+	}}, result.Updates)
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, rejected...)
+	result.Updates, result.AllMessages = []models.Update{}, []string{}
+	for _, item := range items {
+		result.Updates = append(result.Updates, item.Update)
+		result.AllMessages = append(result.AllMessages, item.Update.Text())
+	}
+	result.UpdateCount = len(items)
+	for _, d := range drops {
+		result.Dropped = append(result.Dropped, d.Update)
+		if !dryRun {
+			metrics.Dropped(result.ForBot, d.Stage)
+		}
+	}
+	if len(drops) > 0 {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot":     result.ForBot,
+			"dropped": len(drops),
+			"kept":    len(items),
+		}).Debug("processors dropped updates")
+	}
+	return items, nil
+}
+
+// botUsername : username of the bot from getMe, cached since it does not change for the bot.
+// Lookups for the same bot at the same time share a single getMe, bots do not wait on each other.
+// Failed lookups are not cached, getMe is tried again the next time
+func (a *App) botUsername(ctx context.Context, botid string) (string, error) {
+	a.usernamesMu.Lock()
+	name, ok := a.usernames[botid]
+	a.usernamesMu.Unlock()
+	if ok {
+		return name, nil
+	}
+	val, err, _ := a.usernameLookups.Do(botid, func() (interface{}, error) {
+		// shared by all the callers, one of them giving up should not fail the rest
+		me, err := a.telegram(botid, "").GetMe(scrapers.ScrapeConfig{Context: context.WithoutCancel(ctx), RequestTimeout: a.Profiles.For(botid).RequestTimeout, Transport: a.Transport})
+		if err != nil {
+			return "", err
+		}
+		a.usernamesMu.Lock()
+		a.usernames[botid] = me.UName
+		a.usernamesMu.Unlock()
+		return me.UName, nil
+	})
+	if err != nil {
+		logging.From(ctx).WithFields(log.Fields{
+			"bot": botid,
+		}).Warnf("failed getMe, commands addressed to other bots cannot be told apart: %s", err)
+		return "", err
+	}
+	return val.(string), nil
+}
@@ -0,0 +1,253 @@
+// Profiles are per-bot configurations, read in from a yaml file keyed by the bot id.
+
+// Each bot can have its own exchange, topic, timeouts and filters. Bots without a profile get the defaults.
+package profiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/access"
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EncoderText = "text" // only the text of the message is published, as it always was
+	EncoderJSON = "json" // entire update is published as json
+)
+
+// Profile is the configuration of a single bot
+type Profile struct {
+	Exchange        string          `yaml:"exchange" json:"exchange"`                 // exchange the updates are published to
+	Routing         string          `yaml:"routing" json:"routing"`                   // template for the routing key/topic, see RoutingData
+	AllowedUpdates  []string        `yaml:"allowed_updates" json:"allowed_updates"`   // kinds of updates telegram server would send, empty for all
+	PollingInterval time.Duration   `yaml:"polling_interval" json:"polling_interval"` // how often the bot is expected to be scraped
+	RequestTimeout  time.Duration   `yaml:"request_timeout" json:"request_timeout"`   // timeout for http requests to the telegram server
+	Encoder         string          `yaml:"encoder" json:"encoder"`                   // text or json, how the updates are encoded when published
+	Chats           []int64         `yaml:"chats" json:"chats"`                       // only updates from these chats are published, empty for all
+	StoreMedia      *bool           `yaml:"store_media" json:"store_media"`           // photos & documents are downloaded to the media store during scrape
+	MaxFileSize     int64           `yaml:"max_file_size" json:"max_file_size"`       // bytes, files larger than this are neither proxied nor stored
+	Processors      []pipeline.Spec `yaml:"processors" json:"processors"`             // chain the updates go through before publishing, in order
+	Access          *access.Rules   `yaml:"access" json:"access"`                     // who gets to have their updates published, everyone when not set
+
+	routing  *template.Template
+	pipeline *pipeline.Chain
+}
+
+// RoutingData is what the routing template can refer to.
+// Default template "{{.Bot}}.updates" is what the service always published to.
+type RoutingData struct {
+	Bot    string // id of the bot
+	Kind   string // kind of the update - message, edited_message ..
+	ChatID string // id of the chat the update is from
+}
+
+// Profiles : profiles of all the configured bots, with defaults for the rest
+type Profiles struct {
+	Defaults Profile            `yaml:"defaults"`
+	Bots     map[string]Profile `yaml:"bots"`
+}
+
+// Default : profile that leaves the behaviour of the service as it was before profiles
+func Default() Profile {
+	return Profile{
+		Exchange:        "amq.topic",
+		Routing:         "{{.Bot}}.updates",
+		PollingInterval: 3 * time.Second,
+		RequestTimeout:  6 * time.Second,
+		Encoder:         EncoderText,
+		MaxFileSize:     20 << 20, // getFile of the telegram bot api cant go beyond this anyway
+		Processors:      DefaultProcessors(),
+	}
+}
+
+// DefaultProcessors : chain of the bots that dont list their own processors - commands are published under <botid>.commands.<name>.
+// Bots that list processors replace this chain, they list commands too to keep the command routing. processors: [] for none
+func DefaultProcessors() []pipeline.Spec {
+	return []pipeline.Spec{{Type: "commands"}}
+}
+
+// Load : reads in the profiles from the yaml file.
+// Bot profiles are merged over the defaults in the file, which in turn are merged over Default()
+// Errors when the file cant be read, or any of the profiles is invalid.
+func Load(path string) (*Profiles, error) {
+	byt, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file %s: %s", path, err)
+	}
+	return Parse(byt)
+}
+
+// Parse : same as Load but from the contents of the file
+func Parse(byt []byte) (*Profiles, error) {
+	result := &Profiles{}
+	if err := yaml.Unmarshal(byt, result); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles: %s", err)
+	}
+	result.Defaults = merge(Default(), result.Defaults)
+	if err := result.Defaults.compile(); err != nil {
+		return nil, fmt.Errorf("invalid default profile: %s", err)
+	}
+	for id, p := range result.Bots {
+		p = merge(result.Defaults, p)
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("invalid profile for bot %s: %s", id, err)
+		}
+		result.Bots[id] = p
+	}
+	return result, nil
+}
+
+// NewDefaultProfiles : when there isnt any profiles file, all the bots get the default profile
+func NewDefaultProfiles() *Profiles {
+	result := &Profiles{Defaults: Default(), Bots: map[string]Profile{}}
+	result.Defaults.compile()
+	return result
+}
+
+// For : profile of the bot, defaults if the bot isnt configured
+func (ps *Profiles) For(botid string) Profile {
+	if p, ok := ps.Bots[botid]; ok {
+		return p
+	}
+	return ps.Defaults
+}
+
+// merge : non zero fields of over replace the ones in base
+func merge(base, over Profile) Profile {
+	if over.Exchange != "" {
+		base.Exchange = over.Exchange
+	}
+	if over.Routing != "" {
+		base.Routing = over.Routing
+	}
+	if over.AllowedUpdates != nil {
+		base.AllowedUpdates = over.AllowedUpdates
+	}
+	if over.PollingInterval != 0 {
+		base.PollingInterval = over.PollingInterval
+	}
+	if over.RequestTimeout != 0 {
+		base.RequestTimeout = over.RequestTimeout
+	}
+	if over.Encoder != "" {
+		base.Encoder = over.Encoder
+	}
+	if over.Chats != nil {
+		base.Chats = over.Chats
+	}
+	if over.StoreMedia != nil {
+		base.StoreMedia = over.StoreMedia
+	}
+	if over.MaxFileSize != 0 {
+		base.MaxFileSize = over.MaxFileSize
+	}
+	if over.Processors != nil {
+		base.Processors = over.Processors
+	}
+	if over.Access != nil {
+		base.Access = over.Access
+	}
+	base.routing, base.pipeline = nil, nil // each bot gets a chain of its own, processors like dedup keep state
+	return base
+}
+
+// compile : validates the profile and parses the routing template
+func (p *Profile) compile() error {
+	if p.Encoder != EncoderText && p.Encoder != EncoderJSON {
+		return fmt.Errorf("unknown encoder %s, expected %s or %s", p.Encoder, EncoderText, EncoderJSON)
+	}
+	if p.RequestTimeout < 0 || p.PollingInterval < 0 || p.MaxFileSize < 0 {
+		return fmt.Errorf("timeout, polling interval and max file size cannot be negative")
+	}
+	if p.Access != nil {
+		if err := p.Access.Validate(); err != nil {
+			return fmt.Errorf("invalid access rules: %s", err)
+		}
+	}
+	tmpl, err := template.New("routing").Option("missingkey=error").Parse(p.Routing)
+	if err != nil {
+		return fmt.Errorf("invalid routing template %s: %s", p.Routing, err)
+	}
+	p.routing = tmpl
+	chain, err := pipeline.Build(p.Processors)
+	if err != nil {
+		return err
+	}
+	p.pipeline = chain
+	return nil
+}
+
+// Pipeline : chain of processors the updates of the bot go through before publishing
+func (p Profile) Pipeline() (*pipeline.Chain, error) {
+	if p.pipeline == nil {
+		if err := p.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return p.pipeline, nil
+}
+
+// StoresMedia : true if the files from the messages are to be downloaded to the media store during scrape
+func (p Profile) StoresMedia() bool {
+	return p.StoreMedia != nil && *p.StoreMedia
+}
+
+// AllowsChat : true if updates from the chat can be published for this bot
+func (p Profile) AllowsChat(chatID int64) bool {
+	if len(p.Chats) == 0 {
+		return true
+	}
+	for _, c := range p.Chats {
+		if c == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// Topic : routing key under which the update is published, from the routing template
+func (p Profile) Topic(botid string, u models.Update) (string, error) {
+	if p.routing == nil {
+		if err := p.compile(); err != nil {
+			return "", err
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := p.routing.Execute(buf, RoutingData{Bot: botid, Kind: u.Kind(), ChatID: u.Chat().ChatID.String()}); err != nil {
+		return "", fmt.Errorf("failed to execute routing template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// TopicPattern : binding key that matches all the topics the updates of the bot are published under
+func (p Profile) TopicPattern(botid string) (string, error) {
+	if p.routing == nil {
+		if err := p.compile(); err != nil {
+			return "", err
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := p.routing.Execute(buf, RoutingData{Bot: botid, Kind: "*", ChatID: "*"}); err != nil {
+		return "", fmt.Errorf("failed to execute routing template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// Encode : body of the message when published, along with the content type
+func (p Profile) Encode(u models.Update) ([]byte, string, error) {
+	if p.Encoder == EncoderJSON {
+		byt, err := json.Marshal(u)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode update %s", err)
+		}
+		return byt, "application/json", nil
+	}
+	return []byte(u.Text()), "text/plain", nil
+}
@@ -0,0 +1,118 @@
+package profiles_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/pipeline"
+	"github.com/eensymachines/tgramscraper/profiles"
+	"github.com/stretchr/testify/assert"
+)
+
+const sample = `
+defaults:
+  request_timeout: 8s
+bots:
+  "6133190482":
+    exchange: alarms
+    routing: "{{.Bot}}.{{.Kind}}"
+    allowed_updates: [message, callback_query]
+    polling_interval: 30s
+    encoder: json
+    chats: [5157350442]
+    store_media: true
+    access:
+      private_only: true
+      deny: [{username: mallory}]
+      on_reject: route
+  "6425245255":
+    request_timeout: 2s
+    processors:
+      - type: filter
+        params: {text: "^/"}
+`
+
+func TestParseProfiles(t *testing.T) {
+	ps, err := profiles.Parse([]byte(sample))
+	assert.Nil(t, err, "Unexpected error parsing profiles")
+
+	// TEST: bot without a profile gets defaults, with overrides from the file
+	p := ps.For("0000000000")
+	assert.Equal(t, "amq.topic", p.Exchange, "Unexpected default exchange")
+	assert.Equal(t, 8*time.Second, p.RequestTimeout, "Unexpected default timeout")
+	assert.Equal(t, profiles.EncoderText, p.Encoder, "Unexpected default encoder")
+
+	// TEST: bot profile is merged over the defaults
+	p = ps.For("6425245255")
+	assert.Equal(t, 2*time.Second, p.RequestTimeout, "Unexpected timeout for bot")
+	assert.Equal(t, "amq.topic", p.Exchange, "Unexpected exchange for bot")
+
+	p = ps.For("6133190482")
+	assert.Equal(t, "alarms", p.Exchange, "Unexpected exchange for bot")
+	assert.Equal(t, 30*time.Second, p.PollingInterval, "Unexpected polling interval")
+	assert.Equal(t, 8*time.Second, p.RequestTimeout, "Unexpected timeout for bot")
+	assert.True(t, p.AllowsChat(5157350442), "Unexpected chat filtered out")
+	assert.False(t, p.AllowsChat(1234), "Unexpected chat allowed")
+	assert.True(t, p.StoresMedia(), "Unexpected media not stored for bot")
+	assert.False(t, ps.For("6425245255").StoresMedia(), "Unexpected media stored by default")
+
+	updt := models.Update{UpdtID: "100", Message: &models.UpdateMessage{Text: "hello", Chat: models.Chat{ChatID: json.Number("5157350442")}}}
+	topic, err := p.Topic("6133190482", updt)
+	assert.Nil(t, err, "Unexpected error executing routing template")
+	assert.Equal(t, "6133190482.message", topic, "Unexpected topic")
+	body, ctype, err := p.Encode(updt)
+	assert.Nil(t, err, "Unexpected error encoding")
+	assert.Equal(t, "application/json", ctype, "Unexpected content type")
+	assert.Contains(t, string(body), `"text":"hello"`, "Unexpected body")
+
+	topic, _ = ps.For("0000000000").Topic("0000000000", updt)
+	assert.Equal(t, "0000000000.updates", topic, "Unexpected default topic")
+
+	pattern, _ := p.TopicPattern("6133190482")
+	assert.Equal(t, "6133190482.*", pattern, "Unexpected pattern to bind to all topics of the bot")
+
+	// TEST: processors of the bot, empty chain for the rest
+	chain, err := ps.For("6425245255").Pipeline()
+	assert.Nil(t, err, "Unexpected error getting the pipeline")
+	items, dropped, _ := chain.Run(context.Background(), pipeline.Env{Bot: "6425245255"}, []models.Update{updt})
+	assert.Equal(t, 0, len(items), "Expected the update filtered out by the processor")
+	assert.Equal(t, 1, len(dropped))
+	chain, _ = ps.For("6133190482").Pipeline()
+	items, _, _ = chain.Run(context.Background(), pipeline.Env{Bot: "6133190482"}, []models.Update{updt})
+	assert.Equal(t, 1, len(items), "Expected the update through the default chain")
+
+	// TEST: commands are routed by default, unless the bot lists processors of its own
+	assert.Equal(t, profiles.DefaultProcessors(), ps.For("0000000000").Processors, "Expected the default chain for bots without processors")
+	chain, _ = ps.For("0000000000").Pipeline()
+	status := models.Update{UpdtID: "101", Message: &models.UpdateMessage{Text: "/status", Chat: models.Chat{ChatID: json.Number("5157350442"), Typ: "private"}}}
+	items, _, _ = chain.Run(context.Background(), pipeline.Env{Bot: "0000000000"}, []models.Update{status})
+	assert.Equal(t, "0000000000.commands.status", items[0].Topic, "Expected the command routed by default")
+	none, err := profiles.Parse([]byte("bots:\n  \"1\":\n    processors: []\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(none.For("1").Processors), "Expected the bot to opt out of the default chain")
+
+	// TEST: access rules of the bot, everyone is allowed for the rest
+	assert.Nil(t, ps.For("6425245255").Access, "Unexpected access rules by default")
+	rules := ps.For("6133190482").Access
+	assert.True(t, rules.PrivateOnly)
+	assert.True(t, rules.Routes())
+	assert.Equal(t, "not_private", rules.Check(updt), "Expected the update from a chat that isnt private rejected")
+}
+
+func TestInvalidProfiles(t *testing.T) {
+	cases := []string{
+		"bots:\n  \"1\":\n    encoder: xml\n",
+		"bots:\n  \"1\":\n    routing: \"{{.Bot\"\n",
+		"defaults:\n  request_timeout: -1s\n",
+		"bots:\n  \"1\":\n    processors: [{type: nosuch}]\n",
+		"bots:\n  \"1\":\n    access: {on_reject: bounce}\n",
+		"bots: [",
+	}
+	for _, c := range cases {
+		_, err := profiles.Parse([]byte(c))
+		assert.NotNil(t, err, "Unexpected nil error for invalid profiles %s", c)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/alerts"
+	"github.com/eensymachines/tgramscraper/health"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// newReadiness : component checks for the readiness probe.
+// Only the broker and draining are critical, without the broker the service cant do its job.
+// Registry, telegram server and the outbox backlog only degrade the service, the backlog is also alerted.
+// Bots without an active token are not a reason to drop out of the service - the replacement token is staged through the api.
+func (a *App) newReadiness() *health.Checker {
+	backlogMax := a.Config.OutboxBacklogMax
+	checker := &health.Checker{}
+	checker.Add("shutdown", 0, true, func(ctx context.Context) (interface{}, error) {
+		if a.isDraining() {
+			return nil, fmt.Errorf("draining, shutting down")
+		}
+		return nil, nil
+	})
+	checker.Add("amqp", 10*time.Second, true, func(ctx context.Context) (interface{}, error) {
+		// dialling opens both the connection and the channel
+		conn, err := a.Broker.Open()
+		if err != nil {
+			return nil, fmt.Errorf("broker connection or channel failed: %s", err)
+		}
+		conn.Close()
+		return gin.H{"server": a.Config.AMQP.Server}, nil
+	})
+	checker.Add("registry", 10*time.Second, false, func(ctx context.Context) (interface{}, error) {
+		active := 0
+		for _, st := range a.Registry.Statuses() {
+			if st.State == tokens.StateActive {
+				active++
+			}
+		}
+		detail := gin.H{"registered": a.Registry.Count(), "active": active}
+		if active == 0 {
+			return detail, fmt.Errorf("no bot with an active token")
+		}
+		return detail, nil
+	})
+	checker.Add("telegram", time.Minute, false, func(ctx context.Context) (interface{}, error) {
+		// getMe with any one of the active bots is enough to know the telegram server is reachable
+		for _, st := range a.Registry.Statuses() {
+			if st.State != tokens.StateActive {
+				continue
+			}
+			tok, _ := a.Registry.Find(st.UID)
+			if err := a.telegram(st.UID, "").VerifyToken(tok, scrapers.ScrapeConfig{RequestTimeout: 5 * time.Second, Transport: a.Transport, Context: ctx}); err != nil {
+				// readyz is unauthenticated, only the reason goes out
+				logging.From(ctx).WithFields(log.Fields{
+					"bot": st.UID,
+					"err": err,
+				}).Warn("readiness: telegram getMe failed")
+				return gin.H{"bot": st.UID}, fmt.Errorf("getMe failed: %s", scrapers.Reason(err))
+			}
+			return gin.H{"bot": st.UID, "baseurl": a.Config.BaseURL}, nil
+		}
+		return nil, fmt.Errorf("no bot with an active token to call getMe")
+	})
+	checker.Add("outbox", 30*time.Second, false, func(ctx context.Context) (interface{}, error) {
+		conn, err := a.Broker.Open()
+		if err != nil {
+			return nil, fmt.Errorf("broker connection failed: %s", err)
+		}
+		defer conn.Close()
+		queued, waiting := 0, 0
+		for _, st := range a.Registry.Statuses() {
+			depth, err := conn.QueueDepth(senders.OutboxQueue(st.UID))
+			if err != nil {
+				return nil, fmt.Errorf("failed to inspect outbox of bot %s: %s", st.UID, err)
+			}
+			queued += depth
+			waiting += a.Limiter.Status(st.UID).Depth
+		}
+		detail := gin.H{"queued": queued, "waiting_for_turn": waiting, "max": backlogMax}
+		if queued+waiting > backlogMax {
+			a.Alerts.Raise(alerts.KindOutboxBacklog, "outbox", fmt.Sprintf("%d messages waiting to be sent, beyond %d", queued+waiting, backlogMax))
+			return detail, fmt.Errorf("outbox backlog beyond %d", backlogMax)
+		}
+		return detail, nil
+	})
+	return checker
+}
+
+// HndlHealthz : liveness, if this responds the process is alive
+func (a *App) HndlHealthz(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusOK, gin.H{"status": health.StatusUp})
+}
+
+// HndlReadyz : readiness, 503 when any of the critical components is down so the pod is taken out of the service
+func (a *App) HndlReadyz(ctx *gin.Context) {
+	report := a.Readiness.Run(ctx.Request.Context())
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.AbortWithStatusJSON(status, report)
+}
@@ -0,0 +1,256 @@
+// Named schedules that scrape bots from within the service, instead of an external cron hitting the trigger.
+
+// Each job fires as per its spec, with a random jitter so replicas & jobs firing at the same minute dont all poll together.
+// A job does not fire for a bot while an earlier run for the same bot is still going, the run is recorded as skipped.
+// Last run & the next fire time of each job is kept for the API.
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// ErrSkip : runs that return an error wrapping this are recorded as skipped and not failed - bot is polled elsewhere
+var ErrSkip = errors.New("run skipped")
+
+// ErrNotFound : no job by the name
+var ErrNotFound = errors.New("no such schedule")
+
+// Job : what is scraped when
+type Job struct {
+	Name   string
+	Bot    string
+	Spec   string        // cron expression, descriptor or @every <duration>
+	Jitter time.Duration // fire time is delayed by a random duration up to this
+}
+
+// Status : job with the outcome of the last run, as the API sends it out
+type Status struct {
+	Name         string     `json:"name"`
+	Bot          string     `json:"bot"`
+	Spec         string     `json:"spec"`
+	Jitter       string     `json:"jitter,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"` // nil when the spec does not fire again
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastStatus   string     `json:"last_status,omitempty"` // ok, failed or skipped
+	LastError    string     `json:"last_error,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	Skips        int        `json:"skips"`
+}
+
+// RunFunc : runs the job, ctx carries nothing but is there for the logging & tracing downstream
+type RunFunc func(ctx context.Context, job Job) error
+
+// entry : job as the scheduler holds it
+type entry struct {
+	job    Job
+	spec   Spec
+	timer  *time.Timer
+	status Status
+}
+
+// Scheduler : fires the jobs, all the jobs of a bot share the same running slot
+type Scheduler struct {
+	Run    RunFunc
+	Reason func(err error) string // what of a failed run is kept in LastError, the API serves it - nil for the error as is
+
+	mu      sync.Mutex
+	jobs    map[string]*entry
+	running map[string]bool // bots with a run in progress
+	stopped bool
+	runs    sync.WaitGroup
+	now     func() time.Time
+	jitter  func(max time.Duration) time.Duration
+}
+
+func New(run RunFunc) *Scheduler {
+	return &Scheduler{
+		Run:     run,
+		jobs:    map[string]*entry{},
+		running: map[string]bool{},
+		now:     time.Now,
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+	}
+}
+
+// reason : of the failed run for LastError
+func (s *Scheduler) reason(err error) string {
+	if s.Reason == nil {
+		return err.Error()
+	}
+	return s.Reason(err)
+}
+
+// Validate : job is complete & its spec parses
+func (job Job) Validate() (Spec, error) {
+	if job.Name == "" || job.Bot == "" {
+		return nil, fmt.Errorf("schedule needs a name and a bot")
+	}
+	if job.Jitter < 0 {
+		return nil, fmt.Errorf("schedule %s: jitter cannot be negative", job.Name)
+	}
+	spec, err := Parse(job.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %s: %s", job.Name, err)
+	}
+	return spec, nil
+}
+
+// Put : adds the job or replaces the job by the same name, the replaced job's run in progress is let to finish
+func (s *Scheduler) Put(job Job) (Status, error) {
+	spec, err := job.Validate()
+	if err != nil {
+		return Status{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return Status{}, fmt.Errorf("scheduler is stopped")
+	}
+	e := &entry{job: job, spec: spec, status: Status{Name: job.Name, Bot: job.Bot, Spec: job.Spec}}
+	if job.Jitter > 0 {
+		e.status.Jitter = job.Jitter.String()
+	}
+	if old, ok := s.jobs[job.Name]; ok {
+		old.timer.Stop()
+		// history carries over, it is the same job
+		e.status.LastRun, e.status.LastStatus, e.status.LastError, e.status.LastDuration = old.status.LastRun, old.status.LastStatus, old.status.LastError, old.status.LastDuration
+		e.status.Runs, e.status.Failures, e.status.Skips = old.status.Runs, old.status.Failures, old.status.Skips
+	}
+	s.jobs[job.Name] = e
+	s.arm(e, s.now())
+	return s.statusOf(e), nil
+}
+
+// Remove : job is not fired any more, its run in progress is let to finish
+func (s *Scheduler) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	e.timer.Stop()
+	delete(s.jobs, name)
+	return nil
+}
+
+// Get : status of the job by name
+func (s *Scheduler) Get(name string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.jobs[name]
+	if !ok {
+		return Status{}, false
+	}
+	return s.statusOf(e), true
+}
+
+// List : status of all the jobs, by name
+func (s *Scheduler) List() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Status, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		result = append(result, s.statusOf(e))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Stop : no more fires, runs in progress are let to finish. Wait for them with Wait
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, e := range s.jobs {
+		e.timer.Stop()
+	}
+}
+
+// Wait : till the runs in progress are done
+func (s *Scheduler) Wait() {
+	s.runs.Wait()
+}
+
+// statusOf : copy of the status, running is as of now. Called with the lock held
+func (s *Scheduler) statusOf(e *entry) Status {
+	st := e.status
+	st.Running = s.running[e.job.Bot]
+	return st
+}
+
+// arm : timer for the next fire after the given time, with the jitter. Called with the lock held
+func (s *Scheduler) arm(e *entry, after time.Time) {
+	next := e.spec.Next(after)
+	if next.IsZero() {
+		e.status.NextRun = nil
+		e.timer = time.NewTimer(0)
+		e.timer.Stop()
+		return
+	}
+	fire := next.Add(s.jitter(e.job.Jitter))
+	e.status.NextRun = &fire
+	e.timer = time.AfterFunc(fire.Sub(s.now()), func() { s.fire(e, next) })
+}
+
+// fire : runs the job unless its bot is busy, and arms the next fire from the scheduled time so the jitter does not drift the schedule
+func (s *Scheduler) fire(e *entry, scheduled time.Time) {
+	s.mu.Lock()
+	if s.stopped || s.jobs[e.job.Name] != e {
+		s.mu.Unlock() // removed or replaced in the meantime
+		return
+	}
+	s.arm(e, scheduled)
+	start := s.now()
+	if s.running[e.job.Bot] {
+		e.status.LastRun, e.status.LastStatus, e.status.LastError, e.status.LastDuration = &start, StatusSkipped, "previous run for the bot is still going", ""
+		e.status.Skips++
+		s.mu.Unlock()
+		return
+	}
+	s.running[e.job.Bot] = true
+	s.runs.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.runs.Done()
+		err := s.Run(context.Background(), e.job)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.running, e.job.Bot)
+		st := &e.status
+		st.LastRun, st.LastDuration, st.LastError = &start, s.now().Sub(start).String(), ""
+		switch {
+		case err == nil:
+			st.LastStatus = StatusOK
+			st.Runs++
+		case errors.Is(err, ErrSkip):
+			st.LastStatus, st.LastError = StatusSkipped, s.reason(err)
+			st.Skips++
+		default:
+			st.LastStatus, st.LastError = StatusFailed, s.reason(err)
+			st.Runs++
+			st.Failures++
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, _ := time.Parse("2006-01-02 15:04", s)
+		return tm
+	}
+	data := []struct {
+		spec, after, next string
+	}{
+		{"*/5 * * * *", "2026-10-19 10:02", "2026-10-19 10:05"},
+		{"*/5 * * * *", "2026-10-19 10:05", "2026-10-19 10:10"},
+		{"30 9 * * 1-5", "2026-10-16 10:00", "2026-10-19 09:30"}, // friday after 9:30 is monday
+		{"0 0 1 * *", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 12 * * 0", "2026-10-19 00:00", "2026-10-25 12:00"},
+		{"0 12 * * 7", "2026-10-19 00:00", "2026-10-25 12:00"}, // 7 is sunday too
+		{"0 0 13 * 5", "2026-10-19 00:00", "2026-10-23 00:00"}, // either 13th or friday
+		{"15,45 2-3 * * *", "2026-10-19 02:50", "2026-10-19 03:15"},
+		{"@hourly", "2026-10-19 10:02", "2026-10-19 11:00"},
+		{"@every 90s", "2026-10-19 10:02", "2026-10-19 10:03"}, // 10:03:30, compared to the minute
+		{"10m", "2026-10-19 10:02", "2026-10-19 10:12"},
+	}
+	for _, d := range data {
+		spec, err := Parse(d.spec)
+		assert.Nil(t, err, "Unexpected error parsing %s", d.spec)
+		assert.Equal(t, at(d.next), spec.Next(at(d.after)).Truncate(time.Minute), "Unexpected next for %s after %s", d.spec, d.after)
+	}
+	spec, _ := Parse("0 0 30 2 *")
+	assert.True(t, spec.Next(at("2026-10-19 00:00")).IsZero(), "30th of February never fires")
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@every 10ms", "@every soon", "@fortnightly"} {
+		_, err := Parse(bad)
+		assert.NotNil(t, err, "Expected error parsing %q", bad)
+	}
+}
+
+// fakeRun : runs block till released, each run reports on started
+type fakeRun struct {
+	started chan Job
+	release chan error
+}
+
+func (fr *fakeRun) run(ctx context.Context, job Job) error {
+	fr.started <- job
+	return <-fr.release
+}
+
+func TestScheduler(t *testing.T) {
+	fr := &fakeRun{started: make(chan Job, 10), release: make(chan error)}
+	s := New(fr.run)
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.jitter = func(max time.Duration) time.Duration { return max / 2 }
+	defer s.Stop()
+
+	st, err := s.Put(Job{Name: "morning", Bot: "6425245255", Spec: "@every 1h", Jitter: 10 * time.Minute})
+	assert.Nil(t, err, "Unexpected error adding the job")
+	assert.Equal(t, now.Add(65*time.Minute), *st.NextRun, "Expected next run an hour on with the jitter")
+	s.Put(Job{Name: "other", Bot: "6425245255", Spec: "*/15 * * * *"})
+	_, err = s.Put(Job{Name: "broken", Bot: "6425245255", Spec: "every now and then"})
+	assert.NotNil(t, err, "Expected error for a bad spec")
+
+	// fired by hand, timers are an hour away
+	fire := func(name string) {
+		s.mu.Lock()
+		e := s.jobs[name]
+		s.mu.Unlock()
+		s.fire(e, now)
+	}
+	fire("morning")
+	assert.Equal(t, "morning", (<-fr.started).Name)
+	st, _ = s.Get("morning")
+	assert.True(t, st.Running, "Expected the job running")
+	assert.Equal(t, now.Add(65*time.Minute), *st.NextRun, "Next run is from the scheduled time, not the fire time")
+
+	fire("other") // same bot, still running
+	st, _ = s.Get("other")
+	assert.Equal(t, StatusSkipped, st.LastStatus, "Expected the run skipped while the bot is busy")
+	assert.Equal(t, 1, st.Skips)
+
+	fr.release <- errors.New("telegram is down")
+	s.Wait()
+	st, _ = s.Get("morning")
+	assert.False(t, st.Running)
+	assert.Equal(t, StatusFailed, st.LastStatus)
+	assert.Equal(t, "telegram is down", st.LastError)
+	assert.Equal(t, 1, st.Failures)
+
+	fire("other")
+	<-fr.started
+	fr.release <- nil
+	s.Wait()
+	st, _ = s.Get("other")
+	assert.Equal(t, StatusOK, st.LastStatus)
+	assert.Equal(t, 1, st.Runs)
+
+	fire("other")
+	<-fr.started
+	fr.release <- ErrSkip
+	s.Wait()
+	st, _ = s.Get("other")
+	assert.Equal(t, StatusSkipped, st.LastStatus, "Runs can report themselves skipped")
+	assert.Equal(t, 2, st.Skips)
+
+	// replacing keeps the history, removing stops the job
+	st, _ = s.Put(Job{Name: "other", Bot: "6425245255", Spec: "@daily"})
+	assert.Equal(t, 1, st.Runs, "Expected the history carried over")
+	assert.Equal(t, 2, len(s.List()))
+	assert.Nil(t, s.Remove("other"))
+	assert.True(t, errors.Is(s.Remove("other"), ErrNotFound))
+	assert.Equal(t, 1, len(s.List()))
+}
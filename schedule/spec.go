@@ -0,0 +1,171 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec : when a job fires next
+type Spec interface {
+	// Next : first time strictly after the given time the job fires, zero time if it never does
+	Next(after time.Time) time.Time
+}
+
+// descriptors : shorthands as cron has them
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// MinInterval : jobs cannot fire more often than this, the telegram server long polls anyway
+const MinInterval = time.Second
+
+// Parse : spec from a cron expression (minute hour day-of-month month day-of-week), a descriptor like @hourly,
+// "@every <duration>" or just the duration
+func Parse(expr string) (Spec, error) {
+	expr = strings.TrimSpace(expr)
+	if full, ok := descriptors[expr]; ok {
+		expr = full
+	}
+	if every, ok := strings.CutPrefix(expr, "@every "); ok {
+		return parseInterval(strings.TrimSpace(every))
+	}
+	if d, err := time.ParseDuration(expr); err == nil {
+		return parseInterval(d.String())
+	}
+	return parseCron(expr)
+}
+
+// Interval : fires at fixed intervals from the time the job was scheduled
+type Interval time.Duration
+
+func parseInterval(s string) (Spec, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q: %s", s, err)
+	}
+	if d < MinInterval {
+		return nil, fmt.Errorf("interval %s is shorter than %s", d, MinInterval)
+	}
+	return Interval(d), nil
+}
+
+func (i Interval) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// Cron : 5 field cron expression, evaluated in the location of the time given to Next
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // bit n set when n is allowed
+	domStar, dowStar              bool   // day of month & week are either when both are restricted, as cron has it
+}
+
+// field : bounds of each of the cron fields
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+func parseCron(expr string) (Spec, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid spec %q: expected cron expression of 5 fields, @every <duration> or a descriptor", expr)
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseField(parts[i], f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spec %q: %s", expr, err)
+		}
+		bits[i] = b
+	}
+	c := &Cron{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"), dowStar: strings.HasPrefix(parts[4], "*")}
+	if c.dow&(1<<7) != 0 { // 7 is sunday too
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseField : comma separated list of *, n, a-b, each with an optional /step
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s: invalid step in %q", f.name, item)
+			}
+			rng, step = item[:i], n
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("%s: invalid range %q", f.name, rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid value %q", f.name, rng)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = f.max // n/step is from n onwards
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s: %q is out of %d-%d", f.name, rng, f.min, f.max)
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next : walks forward a month, a day, an hour or a minute at a time, whichever does not match.
+// Gives up after 5 years, for expressions like 30th of February that never fire
+func (c *Cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/lease"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/schedule"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSchedule : scrapes the bot from its stored offset and publishes, as the one-shot scrape does.
+// Bot leased elsewhere is a skip and not a failure - another replica has the same schedule and got there first
+func (a *App) runSchedule(ctx context.Context, job schedule.Job) error {
+	ctx = logging.WithRequestID(ctx, logging.NewRequestID())
+	result, err := a.scrapeStored(ctx, job.Bot, "", true)
+	if err != nil {
+		if errors.Is(err, lease.ErrHeld) {
+			return fmt.Errorf("%w: %s", schedule.ErrSkip, err)
+		}
+		logging.From(ctx).WithFields(log.Fields{
+			"schedule": job.Name,
+			"bot":      job.Bot,
+			"err":      err,
+		}).Error("scheduled scrape failed")
+		return err
+	}
+	logging.From(ctx).WithFields(log.Fields{
+		"schedule": job.Name,
+		"bot":      job.Bot,
+		"count":    result.UpdateCount,
+		"offset":   result.NextUpdateOffset,
+	}).Debug("scheduled scrape done")
+	return nil
+}
+
+// scheduleReason : why the run did not go through, as the schedules API shows it.
+// Errors of the run stay in the logs, they can carry the bot token or the broker credentials
+func scheduleReason(err error) string {
+	if errors.Is(err, schedule.ErrSkip) {
+		return "bot is being polled elsewhere"
+	}
+	if reason := scrapers.Reason(err); reason != "failed" {
+		return fmt.Sprintf("scrape failed: %s", reason)
+	}
+	return "run failed, see the logs"
+}
+
+// loadSchedules : schedules from the config, bots have to be registered.
+// Only the server runs the schedules, commands dont load them
+func (a *App) loadSchedules() error {
+	for _, sch := range a.Config.Schedules {
+		if _, ok := a.Registry.Find(sch.Bot); !ok {
+			return fmt.Errorf("schedule %s is for bot %s which is not registered", sch.Name, sch.Bot)
+		}
+		st, err := a.Schedules.Put(schedule.Job{Name: sch.Name, Bot: sch.Bot, Spec: sch.Spec, Jitter: sch.Jitter})
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"schedule": st.Name,
+			"bot":      st.Bot,
+			"spec":     st.Spec,
+			"next_run": st.NextRun,
+		}).Info("scrape scheduled")
+	}
+	return nil
+}
+
+// HndlSchedules : all the schedules with the last run & the next fire time of each
+func (a *App) HndlSchedules(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusOK, a.Schedules.List())
+}
+
+// HndlSchedule : single schedule by name
+func (a *App) HndlSchedule(ctx *gin.Context) {
+	st, ok := a.Schedules.Get(ctx.Param("name"))
+	if !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("no schedule by the name %s", ctx.Param("name")), nil)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, st)
+}
+
+// HndlPutSchedule : adds the schedule or replaces the one by the same name.
+// Schedules changed over the API are not written back to the config file, a restart goes back to what the file has
+// Payload is {"bot": "<botid>", "spec": "*/5 * * * *", "jitter": "30s"}
+func (a *App) HndlPutSchedule(ctx *gin.Context) {
+	payload := struct {
+		Bot    string `json:"bot"`
+		Spec   string `json:"spec"`
+		Jitter string `json:"jitter"`
+	}{}
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, "invalid payload, expected bot and spec", nil)
+		return
+	}
+	var jitter time.Duration
+	if payload.Jitter != "" {
+		d, err := time.ParseDuration(payload.Jitter)
+		if err != nil {
+			api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, fmt.Sprintf("invalid jitter %q", payload.Jitter), nil)
+			return
+		}
+		jitter = d
+	}
+	if _, ok := a.Registry.Find(payload.Bot); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", payload.Bot), nil)
+		return
+	}
+	st, err := a.Schedules.Put(schedule.Job{Name: ctx.Param("name"), Bot: payload.Bot, Spec: payload.Spec, Jitter: jitter})
+	if err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, err.Error(), nil)
+		return
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"schedule": st.Name,
+		"bot":      st.Bot,
+		"spec":     st.Spec,
+	}).Info("schedule put over the api")
+	ctx.AbortWithStatusJSON(http.StatusOK, st)
+}
+
+// HndlDeleteSchedule : schedule is not fired any more, a run in progress is let to finish
+func (a *App) HndlDeleteSchedule(ctx *gin.Context) {
+	if err := a.Schedules.Remove(ctx.Param("name")); err != nil {
+		api.Abort(ctx, http.StatusNotFound, api.CodeNotFound, err.Error(), nil)
+		return
+	}
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"schedule": ctx.Param("name"),
+	}).Info("schedule removed over the api")
+	ctx.Status(http.StatusNoContent)
+	ctx.Abort()
+}
@@ -0,0 +1,50 @@
+package scrapers
+
+import (
+	"sync"
+)
+
+// BatchJob : one bot to be scraped as a part of the batch
+type BatchJob struct {
+	BotID   string
+	Scraper Scraper
+	Config  ScrapeConfig // per bot timeouts go here
+}
+
+// BatchResult : outcome of a single job in the batch, either the result or the error
+type BatchResult struct {
+	BotID  string
+	Result *ScrapeResult
+	Err    error
+}
+
+// ScrapeBatch : scrapes all the jobs concurrently, with no more than workers scrapes running at any time.
+// after is called for each successful scrape from within the worker, error from after fails the job. nil after to skip.
+// Results are in the same order as the jobs.
+func ScrapeBatch(jobs []BatchJob, workers int, after func(*ScrapeResult) error) []BatchResult {
+	if workers <= 0 {
+		workers = 1
+	}
+	results := make([]BatchResult, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				res, err := jobs[i].Scraper.Scrape(jobs[i].Config)
+				if err == nil && after != nil {
+					err = after(res)
+				}
+				results[i] = BatchResult{BotID: jobs[i].BotID, Result: res, Err: err}
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
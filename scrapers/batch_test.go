@@ -0,0 +1,63 @@
+package scrapers
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingScraper : keeps track of how many scrapes are running at the same time
+type countingScraper struct {
+	id      string
+	running *int32
+	maxSeen *int32
+	fail    bool
+}
+
+func (cs *countingScraper) Scrape(c ScrapeConfig) (*ScrapeResult, error) {
+	now := atomic.AddInt32(cs.running, 1)
+	defer atomic.AddInt32(cs.running, -1)
+	for {
+		seen := atomic.LoadInt32(cs.maxSeen)
+		if now <= seen || atomic.CompareAndSwapInt32(cs.maxSeen, seen, now) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cs.fail {
+		return nil, fmt.Errorf("failed scrape for %s", cs.id)
+	}
+	return &ScrapeResult{ForBot: cs.id}, nil
+}
+
+func TestScrapeBatch(t *testing.T) {
+	var running, maxSeen int32
+	jobs := []BatchJob{}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%d", i)
+		jobs = append(jobs, BatchJob{BotID: id, Scraper: &countingScraper{id: id, running: &running, maxSeen: &maxSeen, fail: i == 3}})
+	}
+	published := int32(0)
+	results := ScrapeBatch(jobs, 3, func(sr *ScrapeResult) error {
+		atomic.AddInt32(&published, 1)
+		if sr.ForBot == "5" {
+			return fmt.Errorf("failed publish")
+		}
+		return nil
+	})
+	assert.Equal(t, 10, len(results), "Unexpected count of results")
+	assert.LessOrEqual(t, maxSeen, int32(3), "Unexpected number of concurrent scrapes")
+	assert.Equal(t, int32(9), published, "Unexpected count of publishes")
+	for i, r := range results {
+		assert.Equal(t, fmt.Sprintf("%d", i), r.BotID, "Unexpected order of results")
+		if i == 3 || i == 5 {
+			assert.NotNil(t, r.Err, "Unexpected nil error for job %d", i)
+		} else {
+			assert.Nil(t, r.Err, "Unexpected error for job %d", i)
+		}
+	}
+	assert.Empty(t, ScrapeBatch(nil, 3, nil), "Unexpected results for empty batch")
+}
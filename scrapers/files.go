@@ -0,0 +1,115 @@
+package scrapers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+)
+
+// ErrFileTooLarge is returned when the file is larger than the limit the caller has set
+var ErrFileTooLarge = errors.New("file is larger than the allowed size")
+
+// GetFile : resolves the file id to the file path on the telegram server.
+func (ts *TelegramScraper) GetFile(fileID string, c ScrapeConfig) (*models.File, error) {
+	botTok, ok := ts.Registry.Find(ts.UID)
+	if !ok || botTok == "" {
+		return nil, fmt.Errorf("no bot with id %s found registered with us: %w", ts.UID, ErrBotNotRegistered)
+	}
+	byt, err := ts.call(fmt.Sprintf("%s/bot%s/getFile?file_id=%s", ts.BaseUrl, botTok, url.QueryEscape(fileID)), c)
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			return nil, fmt.Errorf("failed to get file for bot %s: %w", ts.UID, ErrTokenRevoked)
+		}
+		return nil, err
+	}
+	resp := struct {
+		OK     bool        `json:"ok"`
+		Result models.File `json:"result"`
+	}{}
+	if err := json.Unmarshal(byt, &resp); err != nil || !resp.OK {
+		return nil, fmt.Errorf("failed to unmarshal getFile response from server %v", err)
+	}
+	return &resp.Result, nil
+}
+
+// OpenFile : resolves the file and opens it for download from the telegram server.
+// Files larger than maxSize are refused with ErrFileTooLarge, before downloading when telegram tells the size.
+// Caller has to close the body, which also errors if more than maxSize is read.
+// RequestTimeout bounds the wait for the response headers only, large files take as long as they take - cancel the context to stop the download.
+func (ts *TelegramScraper) OpenFile(fileID string, maxSize int64, c ScrapeConfig) (io.ReadCloser, *http.Response, *models.File, error) {
+	file, err := ts.GetFile(fileID, c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if file.FileSize > maxSize {
+		return nil, nil, file, fmt.Errorf("file of %d bytes: %w", file.FileSize, ErrFileTooLarge)
+	}
+	if file.FilePath == "" {
+		return nil, nil, file, fmt.Errorf("telegram server did not send the path for file %s", fileID)
+	}
+	botTok, _ := ts.Registry.Find(ts.UID)
+	// client timeout would cut off the body mid read, the request is cancelled only if the headers dont arrive in time
+	ctx, cancelCause := context.WithCancelCause(c.context())
+	cancel := func() { cancelCause(nil) }
+	if c.RequestTimeout > 0 {
+		timer := time.AfterFunc(c.RequestTimeout, func() {
+			cancelCause(fmt.Errorf("%w after %s", ErrTimeout, c.RequestTimeout))
+		})
+		defer timer.Stop()
+	}
+	client := &http.Client{Transport: c.Transport}
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/file/bot%s/%s", ts.BaseUrl, botTok, file.FilePath), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		if cause := context.Cause(ctx); errors.Is(cause, ErrTimeout) {
+			return nil, nil, file, cause
+		}
+		return nil, nil, file, TransportError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, file, &StatusError{Code: resp.StatusCode}
+	}
+	if resp.ContentLength > maxSize {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, file, fmt.Errorf("file of %d bytes: %w", resp.ContentLength, ErrFileTooLarge)
+	}
+	return &limitedBody{body: resp.Body, left: maxSize, cancel: cancel}, resp, file, nil
+}
+
+// limitedBody : errors with ErrFileTooLarge once more than the limit is read
+type limitedBody struct {
+	body   io.ReadCloser
+	left   int64
+	cancel context.CancelFunc // of the download request, once the body is closed
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.left < 0 {
+		return 0, ErrFileTooLarge
+	}
+	if int64(len(p)) > lb.left+1 {
+		p = p[:lb.left+1]
+	}
+	n, err := lb.body.Read(p)
+	lb.left -= int64(n)
+	if lb.left < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	defer lb.cancel()
+	return lb.body.Close()
+}
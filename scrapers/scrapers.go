@@ -5,21 +5,42 @@ package scrapers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net/http"
+	"net/url"
+	"path"
 	"time"
 
+	"github.com/eensymachines/tgramscraper/logging"
 	"github.com/eensymachines/tgramscraper/models"
 	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/eensymachines/tgramscraper/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ScrapeConfig extensible configuration object when scraping
 type ScrapeConfig struct {
-	RequestTimeout time.Duration // scrape requests refer to http requests made, timeout refers to the same
+	RequestTimeout time.Duration            // scrape requests refer to http requests made, timeout refers to the same
+	AllowedUpdates []string                 // kinds of updates the telegram server should send, empty for all kinds
+	Filter         func(models.Update) bool // updates for which this is false are left out of the result, nil to keep all
+	Transport      http.RoundTripper        // wraps the http calls to the telegram server, nil for the default transport
+	Context        context.Context          // parent of the scrape span & cancels the http calls, nil for background
+}
+
+// context : context for the scrape, background when not configured
+func (c ScrapeConfig) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
 }
 
 type Scraper interface {
@@ -38,88 +59,298 @@ type TelegramScraper struct {
 
 // ScrapeResult is the return result after Scrape is called.
 type ScrapeResult struct {
-	UpdateCount      int      `json:"update_count"` // count of distinct updatess
-	NextUpdateOffset string   `json:"offset"`       // for the subsequent request this is used as the offset for getting the updates, large number
-	AllMessages      []string `json:"all_messages"` // text messages in each of the updates
-	ForBot           string   `json:"for_bot"`      // id of the bot for which this result is relevant, each bot has an id
+	UpdateCount      int      `json:"update_count"`         // count of distinct updatess
+	NextUpdateOffset string   `json:"offset"`               // for the subsequent request this is used as the offset for getting the updates, large number
+	AllMessages      []string `json:"all_messages"`         // text messages in each of the updates
+	ForBot           string   `json:"for_bot"`              // id of the bot for which this result is relevant, each bot has an id
+	Duplicates       int      `json:"duplicates,omitempty"` // updates left out since they were published earlier
+
+	Updates  []models.Update `json:"-"` // decoded updates, same order as AllMessages
+	Dropped  []models.Update `json:"-"` // updates that were received but left out by the filter
+	Rejected []models.Update `json:"-"` // updates the access rules of the bot rejected, in Dropped too unless the rules route them
+}
+
+var (
+	// ErrBotNotRegistered is returned when there isnt any token in the registry for the bot
+	ErrBotNotRegistered = errors.New("bot not registered, only registered bots can scrape")
+	// ErrTokenRevoked is returned when the telegram server refuses the bot token and there is no pending token to fall back on
+	ErrTokenRevoked = errors.New("bot token revoked, stage a new token to resume scraping")
+	// errUnauthorized is what the telegram server says when the token has been revoked by BotFather
+	errUnauthorized = errors.New("telegram server refused the token, 401 unauthorized")
+	// ErrTransport is wrapped by the errors of calls that got no response from the telegram server - timeouts, refused or reset connections
+	ErrTransport = errors.New("failed to send http request to Telegram server")
+	// ErrTimeout is the transport error when the telegram server does not respond in time
+	ErrTimeout = fmt.Errorf("%w: timeout", ErrTransport)
+)
+
+// StatusError : telegram server responded, but with an unfavorable http status
+type StatusError struct {
+	Code int
+}
+
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("error response from telegram server %d", se.Code)
+}
+
+// TransportError : error of the http client without the request url, the url carries the bot token
+// Timeouts are reported as such, for the rest only the underlying error is kept
+func TransportError(err error) error {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return fmt.Errorf("%w: %s", ErrTransport, err)
+	}
+	if ue.Timeout() {
+		return ErrTimeout
+	}
+	return fmt.Errorf("%w: %s", ErrTransport, ue.Err)
 }
 
 // Scrape : getupdates > send the message over to the broker >return reponse result (sumamry of the update)
+// When the registry is a tokens.ManagedRegistry, a 401 from the telegram server marks the token revoked
+// and the pending token (if any) is tried & promoted in its place.
 func (ts *TelegramScraper) Scrape(c ScrapeConfig) (*ScrapeResult, error) {
+	ctx, span := tracing.Tracer().Start(c.context(), "scrape", trace.WithAttributes(
+		attribute.String("bot.id", ts.UID),
+		attribute.String("scrape.offset", ts.Offset),
+	))
+	defer span.End()
+	c.Context = ctx
+	result, err := ts.scrape(c)
+	if err != nil {
+		// only the reason, the errors of the telegram calls can carry the token
+		span.RecordError(errors.New(Reason(err)))
+		span.SetStatus(codes.Error, "failed to scrape")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("scrape.update_count", result.UpdateCount), attribute.Int("scrape.dropped_count", len(result.Dropped)))
+	return result, nil
+}
+
+// scrape : does the actual work for Scrape, within the scrape span
+func (ts *TelegramScraper) scrape(c ScrapeConfig) (*ScrapeResult, error) {
 	// TODO: finding from the registry shouldnt be the responsibility of the scrapper
 	// Need tomove the same from here
 	botTok, ok := ts.Registry.Find(ts.UID)
 	if !ok {
 		// unregistered bot token
-		return nil, fmt.Errorf("invalid bot ID, no token found registered against it %s", ts.UID)
+		return nil, fmt.Errorf("invalid bot ID, no token found registered against it %s: %w", ts.UID, ErrBotNotRegistered)
 	}
-	if botTok != "" {
-		url := func(tok string) string {
-			n := new(big.Int)
-			val, _ := n.SetString(ts.Offset, 10)
-			if val != big.NewInt(0) {
-				return fmt.Sprintf("%s/bot%s/getUpdates?offset=%s", ts.BaseUrl, botTok, ts.Offset)
-			} else {
-				// Offset specified when 0 would lead to downloading all the updates that have been previously downloaded
-				// Not sending offset param will then get no updates if the updates have been already fetched.
-				return fmt.Sprintf("%s/bot%s/getUpdates", ts.BaseUrl, botTok)
-			}
-		}(botTok)
-		req, _ := http.NewRequest("GET", url, bytes.NewBuffer([]byte("")))
-		client := &http.Client{
-			Timeout: c.RequestTimeout,
+	if botTok == "" {
+		return nil, fmt.Errorf("no bot with id %s found registered with us: %w", ts.UID, ErrBotNotRegistered)
+	}
+	managed, isManaged := ts.Registry.(tokens.ManagedRegistry)
+	var updtResp *models.UpdateResponse
+	var err error
+	if isManaged && isRevoked(managed, ts.UID) {
+		// no point asking the telegram server with a token we know is revoked
+		err = errUnauthorized
+	} else {
+		updtResp, err = ts.getUpdates(botTok, c)
+	}
+	if errors.Is(err, errUnauthorized) && isManaged {
+		managed.Revoke(ts.UID, botTok)
+		pendTok, ok := managed.Pending(ts.UID)
+		if !ok {
+			return nil, fmt.Errorf("failed to scrape bot %s: %w", ts.UID, ErrTokenRevoked)
 		}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Debug("Scrape: error making the http request, check internet connection")
-			return nil, fmt.Errorf("failed to send http reuest to Telegram server %s", err)
+		// trying the new token, switching over only if the telegram server accepts it
+		updtResp, err = ts.getUpdates(pendTok, c)
+		if err == nil {
+			// the token that was refused, swapped for the one that was tried - unless either has changed by now
+			if err := managed.Promote(ts.UID, botTok, pendTok); err != nil {
+				logging.From(c.context()).WithFields(log.Fields{
+					"err": err,
+					"uid": ts.UID,
+				}).Warn("Scrape: pending token worked but could not be promoted")
+			}
+		} else if errors.Is(err, errUnauthorized) {
+			return nil, fmt.Errorf("failed to scrape bot %s, pending token refused as well: %w", ts.UID, ErrTokenRevoked)
 		}
-		if resp.StatusCode != http.StatusOK {
-			log.WithFields(log.Fields{
-				"status_code": resp.StatusCode,
-			}).Debug("Scrape: Http status code from the telegram server is unfavorable")
-			return nil, fmt.Errorf("error response from telegram server %d", resp.StatusCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	updtResp.BotID = ts.UID // bot id is nowhere to be found in the update - hence attaching the same
+	kept, dropped := []models.Update{}, []models.Update{}
+	for _, u := range updtResp.Result {
+		if c.Filter == nil || c.Filter(u) {
+			kept = append(kept, u)
+		} else {
+			dropped = append(dropped, u)
 		}
+	}
+	return &ScrapeResult{
+		UpdateCount: len(kept),
+		NextUpdateOffset: func() string {
+			n := new(big.Int)
+			if len(updtResp.Result) > 0 {
+				val, _ := n.SetString(updtResp.Result[len(updtResp.Result)-1].UpdtID.String(), 10)
+				val = n.Add(val, big.NewInt(1))
+				return val.String()
+			}
+			return n.String()
+		}(),
+		ForBot: ts.UID,
+		AllMessages: func() []string { // collects texts of all the messages
+			res := []string{}
+			for _, r := range kept {
+				res = append(res, r.Text())
+			}
+			return res
+		}(),
+		Updates: kept,
+		Dropped: dropped,
+	}, nil
+}
 
-		// statusok , reading the response body
-		byt, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Debug("Scrape: Error reading response payload from telegram server")
-			return nil, fmt.Errorf("error reading the response body: %s", err)
+// isRevoked : true when the registry already knows the current token is revoked
+func isRevoked(reg tokens.ManagedRegistry, uid string) bool {
+	st, ok := reg.Status(uid)
+	return ok && st.State == tokens.StateRevoked
+}
+
+// getUpdates : sends the getUpdates request with the given token and unmarshals the response.
+// Errors with errUnauthorized when the server responds with 401
+func (ts *TelegramScraper) getUpdates(botTok string, c ScrapeConfig) (*models.UpdateResponse, error) {
+	params := url.Values{}
+	n := new(big.Int)
+	val, _ := n.SetString(ts.Offset, 10)
+	if val != big.NewInt(0) {
+		params.Set("offset", ts.Offset)
+	}
+	// Offset specified when 0 would lead to downloading all the updates that have been previously downloaded
+	// Not sending offset param will then get no updates if the updates have been already fetched.
+	if len(c.AllowedUpdates) > 0 {
+		allowed, _ := json.Marshal(c.AllowedUpdates)
+		params.Set("allowed_updates", string(allowed))
+	}
+	reqUrl := fmt.Sprintf("%s/bot%s/getUpdates", ts.BaseUrl, botTok)
+	if len(params) > 0 {
+		reqUrl = fmt.Sprintf("%s?%s", reqUrl, params.Encode())
+	}
+	byt, err := ts.call(reqUrl, c)
+	if err != nil {
+		return nil, err
+	}
+	updtResp := models.UpdateResponse{}
+	err = json.Unmarshal(byt, &updtResp)
+	if err != nil {
+		logging.From(c.context()).WithFields(log.Fields{
+			"err": err,
+		}).Debug("Scrape: Error unmarshaling response payload from telegram server")
+		return nil, fmt.Errorf("failed to unmarshal update response from server %s", err)
+	}
+	return &updtResp, nil
+}
+
+// VerifyToken : calls getMe with the token, nil error if the telegram server accepts the token.
+// Use this to try a pending token before promoting it.
+func (ts *TelegramScraper) VerifyToken(tok string, c ScrapeConfig) error {
+	_, err := ts.call(fmt.Sprintf("%s/bot%s/getMe", ts.BaseUrl, tok), c)
+	return err
+}
+
+// GetMe : the bot as the telegram server knows it, with the current token of the bot from the registry
+func (ts *TelegramScraper) GetMe(c ScrapeConfig) (*models.Sender, error) {
+	botTok, ok := ts.Registry.Find(ts.UID)
+	if !ok || botTok == "" {
+		return nil, fmt.Errorf("no bot with id %s found registered with us: %w", ts.UID, ErrBotNotRegistered)
+	}
+	byt, err := ts.call(fmt.Sprintf("%s/bot%s/getMe", ts.BaseUrl, botTok), c)
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			return nil, fmt.Errorf("failed getMe for bot %s: %w", ts.UID, ErrTokenRevoked)
 		}
-		updtResp := models.UpdateResponse{}
-		err = json.Unmarshal(byt, &updtResp)
+		return nil, err
+	}
+	resp := struct {
+		OK     bool          `json:"ok"`
+		Result models.Sender `json:"result"`
+	}{}
+	if err := json.Unmarshal(byt, &resp); err != nil || !resp.OK {
+		return nil, fmt.Errorf("failed to unmarshal getMe response from server %v", err)
+	}
+	return &resp.Result, nil
+}
+
+// call : sends a GET request to the telegram server and reads in the response body when the status is ok
+// The http call has its own span, named after the bot api method. Url is not an attribute since it carries the token,
+// and errors are recorded only by their Reason for the same reason
+func (ts *TelegramScraper) call(reqUrl string, c ScrapeConfig) (byt []byte, err error) {
+	ctx, span := tracing.Tracer().Start(c.context(), fmt.Sprintf("telegram %s", apiMethod(reqUrl)), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", "GET"), attribute.String("bot.id", ts.UID)))
+	defer func() {
 		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Debug("Scrape: Error unmarshaling response payload from telegram server")
-			return nil, fmt.Errorf("failed to unmarshal update response from server %s", err)
+			span.RecordError(errors.New(Reason(err)))
+			span.SetStatus(codes.Error, "telegram call failed")
 		}
-		updtResp.BotID = ts.UID // bot id is nowhere to be found in the update - hence attaching the same
-		return &ScrapeResult{
-			UpdateCount: len(updtResp.Result),
-			NextUpdateOffset: func() string {
-				n := new(big.Int)
-				if len(updtResp.Result) > 0 {
-					val, _ := n.SetString(updtResp.Result[len(updtResp.Result)-1].UpdtID.String(), 10)
-					val = n.Add(val, big.NewInt(1))
-					return val.String()
-				}
-				return n.String()
-			}(),
-			ForBot: ts.UID,
-			AllMessages: func() []string { // collects texts of all the messages
-				res := []string{}
-				for _, r := range updtResp.Result {
-					res = append(res, r.Message.Text)
-				}
-				return res
-			}(),
-		}, nil
-	}
-	return nil, fmt.Errorf("no bot with id %s found registered with us. Only registerd bots can scrape", botTok)
+		span.End()
+	}()
+	req, _ := http.NewRequestWithContext(ctx, "GET", reqUrl, bytes.NewBuffer([]byte("")))
+	client := &http.Client{
+		Timeout:   c.RequestTimeout,
+		Transport: c.Transport,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logging.From(c.context()).WithFields(log.Fields{
+			"err": err,
+		}).Debug("Scrape: error making the http request, check internet connection")
+		return nil, TransportError(err)
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode == http.StatusUnauthorized {
+		logging.From(c.context()).WithFields(log.Fields{
+			"uid": ts.UID,
+		}).Warn("Scrape: telegram server refused the bot token")
+		return nil, errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		logging.From(c.context()).WithFields(log.Fields{
+			"status_code": resp.StatusCode,
+		}).Debug("Scrape: Http status code from the telegram server is unfavorable")
+		return nil, &StatusError{Code: resp.StatusCode}
+	}
+
+	// statusok , reading the response body
+	byt, err = io.ReadAll(resp.Body)
+	if err != nil {
+		logging.From(c.context()).WithFields(log.Fields{
+			"err": err,
+		}).Debug("Scrape: Error reading response payload from telegram server")
+		return nil, fmt.Errorf("error reading the response body: %s", err)
+	}
+	return byt, nil
+}
+
+// Reason : short reason a telegram call failed, fit to be shown outside - never the raw error which can carry the token
+func Reason(err error) string {
+	var se *StatusError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrTransport):
+		return "unreachable"
+	case errors.Is(err, errUnauthorized), errors.Is(err, ErrTokenRevoked):
+		return "token refused"
+	case errors.Is(err, ErrBotNotRegistered):
+		return "bot not registered"
+	case errors.Is(err, ErrFileTooLarge):
+		return "file too large"
+	case errors.As(err, &se):
+		return fmt.Sprintf("status %d", se.Code)
+	}
+	return "failed"
+}
+
+// apiMethod : bot api method from the request url, last segment of the path without the query
+func apiMethod(reqUrl string) string {
+	u, err := url.Parse(reqUrl)
+	if err != nil {
+		return "unknown"
+	}
+	return path.Base(u.Path)
 }
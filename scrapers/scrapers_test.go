@@ -0,0 +1,243 @@
+package scrapers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	testCurrentTok = "6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4"
+	testPendingTok = "6425245255:oOkCGb-FjTX43v4u4A2p1IOED0-oHZ-hMPt"
+)
+
+// revokedServer : telegram server that refuses the current token and accepts the pending one
+func revokedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, fmt.Sprintf("/bot%s/", testCurrentTok)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ok":false,"error_code":401,"description":"Unauthorized"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":[{"update_id":100,"message":{"message_id":1,"text":"hello"}}]}`))
+	}))
+}
+
+func TestScrapeRevokedToken(t *testing.T) {
+	srv := revokedServer()
+	defer srv.Close()
+	registry := tokens.NewRotatingTokenRegistry(testCurrentTok)
+	scraper := &TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Offset: "0", Registry: registry}
+
+	// TEST: 401 without a pending token marks the bot revoked
+	_, err := scraper.Scrape(ScrapeConfig{RequestTimeout: time.Second})
+	assert.True(t, errors.Is(err, ErrTokenRevoked), "Unexpected error when token is revoked: %s", err)
+	st, _ := registry.Status("6425245255")
+	assert.Equal(t, tokens.StateRevoked, st.State, "Unexpected state after 401")
+
+	// TEST: with a pending token, the scrape switches over
+	assert.Nil(t, registry.Stage(testPendingTok), "Unexpected error staging token")
+	result, err := scraper.Scrape(ScrapeConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Unexpected error scraping with pending token")
+	assert.Equal(t, 1, result.UpdateCount, "Unexpected count of updates")
+	assert.Equal(t, "101", result.NextUpdateOffset, "Unexpected next offset")
+	tok, _ := registry.Find("6425245255")
+	assert.Equal(t, testPendingTok, tok, "Unexpected token after switch over")
+
+	// TEST: token staged while the pending one was being tried is not promoted in its stead
+	registry = tokens.NewRotatingTokenRegistry(testCurrentTok)
+	assert.Nil(t, registry.Stage(testPendingTok), "Unexpected error staging token")
+	restaged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, fmt.Sprintf("/bot%s/", testCurrentTok)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.Stage("6425245255:aePQBm-7cABKvZ7sOG6l1q21ha-5NB-2Sj2")
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	}))
+	defer restaged.Close()
+	_, err = (&TelegramScraper{UID: "6425245255", BaseUrl: restaged.URL, Offset: "0", Registry: registry}).Scrape(ScrapeConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Unexpected error scraping with pending token")
+	tok, _ = registry.Find("6425245255")
+	assert.Equal(t, testCurrentTok, tok, "Unexpected promotion of a token that was not tried")
+
+	// TEST: simple registries just get the error
+	scraper.Registry = tokens.NewSimpleTokenRegistry(testCurrentTok)
+	_, err = scraper.Scrape(ScrapeConfig{RequestTimeout: time.Second})
+	assert.NotNil(t, err, "Unexpected nil error for refused token")
+}
+
+func TestScrapeFilter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `["message"]`, r.URL.Query().Get("allowed_updates"), "Unexpected allowed updates in the request")
+		w.Write([]byte(`{"ok":true,"result":[
+			{"update_id":100,"message":{"message_id":1,"text":"hello","chat":{"id":1}}},
+			{"update_id":101,"message":{"message_id":2,"text":"from elsewhere","chat":{"id":2}}}
+		]}`))
+	}))
+	defer srv.Close()
+	scraper := &TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Offset: "0", Registry: tokens.NewSimpleTokenRegistry(testCurrentTok)}
+	result, err := scraper.Scrape(ScrapeConfig{
+		RequestTimeout: time.Second,
+		AllowedUpdates: []string{"message"},
+		Filter: func(u models.Update) bool {
+			return u.Chat().ChatID.String() == "1"
+		},
+	})
+	assert.Nil(t, err, "Unexpected error when scraping")
+	assert.Equal(t, 1, result.UpdateCount, "Unexpected count of updates")
+	assert.Equal(t, []string{"hello"}, result.AllMessages, "Unexpected messages")
+	assert.Equal(t, 1, len(result.Dropped), "Unexpected count of dropped updates")
+	assert.Equal(t, "102", result.NextUpdateOffset, "Unexpected offset, dropped updates count towards the offset")
+}
+
+func TestScrapeSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":[{"update_id":100,"message":{"message_id":1,"text":"hello","chat":{"id":1}}}]}`))
+	}))
+	defer srv.Close()
+	parent, span := otel.Tracer("test").Start(context.Background(), "trigger")
+	scraper := &TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Offset: "0", Registry: tokens.NewSimpleTokenRegistry(testCurrentTok)}
+	_, err := scraper.Scrape(ScrapeConfig{RequestTimeout: time.Second, Context: parent})
+	span.End()
+	assert.Nil(t, err, "Unexpected error when scraping")
+
+	ended := recorder.Ended()
+	assert.Equal(t, 3, len(ended), "Unexpected count of spans")
+	names := []string{}
+	for _, s := range ended {
+		names = append(names, s.Name())
+		assert.Equal(t, span.SpanContext().TraceID(), s.SpanContext().TraceID(), "All spans should be on the trigger trace")
+		for _, attr := range s.Attributes() {
+			assert.NotContains(t, attr.Value.Emit(), testCurrentTok, "Token should never be a span attribute")
+		}
+	}
+	assert.Equal(t, []string{"telegram getUpdates", "scrape", "trigger"}, names, "Unexpected spans")
+
+	// TEST: failed calls record only the reason, the error of the http client has the url with the token
+	srv.Close()
+	_, err = scraper.Scrape(ScrapeConfig{RequestTimeout: time.Second})
+	assert.True(t, errors.Is(err, ErrTransport), "Unexpected error for unreachable server %s", err)
+	for _, s := range recorder.Ended()[3:] {
+		assert.Equal(t, codes.Error, s.Status().Code, "Expected failed span %s", s.Name())
+		for _, ev := range s.Events() {
+			for _, attr := range ev.Attributes {
+				assert.NotContains(t, attr.Value.Emit(), testCurrentTok, "Token should never be in the span events")
+			}
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/bot%s/getFile", testCurrentTok):
+			switch r.URL.Query().Get("file_id") {
+			case "small":
+				w.Write([]byte(`{"ok":true,"result":{"file_id":"small","file_unique_id":"s","file_size":5,"file_path":"photos/file_1.jpg"}}`))
+			case "large":
+				w.Write([]byte(`{"ok":true,"result":{"file_id":"large","file_unique_id":"l","file_size":5000000,"file_path":"photos/file_2.jpg"}}`))
+			case "lying":
+				// says its small, but isnt
+				w.Write([]byte(`{"ok":true,"result":{"file_id":"lying","file_unique_id":"x","file_path":"photos/file_3.jpg"}}`))
+			case "slowbody":
+				w.Write([]byte(`{"ok":true,"result":{"file_id":"slowbody","file_unique_id":"b","file_size":10,"file_path":"photos/file_4.jpg"}}`))
+			case "noheaders":
+				w.Write([]byte(`{"ok":true,"result":{"file_id":"noheaders","file_unique_id":"h","file_size":10,"file_path":"photos/file_5.jpg"}}`))
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		case fmt.Sprintf("/file/bot%s/photos/file_1.jpg", testCurrentTok):
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("hello"))
+		case fmt.Sprintf("/file/bot%s/photos/file_3.jpg", testCurrentTok):
+			// flushing early so the response is chunked, without content length
+			w.Write([]byte(strings.Repeat("x", 5)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("x", 95)))
+		case fmt.Sprintf("/file/bot%s/photos/file_4.jpg", testCurrentTok):
+			// headers right away, the body takes longer than the request timeout
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("world"))
+		case fmt.Sprintf("/file/bot%s/photos/file_5.jpg", testCurrentTok):
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("helloworld"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	scraper := &TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Registry: tokens.NewSimpleTokenRegistry(testCurrentTok)}
+	config := ScrapeConfig{RequestTimeout: time.Second}
+
+	body, resp, file, err := scraper.OpenFile("small", 10, config)
+	assert.Nil(t, err, "Unexpected error opening file")
+	assert.Equal(t, "photos/file_1.jpg", file.FilePath, "Unexpected file path")
+	assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"), "Unexpected content type")
+	byt, err := io.ReadAll(body)
+	body.Close()
+	assert.Nil(t, err, "Unexpected error reading file")
+	assert.Equal(t, "hello", string(byt), "Unexpected file content")
+
+	_, _, _, err = scraper.OpenFile("large", 10, config)
+	assert.True(t, errors.Is(err, ErrFileTooLarge), "Unexpected error for large file %s", err)
+
+	body, _, _, err = scraper.OpenFile("lying", 10, config)
+	assert.Nil(t, err, "Unexpected error opening file of unknown size")
+	_, err = io.ReadAll(body)
+	body.Close()
+	assert.True(t, errors.Is(err, ErrFileTooLarge), "Unexpected error reading beyond the limit %s", err)
+
+	_, _, _, err = scraper.OpenFile("unknown", 10, config)
+	assert.NotNil(t, err, "Unexpected nil error for unknown file")
+
+	// TEST: request timeout bounds the wait for the headers, not the download
+	config.RequestTimeout = 100 * time.Millisecond
+	body, _, _, err = scraper.OpenFile("slowbody", 10, config)
+	if assert.Nil(t, err, "Unexpected error opening slow file") {
+		byt, err = io.ReadAll(body)
+		body.Close()
+		assert.Nil(t, err, "Unexpected error reading body slower than the request timeout")
+		assert.Equal(t, "helloworld", string(byt))
+	}
+	_, _, _, err = scraper.OpenFile("noheaders", 10, config)
+	assert.True(t, errors.Is(err, ErrTransport), "Expected error when the headers dont arrive in time: %s", err)
+	assert.NotContains(t, fmt.Sprint(err), testCurrentTok, "Unexpected token in the error")
+
+	// TEST: cancelling the context stops the download
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config.Context = ctx
+	_, _, _, err = scraper.OpenFile("small", 10, config)
+	assert.True(t, errors.Is(err, ErrTransport), "Expected error opening file with cancelled context: %s", err)
+	assert.NotContains(t, fmt.Sprint(err), testCurrentTok, "Unexpected token in the error")
+}
+
+func TestReason(t *testing.T) {
+	assert.Equal(t, "", Reason(nil))
+	assert.Equal(t, "timeout", Reason(fmt.Errorf("failed getMe: %w", ErrTimeout)))
+	assert.Equal(t, "unreachable", Reason(TransportError(errors.New("connection refused"))))
+	assert.Equal(t, "token refused", Reason(ErrTokenRevoked))
+	assert.Equal(t, "status 502", Reason(&StatusError{Code: 502}))
+	assert.Equal(t, "failed", Reason(fmt.Errorf("bot%s is broken", testCurrentTok)))
+}
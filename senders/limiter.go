@@ -0,0 +1,202 @@
+package senders
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Limits are the flood limits of the telegram server, as token buckets
+type Limits struct {
+	PerBot     rate.Limit // messages per second for a bot across all chats
+	BotBurst   int
+	PerChat    rate.Limit // messages per second in a single chat, groups included
+	PerGroup   rate.Limit // messages per second in a single group on top of PerChat, groups have negative chat ids
+	GroupBurst int
+	MaxRetries int // times a message is retried after 429 before giving up
+}
+
+// DefaultLimits : about 30 messages per second per bot, 1 per second per chat and 20 per minute per group - groups are held to both
+func DefaultLimits() Limits {
+	return Limits{
+		PerBot:     rate.Limit(30),
+		BotBurst:   30,
+		PerChat:    rate.Limit(1),
+		PerGroup:   rate.Every(time.Minute / 20),
+		GroupBurst: 20,
+		MaxRetries: 3,
+	}
+}
+
+// Limiter : schedules the outbound calls so the bots stay within the flood limits.
+// Callers queue (wait) for their turn instead of failing, and a 429 holds back the entire bot for retry_after.
+type Limiter struct {
+	mu           sync.Mutex
+	limits       Limits
+	bots         map[string]*rate.Limiter
+	chats        map[string]*rate.Limiter // keyed by bot & chat, since limits are per bot
+	groups       map[string]*rate.Limiter // keyed as chats, only for the groups
+	depth        map[string]int           // callers waiting, per bot
+	blockedUntil map[string]time.Time     // per bot, from the retry_after of 429
+}
+
+func NewLimiter(l Limits) *Limiter {
+	return &Limiter{
+		limits:       l,
+		bots:         map[string]*rate.Limiter{},
+		chats:        map[string]*rate.Limiter{},
+		groups:       map[string]*rate.Limiter{},
+		depth:        map[string]int{},
+		blockedUntil: map[string]time.Time{},
+	}
+}
+
+// reserve : reservations on the bot & chat buckets - and the group bucket for groups, and the time the caller has to wait for its turn
+func (l *Limiter) reserve(botid string, chatID int64) ([]*rate.Reservation, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bl, ok := l.bots[botid]
+	if !ok {
+		bl = rate.NewLimiter(l.limits.PerBot, l.limits.BotBurst)
+		l.bots[botid] = bl
+	}
+	key := fmt.Sprintf("%s/%d", botid, chatID)
+	cl, ok := l.chats[key]
+	if !ok {
+		if len(l.chats) > 10000 {
+			l.prune()
+		}
+		cl = rate.NewLimiter(l.limits.PerChat, 1)
+		l.chats[key] = cl
+	}
+	now := time.Now()
+	rsvs := []*rate.Reservation{bl.ReserveN(now, 1), cl.ReserveN(now, 1)}
+	if chatID < 0 {
+		// groups are held to both, no more than 1 per second and no more than 20 per minute
+		gl, ok := l.groups[key]
+		if !ok {
+			gl = rate.NewLimiter(l.limits.PerGroup, l.limits.GroupBurst)
+			l.groups[key] = gl
+		}
+		rsvs = append(rsvs, gl.ReserveN(now, 1))
+	}
+	wait := time.Duration(0)
+	for _, r := range rsvs {
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+	if until, ok := l.blockedUntil[botid]; ok && until.Sub(now) > wait {
+		wait = until.Sub(now)
+	}
+	return rsvs, wait
+}
+
+// prune : forgets the chat & group buckets that are full, they would be created afresh the same. Caller has to hold the lock.
+func (l *Limiter) prune() {
+	for _, buckets := range []map[string]*rate.Limiter{l.chats, l.groups} {
+		for key, b := range buckets {
+			if b.Tokens() >= float64(b.Burst()) {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// Wait : blocks till the message for the chat can be sent, errors only if the context is done before that.
+func (l *Limiter) Wait(ctx context.Context, botid string, chatID int64) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rsvs, wait := l.reserve(botid, chatID)
+	if wait <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	l.depth[botid]++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.depth[botid]--
+		l.mu.Unlock()
+	}()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		for _, r := range rsvs {
+			r.Cancel() // tokens go back to the bucket for the others in the queue
+		}
+		return ctx.Err()
+	}
+}
+
+// Backoff : telegram server has asked the bot to hold off, nothing is sent for the bot till then
+func (l *Limiter) Backoff(botid string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.After(l.blockedUntil[botid]) {
+		l.blockedUntil[botid] = until
+	}
+	log.WithFields(log.Fields{
+		"bot":   botid,
+		"until": until,
+	}).Warn("bot is rate limited by the telegram server")
+}
+
+// QueueStatus : callers waiting for their turn to send, per bot
+type QueueStatus struct {
+	Bot          string     `json:"bot"`
+	Depth        int        `json:"depth"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"` // when the bot is held back after 429
+}
+
+// Status : queue depth for the bot
+func (l *Limiter) Status(botid string) QueueStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	qs := QueueStatus{Bot: botid, Depth: l.depth[botid]}
+	if until, ok := l.blockedUntil[botid]; ok && until.After(time.Now()) {
+		qs.BlockedUntil = &until
+	}
+	return qs
+}
+
+// LimitedSender : Sender that waits for its turn from the Limiter before each send, and retries after 429
+type LimitedSender struct {
+	Sender
+	BotID   string
+	Limiter *Limiter
+}
+
+func (ls *LimitedSender) Send(msg OutboundMessage, c SendConfig) (*SendResult, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	chatID, _ := msg.ChatID.Int64()
+	for attempt := 0; ; attempt++ {
+		if err := ls.Limiter.Wait(c.Context, ls.BotID, chatID); err != nil {
+			return nil, fmt.Errorf("gave up waiting for turn to send: %s", err)
+		}
+		result, err := ls.Sender.Send(msg, c)
+		te, ok := AsTelegramError(err)
+		if !ok || te.Code != 429 {
+			return result, err
+		}
+		retryAfter := time.Duration(te.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		ls.Limiter.Backoff(ls.BotID, retryAfter)
+		if attempt >= ls.Limiter.limits.MaxRetries {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package senders
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(Limits{PerBot: rate.Limit(100), BotBurst: 100, PerChat: rate.Limit(10), PerGroup: rate.Limit(5), GroupBurst: 1})
+
+	// TEST: sends to the same chat are spaced out, sends to different chats are not
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, limiter.Wait(context.Background(), "bot", 1), "Unexpected error waiting")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond, "Unexpected sends to same chat without waiting")
+	start = time.Now()
+	for i := int64(10); i < 20; i++ {
+		assert.Nil(t, limiter.Wait(context.Background(), "bot", i), "Unexpected error waiting")
+	}
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "Unexpected wait for distinct chats")
+
+	// TEST: queue depth is visible while callers are waiting
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Wait(context.Background(), "bot", -100)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, limiter.Status("bot").Depth, "Unexpected queue depth")
+	wg.Wait()
+	assert.Equal(t, 0, limiter.Status("bot").Depth, "Unexpected queue depth after sends")
+
+	// TEST: groups are held to the per chat bucket too, even with the group bucket having room
+	groups := NewLimiter(Limits{PerBot: rate.Limit(100), BotBurst: 100, PerChat: rate.Limit(10), PerGroup: rate.Limit(5), GroupBurst: 20})
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, groups.Wait(context.Background(), "bot", -200), "Unexpected error waiting")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond, "Unexpected sends to same group without waiting")
+
+	// TEST: backoff holds the bot, and waiting can be cancelled
+	limiter.Backoff("bot", time.Minute)
+	assert.NotNil(t, limiter.Status("bot").BlockedUntil, "Unexpected status without block")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, limiter.Wait(ctx, "bot", 30), "Unexpected nil error when context is done")
+}
+
+func TestLimitedSender(t *testing.T) {
+	calls := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":42,"date":1700000000,"chat":{"id":1}}}`))
+	}))
+	defer srv.Close()
+	sender := &LimitedSender{
+		Sender:  &TelegramSender{UID: "6425245255", BaseUrl: srv.URL, Registry: tokens.NewSimpleTokenRegistry(testTok)},
+		BotID:   "6425245255",
+		Limiter: NewLimiter(DefaultLimits()),
+	}
+	start := time.Now()
+	result, err := sender.Send(OutboundMessage{ChatID: "1", Text: "hello"}, SendConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Unexpected error after retry")
+	assert.Equal(t, "42", result.MessageID.String(), "Unexpected message id")
+	assert.Equal(t, int32(2), calls, "Unexpected count of calls to the server")
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "Unexpected retry before retry_after")
+}
@@ -0,0 +1,186 @@
+package senders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/logging"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Receipt is published for every message taken off the outbox, correlated by the correlation id (or message id) of the delivery
+type Receipt struct {
+	CorrelationID string      `json:"correlation_id"`
+	Bot           string      `json:"bot"`
+	OK            bool        `json:"ok"`
+	MessageID     json.Number `json:"message_id,omitempty"` // id of the sent message, when ok
+	ChatID        json.Number `json:"chat_id,omitempty"`
+	Error         string      `json:"error,omitempty"` // why the message could not be sent, when not ok
+	At            time.Time   `json:"at"`
+}
+
+// OutboxQueue : name of the queue, also the topic, on which replies for the bot are queued
+func OutboxQueue(botid string) string {
+	return botid + ".outbox"
+}
+
+// AttemptsHeader : header counting the times the message was taken off the outbox and could not be sent
+const AttemptsHeader = "x-outbox-attempts"
+
+// DefaultMaxAttempts : attempts at a message before the outbox gives up on it, when Outbox.MaxAttempts isnt set
+const DefaultMaxAttempts = 5
+
+// ReceiptTopic : topic under which the delivery receipts for the bot are published
+func ReceiptTopic(botid string) string {
+	return botid + ".receipts"
+}
+
+// Outbox : sends the replies queued for a bot, and publishes a receipt for each
+type Outbox struct {
+	BotID       string
+	Sender      Sender
+	Config      SendConfig
+	Exchange    string                                                 // exchange the receipts are published to, and the retries queued back on
+	Publish     func(excName, topic string, msg amqp.Publishing) error // publishing the receipts and the retries
+	Limiter     *Limiter                                               // held back for the retry_after of retryable failures, nil to not hold back
+	MaxAttempts int                                                    // message fails with a receipt after these many attempts, DefaultMaxAttempts when 0
+}
+
+// Handle : sends a single queued reply.
+// requeue is true when the message could not be sent now but can be later, no receipt is published for such messages till the attempts run out.
+func (ob *Outbox) Handle(body []byte, correlationID string) (receipt Receipt, requeue bool) {
+	receipt = Receipt{CorrelationID: correlationID, Bot: ob.BotID, At: time.Now()}
+	msg := OutboundMessage{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		receipt.Error = "invalid outbound message, expected json sendMessage payload"
+		return receipt, false
+	}
+	receipt.ChatID = msg.ChatID
+	result, err := ob.Sender.Send(msg, ob.Config)
+	if err != nil {
+		receipt.Error = err.Error()
+		if Retryable(err) {
+			ob.backoff(err)
+			return receipt, true
+		}
+		return receipt, false
+	}
+	receipt.OK, receipt.MessageID = true, result.MessageID
+	return receipt, false
+}
+
+// backoff : bot is held back in the limiter for the retry_after of the failure, or a second when the server did not say
+func (ob *Outbox) backoff(err error) {
+	if ob.Limiter == nil {
+		return
+	}
+	retryAfter := time.Duration(0)
+	if te, ok := AsTelegramError(err); ok {
+		retryAfter = time.Duration(te.RetryAfter) * time.Second
+	}
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	ob.Limiter.Backoff(ob.BotID, retryAfter)
+}
+
+// attempts : times the delivery was attempted before this one, from AttemptsHeader
+func attempts(d amqp.Delivery) int {
+	switch n := d.Headers[AttemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// retry : delivery is queued back on the outbox with the attempts counted up.
+// Publishing afresh is the only way to carry the count, a nack requeues the message as it was
+func (ob *Outbox) retry(d amqp.Delivery, attempt int) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[AttemptsHeader] = int32(attempt)
+	return ob.Publish(ob.Exchange, OutboxQueue(ob.BotID), amqp.Publishing{
+		ContentType:   d.ContentType,
+		CorrelationId: d.CorrelationId,
+		MessageId:     d.MessageId,
+		Headers:       headers,
+		Body:          d.Body,
+	})
+}
+
+// Run : consumes the deliveries until the channel is closed or stop is closed.
+// Deliveries are acked only after the receipt is published. Retryable failures are queued back with the attempts counted,
+// the next send waits in the limiter for the retry_after. After MaxAttempts the message fails with a receipt.
+func (ob *Outbox) Run(deliveries <-chan amqp.Delivery, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case d, ok := <-deliveries:
+			if !ok {
+				log.WithFields(log.Fields{
+					"bot": ob.BotID,
+				}).Warn("outbox deliveries closed, broker connection lost?")
+				return
+			}
+			correlationID := d.CorrelationId
+			if correlationID == "" {
+				correlationID = d.MessageId
+			}
+			// request id of whoever queued the message, carried over to the receipt
+			reqID, _ := d.Headers[logging.RequestIDAMQP].(string)
+			entry := logging.From(logging.WithRequestID(context.Background(), reqID))
+			receipt, requeue := ob.Handle(d.Body, correlationID)
+			maxAttempts := ob.MaxAttempts
+			if maxAttempts <= 0 {
+				maxAttempts = DefaultMaxAttempts
+			}
+			if attempt := attempts(d) + 1; requeue && attempt < maxAttempts {
+				if err := ob.retry(d, attempt); err != nil {
+					entry.WithFields(log.Fields{
+						"bot": ob.BotID,
+						"err": err,
+					}).Error("failed Outbox.Run: could not queue the message back for retry")
+					d.Nack(false, true)
+					continue
+				}
+				d.Ack(false)
+				continue
+			} else if requeue {
+				receipt.Error = fmt.Sprintf("gave up after %d attempts: %s", attempt, receipt.Error)
+			}
+			byt, _ := json.Marshal(receipt)
+			receiptMsg := amqp.Publishing{
+				ContentType:   "application/json",
+				CorrelationId: correlationID,
+				Body:          byt,
+			}
+			if reqID != "" {
+				receiptMsg.Headers = amqp.Table{logging.RequestIDAMQP: reqID}
+			}
+			err := ob.Publish(ob.Exchange, ReceiptTopic(ob.BotID), receiptMsg)
+			if err != nil {
+				entry.WithFields(log.Fields{
+					"bot": ob.BotID,
+					"err": err,
+				}).Error("failed Outbox.Run: could not publish receipt")
+			}
+			if !receipt.OK {
+				entry.WithFields(log.Fields{
+					"bot": ob.BotID,
+					"err": receipt.Error,
+				}).Warn("outbox message could not be sent")
+			}
+			d.Ack(false)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Senders are the outbound counterpart of the scrapers, they send messages on behalf of the registered bots
+
+// Downstream services send replies through here and never have to hold the bot token.
+package senders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/tokens"
+	log "github.com/sirupsen/logrus"
+)
+
+// SendConfig extensible configuration object when sending
+type SendConfig struct {
+	RequestTimeout time.Duration     // timeout for the http request to the telegram server
+	Context        context.Context   // cancels the wait when the send is queued by the Limiter, nil for no cancellation
+	Transport      http.RoundTripper // wraps the http call to the telegram server, nil for the default transport
+}
+
+// OutboundMessage is the sendMessage request, same field names as the telegram bot api
+type OutboundMessage struct {
+	ChatID              json.Number     `json:"chat_id"`
+	Text                string          `json:"text"`
+	ParseMode           string          `json:"parse_mode,omitempty"`           // MarkdownV2, HTML or Markdown
+	ReplyMarkup         json.RawMessage `json:"reply_markup,omitempty"`         // inline keyboard, reply keyboard .. passed on as is
+	ReplyTo             json.Number     `json:"reply_to_message_id,omitempty"`  // message this is a reply to
+	DisableNotification bool            `json:"disable_notification,omitempty"` // sends the message silently
+}
+
+// Validate : checks the message before its sent to the telegram server
+func (om OutboundMessage) Validate() error {
+	if _, err := om.ChatID.Int64(); err != nil {
+		return fmt.Errorf("invalid chat_id, expected numerical id")
+	}
+	if om.Text == "" {
+		return fmt.Errorf("text of the message cannot be empty")
+	}
+	if om.ReplyTo != "" {
+		if _, err := om.ReplyTo.Int64(); err != nil {
+			return fmt.Errorf("invalid reply_to_message_id, expected numerical id")
+		}
+	}
+	switch om.ParseMode {
+	case "", "MarkdownV2", "HTML", "Markdown":
+	default:
+		return fmt.Errorf("invalid parse_mode %s", om.ParseMode)
+	}
+	return nil
+}
+
+// SendResult : what the telegram server sends back for a message that was sent
+type SendResult struct {
+	MessageID json.Number `json:"message_id"`
+	ChatID    json.Number `json:"chat_id"`
+	Date      int64       `json:"date"`
+}
+
+// TelegramError : the telegram server has refused to send the message
+type TelegramError struct {
+	Code        int    `json:"error_code"`
+	Description string `json:"description"`
+	RetryAfter  int    `json:"retry_after,omitempty"` // seconds, only when Code is 429
+}
+
+func (te *TelegramError) Error() string {
+	return fmt.Sprintf("telegram server error %d: %s", te.Code, te.Description)
+}
+
+// Retryable : true when sending the same message later could succeed
+func (te *TelegramError) Retryable() bool {
+	return te.Code == http.StatusTooManyRequests || te.Code >= http.StatusInternalServerError
+}
+
+type Sender interface {
+	Send(msg OutboundMessage, c SendConfig) (*SendResult, error)
+}
+
+// TelegramSender : sends messages for the bot, token from the registry
+type TelegramSender struct {
+	UID      string
+	BaseUrl  string // telegram server base url
+	Registry tokens.TokenRegistry
+}
+
+// telegramResponse : envelope of all the responses from the telegram bot api
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Send : sendMessage on the telegram server.
+// Errors are *TelegramError when the server refuses, 401 marks the token revoked same as the scraper does.
+// When the server could not be reached errors wrap scrapers.ErrTransport, and never carry the request url since it has the token.
+func (ts *TelegramSender) Send(msg OutboundMessage, c SendConfig) (*SendResult, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	botTok, ok := ts.Registry.Find(ts.UID)
+	if !ok || botTok == "" {
+		return nil, fmt.Errorf("no bot with id %s found registered with us: %w", ts.UID, scrapers.ErrBotNotRegistered)
+	}
+	if managed, ok := ts.Registry.(tokens.ManagedRegistry); ok {
+		if st, _ := managed.Status(ts.UID); st.State == tokens.StateRevoked {
+			return nil, fmt.Errorf("cannot send for bot %s: %w", ts.UID, scrapers.ErrTokenRevoked)
+		}
+	}
+	body, _ := json.Marshal(msg)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/bot%s/sendMessage", ts.BaseUrl, botTok), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: c.RequestTimeout, Transport: c.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		logging.From(c.Context).WithFields(log.Fields{
+			"err": err,
+		}).Debug("Send: error making the http request, check internet connection")
+		return nil, scrapers.TransportError(err)
+	}
+	defer resp.Body.Close()
+	byt, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading the response body: %s", scrapers.ErrTransport, err)
+	}
+	// refused token is revoked whatever the body, proxies in between can send back 401 without the json
+	if resp.StatusCode == http.StatusUnauthorized {
+		if managed, ok := ts.Registry.(tokens.ManagedRegistry); ok {
+			managed.Revoke(ts.UID, botTok)
+		}
+		return nil, fmt.Errorf("cannot send for bot %s: %w", ts.UID, scrapers.ErrTokenRevoked)
+	}
+	tresp := telegramResponse{}
+	if err := json.Unmarshal(byt, &tresp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sendMessage response %d from server: %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || !tresp.OK {
+		return nil, &TelegramError{Code: resp.StatusCode, Description: tresp.Description, RetryAfter: tresp.Parameters.RetryAfter}
+	}
+	sent := struct {
+		MessageID json.Number `json:"message_id"`
+		Date      int64       `json:"date"`
+		Chat      struct {
+			ID json.Number `json:"id"`
+		} `json:"chat"`
+	}{}
+	if err := json.Unmarshal(tresp.Result, &sent); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sent message: %s", err)
+	}
+	return &SendResult{MessageID: sent.MessageID, ChatID: sent.Chat.ID, Date: sent.Date}, nil
+}
+
+// Retryable : true when sending the same message later could succeed - the server asked to retry, failed or could not be reached
+func Retryable(err error) bool {
+	if te, ok := AsTelegramError(err); ok {
+		return te.Retryable()
+	}
+	return errors.Is(err, scrapers.ErrTransport)
+}
+
+// AsTelegramError : unwraps the telegram error if any
+func AsTelegramError(err error) (*TelegramError, bool) {
+	var te *TelegramError
+	ok := errors.As(err, &te)
+	return te, ok
+}
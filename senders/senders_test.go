@@ -0,0 +1,184 @@
+package senders
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTok = "6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4"
+
+// sendServer : telegram server that replies based on the text of the message
+func sendServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/bot"+testTok+"/sendMessage", r.URL.Path, "Unexpected path for sendMessage")
+		byt, _ := io.ReadAll(r.Body)
+		msg := OutboundMessage{}
+		json.Unmarshal(byt, &msg)
+		switch msg.Text {
+		case "flood":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`))
+		case "nochat":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+		case "revoked":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ok":false,"error_code":401,"description":"Unauthorized"}`))
+		case "proxied":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`<html><body>401 Authorization Required</body></html>`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":{"message_id":42,"date":1700000000,"chat":{"id":` + msg.ChatID.String() + `}}}`))
+		}
+	}))
+}
+
+func TestSend(t *testing.T) {
+	srv := sendServer(t)
+	defer srv.Close()
+	registry := tokens.NewRotatingTokenRegistry(testTok)
+	sender := &TelegramSender{UID: "6425245255", BaseUrl: srv.URL, Registry: registry}
+	config := SendConfig{RequestTimeout: time.Second}
+
+	result, err := sender.Send(OutboundMessage{ChatID: "5157350442", Text: "hello", ParseMode: "HTML", ReplyTo: "10"}, config)
+	assert.Nil(t, err, "Unexpected error sending message")
+	assert.Equal(t, "42", result.MessageID.String(), "Unexpected message id")
+	assert.Equal(t, "5157350442", result.ChatID.String(), "Unexpected chat id")
+
+	// TEST: invalid messages never reach the server
+	for _, msg := range []OutboundMessage{{ChatID: "abc", Text: "hello"}, {ChatID: "1"}, {ChatID: "1", Text: "hello", ParseMode: "XML"}} {
+		_, err = sender.Send(msg, config)
+		assert.NotNil(t, err, "Unexpected nil error for invalid message %v", msg)
+	}
+
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "flood"}, config)
+	te, ok := AsTelegramError(err)
+	assert.True(t, ok, "Unexpected error type for 429")
+	assert.Equal(t, 5, te.RetryAfter, "Unexpected retry after")
+	assert.True(t, te.Retryable(), "Unexpected non retryable 429")
+
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "nochat"}, config)
+	te, ok = AsTelegramError(err)
+	assert.True(t, ok, "Unexpected error type for 400")
+	assert.False(t, te.Retryable(), "Unexpected retryable 400")
+
+	// TEST: 401 revokes the token, and further sends are refused without calling the server
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "revoked"}, config)
+	assert.True(t, errors.Is(err, scrapers.ErrTokenRevoked), "Unexpected error for 401 %s", err)
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "hello"}, config)
+	assert.True(t, errors.Is(err, scrapers.ErrTokenRevoked), "Unexpected error for revoked token %s", err)
+
+	// TEST: 401 that isnt json revokes the token all the same
+	sender = &TelegramSender{UID: "6425245255", BaseUrl: srv.URL, Registry: tokens.NewRotatingTokenRegistry(testTok)}
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "proxied"}, config)
+	assert.True(t, errors.Is(err, scrapers.ErrTokenRevoked), "Unexpected error for 401 without json %s", err)
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "hello"}, config)
+	assert.True(t, errors.Is(err, scrapers.ErrTokenRevoked), "Expected the token revoked %s", err)
+
+	// TEST: server that cant be reached is retryable, and the error has no token
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	sender = &TelegramSender{UID: "6425245255", BaseUrl: down.URL, Registry: tokens.NewRotatingTokenRegistry(testTok)}
+	_, err = sender.Send(OutboundMessage{ChatID: "1", Text: "hello"}, config)
+	assert.True(t, errors.Is(err, scrapers.ErrTransport), "Unexpected error for unreachable server %s", err)
+	assert.True(t, Retryable(err), "Expected unreachable server to be retryable")
+	assert.NotContains(t, err.Error(), testTok, "Unexpected token in the error")
+}
+
+// fakeAcker : records the acks and nacks of the deliveries
+type fakeAcker struct {
+	acked, nacked int
+}
+
+func (fa *fakeAcker) Ack(tag uint64, multiple bool) error {
+	fa.acked++
+	return nil
+}
+func (fa *fakeAcker) Nack(tag uint64, multiple, requeue bool) error {
+	fa.nacked++
+	return nil
+}
+func (fa *fakeAcker) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	srv := sendServer(t)
+	defer srv.Close()
+	receipts, retries := []Receipt{}, []amqp.Publishing{}
+	ob := &Outbox{
+		BotID:    "6425245255",
+		Sender:   &TelegramSender{UID: "6425245255", BaseUrl: srv.URL, Registry: tokens.NewSimpleTokenRegistry(testTok)},
+		Config:   SendConfig{RequestTimeout: time.Second},
+		Exchange: "amq.topic",
+		Publish: func(excName, topic string, msg amqp.Publishing) error {
+			if topic == OutboxQueue("6425245255") {
+				retries = append(retries, msg)
+				return nil
+			}
+			assert.Equal(t, "6425245255.receipts", topic, "Unexpected receipt topic")
+			r := Receipt{}
+			json.Unmarshal(msg.Body, &r)
+			receipts = append(receipts, r)
+			return nil
+		},
+	}
+	acker := &fakeAcker{}
+	deliveries := make(chan amqp.Delivery, 3)
+	deliveries <- amqp.Delivery{Acknowledger: acker, CorrelationId: "c1", Body: []byte(`{"chat_id":1,"text":"hello"}`)}
+	deliveries <- amqp.Delivery{Acknowledger: acker, MessageId: "c2", Body: []byte(`{"chat_id":1,"text":"nochat"}`)}
+	deliveries <- amqp.Delivery{Acknowledger: acker, CorrelationId: "c3", Body: []byte(`not json`)}
+	close(deliveries)
+	ob.Run(deliveries, make(chan struct{}))
+
+	assert.Equal(t, 3, acker.acked, "Unexpected count of acks")
+	assert.Equal(t, 3, len(receipts), "Unexpected count of receipts")
+	assert.True(t, receipts[0].OK, "Unexpected failed receipt")
+	assert.Equal(t, "c1", receipts[0].CorrelationID, "Unexpected correlation id")
+	assert.False(t, receipts[1].OK, "Unexpected ok receipt for rejected message")
+	assert.Equal(t, "c2", receipts[1].CorrelationID, "Unexpected correlation id from message id")
+	assert.False(t, receipts[2].OK, "Unexpected ok receipt for invalid message")
+
+	// TEST: retryable failures are requeued, no receipt
+	_, requeue := ob.Handle([]byte(`{"chat_id":1,"text":"flood"}`), "c4")
+	assert.True(t, requeue, "Unexpected no requeue for flood")
+
+	// TEST: retries are queued back with the attempts counted and the bot held back, till the attempts run out
+	ob.Limiter = NewLimiter(DefaultLimits())
+	acker, receipts = &fakeAcker{}, []Receipt{}
+	deliveries = make(chan amqp.Delivery, 2)
+	deliveries <- amqp.Delivery{Acknowledger: acker, CorrelationId: "c5", Body: []byte(`{"chat_id":1,"text":"flood"}`)}
+	deliveries <- amqp.Delivery{Acknowledger: acker, CorrelationId: "c6", Headers: amqp.Table{AttemptsHeader: int32(DefaultMaxAttempts - 1)}, Body: []byte(`{"chat_id":1,"text":"flood"}`)}
+	close(deliveries)
+	ob.Run(deliveries, make(chan struct{}))
+	assert.Equal(t, 2, acker.acked, "Expected both acked, nothing requeued as is")
+	assert.Equal(t, 0, acker.nacked)
+	if assert.Equal(t, 1, len(retries), "Expected the first queued back for retry") {
+		assert.Equal(t, "c5", retries[0].CorrelationId)
+		assert.Equal(t, int32(1), retries[0].Headers[AttemptsHeader])
+	}
+	if assert.Equal(t, 1, len(receipts), "Expected a failed receipt once the attempts run out") {
+		assert.False(t, receipts[0].OK)
+		assert.Equal(t, "c6", receipts[0].CorrelationID)
+		assert.Contains(t, receipts[0].Error, "gave up after 5 attempts")
+	}
+	assert.NotNil(t, ob.Limiter.Status("6425245255").BlockedUntil, "Expected the bot held back for the retry_after")
+
+	// TEST: server that cant be reached is retried, receipts never carry the token
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	ob.Sender = &TelegramSender{UID: "6425245255", BaseUrl: down.URL, Registry: tokens.NewSimpleTokenRegistry(testTok)}
+	receipt, requeue := ob.Handle([]byte(`{"chat_id":1,"text":"hello"}`), "c7")
+	assert.True(t, requeue, "Expected unreachable server to be retried")
+	assert.NotContains(t, receipt.Error, testTok, "Unexpected token in the receipt")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// isDraining : true once the shutdown has begun
+func (a *App) isDraining() bool {
+	select {
+	case <-a.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// HndlRefuseDraining : new scrapes & sends are refused once the service is draining.
+// Callers retry on another instance, requests already in flight are unaffected
+func (a *App) HndlRefuseDraining(ctx *gin.Context) {
+	if a.isDraining() {
+		ctx.Header("Connection", "close")
+		api.Abort(ctx, http.StatusServiceUnavailable, api.CodeUnavailable, "service is shutting down, try again", nil)
+		return
+	}
+	ctx.Next()
+}
+
+// startOutbox : runs the outbox consumer for the bot, shutdown waits for it to stop
+func (a *App) startOutbox(botid string) {
+	a.outboxes.Add(1)
+	go func() {
+		defer a.outboxes.Done()
+		a.runOutbox(botid, a.stopOutbox)
+	}()
+}
+
+// serve : runs the http server till SIGINT or SIGTERM, then drains.
+// Error only when the server could not listen or the drain did not finish in time
+func (a *App) serve(srv *http.Server, grace time.Duration) error {
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- srv.ListenAndServe()
+	}()
+	log.WithFields(log.Fields{
+		"addr": srv.Addr,
+	}).Info("http server listening")
+	select {
+	case err := <-listenErr:
+		return fmt.Errorf("failed to listen on %s: %s", srv.Addr, err)
+	case <-sigCtx.Done():
+	}
+	stop() // a second signal kills the process right away
+	return a.drain(srv, grace)
+}
+
+// drain : stops accepting new work, waits for the in-flight scrape-and-publish chains, scheduled scrapes and the outbox consumers.
+// Outbox consumers finish the message in hand, ack it and close their broker connection.
+// Scrape handlers close their own broker connection once the publish loop is done
+func (a *App) drain(srv *http.Server, grace time.Duration) error {
+	log.WithFields(log.Fields{
+		"grace": grace,
+	}).Info("shutting down, draining in-flight scrapes, publishes and outbox sends")
+	start := time.Now()
+	close(a.draining) // readiness fails, new triggers refused, streams closed
+	close(a.stopOutbox)
+	a.Schedules.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	srv.SetKeepAlivesEnabled(false)
+	errs := []error{}
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http requests still in flight after %s: %s", grace, err))
+	}
+	outboxesDone := make(chan struct{})
+	go func() {
+		a.outboxes.Wait()
+		a.Schedules.Wait()
+		close(outboxesDone)
+	}()
+	select {
+	case <-outboxesDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("outbox consumers or scheduled scrapes still running after %s", grace))
+	}
+	if err := a.Dedupe.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close the dedupe store: %s", err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to drain: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"took": time.Since(start),
+	}).Info("drained, all in-flight work done")
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	a, _, _ := newTestApp(t, "http://telegram.invalid")
+	inFlight := make(chan struct{})
+	r := gin.New()
+	r.POST("/trigger", a.HndlRefuseDraining, func(ctx *gin.Context) {
+		close(inFlight)
+		time.Sleep(300 * time.Millisecond) // scrape & publish still going when shutdown begins
+		ctx.Status(http.StatusOK)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Unexpected error listening")
+	srv := &http.Server{Handler: r}
+	go srv.Serve(ln)
+
+	stopped := false
+	a.outboxes.Add(1)
+	go func() {
+		defer a.outboxes.Done()
+		<-a.stopOutbox
+		stopped = true
+	}()
+
+	status := make(chan int)
+	go func() {
+		resp, err := http.Post("http://"+ln.Addr().String()+"/trigger", "application/json", nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-inFlight
+	assert.Nil(t, a.drain(srv, 5*time.Second), "Unexpected error draining")
+	assert.Equal(t, http.StatusOK, <-status, "In-flight request should have completed")
+	assert.True(t, stopped, "Outbox consumers should have stopped")
+
+	// once draining new triggers are refused, even if they get through
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/trigger", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "Expected trigger refused while draining")
+}
@@ -0,0 +1,144 @@
+// Stream is the internal stream of decoded updates, the same updates that are published to the broker.
+
+// Dashboards & browser tools that cant speak AMQP subscribe to the hub, over SSE or websockets.
+// Hub keeps a few of the recent updates per bot so subscribers can resume from the last update they saw.
+package stream
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/eensymachines/tgramscraper/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Filter : server side filters for the subscriber, empty filter lets all the updates through
+type Filter struct {
+	Chats []int64  // only updates from these chats
+	Kinds []string // only these kinds of updates - message, edited_message ..
+}
+
+// Match : true if the update passes the filter
+func (f Filter) Match(u models.Update) bool {
+	if len(f.Chats) > 0 {
+		id, _ := u.Chat().ChatID.Int64()
+		found := false
+		for _, c := range f.Chats {
+			if c == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Kinds) > 0 {
+		for _, k := range f.Kinds {
+			if k == u.Kind() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type subscriber struct {
+	ch     chan models.Update
+	filter Filter
+}
+
+// botStream : recent updates and the subscribers of a single bot
+type botStream struct {
+	recent []models.Update
+	subs   map[*subscriber]bool
+}
+
+// Hub fans out the updates of each bot to all its subscribers.
+// Slow subscribers miss updates instead of holding up the publishing.
+type Hub struct {
+	mu      sync.Mutex
+	backlog int // recent updates kept per bot for resuming
+	bots    map[string]*botStream
+}
+
+// NewHub : backlog is the count of recent updates kept per bot for the subscribers to resume from
+func NewHub(backlog int) *Hub {
+	return &Hub{backlog: backlog, bots: map[string]*botStream{}}
+}
+
+// bot : stream of the bot, created if not already, caller has to hold the lock
+func (h *Hub) bot(botid string) *botStream {
+	bs, ok := h.bots[botid]
+	if !ok {
+		bs = &botStream{recent: []models.Update{}, subs: map[*subscriber]bool{}}
+		h.bots[botid] = bs
+	}
+	return bs
+}
+
+// Publish : sends the updates to all the subscribers of the bot whose filters match
+func (h *Hub) Publish(botid string, updts ...models.Update) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bs := h.bot(botid)
+	for _, u := range updts {
+		bs.recent = append(bs.recent, u)
+		if len(bs.recent) > h.backlog {
+			bs.recent = bs.recent[len(bs.recent)-h.backlog:]
+		}
+		for sub := range bs.subs {
+			if !sub.filter.Match(u) {
+				continue
+			}
+			select {
+			case sub.ch <- u:
+			default:
+				log.WithFields(log.Fields{
+					"bot":       botid,
+					"update_id": u.UpdtID,
+				}).Warn("stream subscriber too slow, update missed")
+			}
+		}
+	}
+}
+
+// Subscribe : channel on which the updates of the bot are sent, as they are published.
+// When lastEventID is not empty, recent updates after it are sent first so the subscriber can resume.
+// Call the cancel function when done, channel is closed on cancel.
+func (h *Hub) Subscribe(botid string, f Filter, lastEventID string) (<-chan models.Update, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bs := h.bot(botid)
+	sub := &subscriber{ch: make(chan models.Update, h.backlog+64), filter: f}
+	if lastEventID != "" {
+		last, ok := new(big.Int).SetString(lastEventID, 10)
+		for _, u := range bs.recent {
+			id, valid := new(big.Int).SetString(u.UpdtID.String(), 10)
+			if ok && valid && id.Cmp(last) > 0 && f.Match(u) {
+				sub.ch <- u
+			}
+		}
+	}
+	bs.subs[sub] = true
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(bs.subs, sub)
+			close(sub.ch)
+		})
+	}
+}
+
+// Subscribers : count of subscribers for the bot
+func (h *Hub) Subscribers(botid string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if bs, ok := h.bots[botid]; ok {
+		return len(bs.subs)
+	}
+	return 0
+}
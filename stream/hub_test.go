@@ -0,0 +1,53 @@
+package stream_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/eensymachines/tgramscraper/models"
+	"github.com/eensymachines/tgramscraper/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func update(id int, chat int64, edited bool) models.Update {
+	msg := &models.UpdateMessage{Text: fmt.Sprintf("update %d", id), Chat: models.Chat{ChatID: json.Number(fmt.Sprintf("%d", chat))}}
+	if edited {
+		return models.Update{UpdtID: json.Number(fmt.Sprintf("%d", id)), EditedMessage: msg}
+	}
+	return models.Update{UpdtID: json.Number(fmt.Sprintf("%d", id)), Message: msg}
+}
+
+func TestHub(t *testing.T) {
+	hub := stream.NewHub(3)
+	all, cancelAll := hub.Subscribe("bot", stream.Filter{}, "")
+	chat2, cancelChat2 := hub.Subscribe("bot", stream.Filter{Chats: []int64{2}}, "")
+	edits, cancelEdits := hub.Subscribe("bot", stream.Filter{Kinds: []string{"edited_message"}}, "")
+	other, cancelOther := hub.Subscribe("otherbot", stream.Filter{}, "")
+	assert.Equal(t, 3, hub.Subscribers("bot"), "Unexpected count of subscribers")
+
+	hub.Publish("bot", update(10, 1, false), update(11, 2, false), update(12, 2, true))
+	assert.Equal(t, 3, len(all), "Unexpected count of updates for unfiltered subscriber")
+	assert.Equal(t, 2, len(chat2), "Unexpected count of updates for chat filtered subscriber")
+	assert.Equal(t, 1, len(edits), "Unexpected count of updates for kind filtered subscriber")
+	assert.Equal(t, 0, len(other), "Unexpected updates for other bot")
+
+	// TEST: resuming from last event id replays only the recent ones after it
+	hub.Publish("bot", update(13, 1, false))
+	resumed, cancelResumed := hub.Subscribe("bot", stream.Filter{}, "11")
+	assert.Equal(t, 2, len(resumed), "Unexpected count of replayed updates")
+	u := <-resumed
+	assert.Equal(t, "12", u.UpdtID.String(), "Unexpected first replayed update")
+	// backlog is 3, update 10 is no longer there to replay
+	fromStart, cancelFromStart := hub.Subscribe("bot", stream.Filter{}, "0")
+	assert.Equal(t, 3, len(fromStart), "Unexpected count of replayed updates beyond backlog")
+
+	for _, cancel := range []func(){cancelAll, cancelChat2, cancelEdits, cancelOther, cancelResumed, cancelFromStart} {
+		cancel()
+	}
+	cancelAll() // cancelling twice is harmless
+	assert.Equal(t, 0, hub.Subscribers("bot"), "Unexpected subscribers after cancel")
+	for range edits {
+		// channel is closed on cancel, else this would block
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/api"
+	"github.com/eensymachines/tgramscraper/logging"
+	"github.com/eensymachines/tgramscraper/stream"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// allowedOrigin : websocket is opened only from pages of the same origin or the configured stream origins.
+// Clients that arent browsers dont send an origin and are let through
+func (a *App) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range a.Config.StreamOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// streamFilter : server side filters from the query params, chat & kind can be repeated
+func streamFilter(ctx *gin.Context) (stream.Filter, error) {
+	f := stream.Filter{Kinds: ctx.QueryArray("kind")}
+	for _, c := range ctx.QueryArray("chat") {
+		id, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid chat id %s", c)
+		}
+		f.Chats = append(f.Chats, id)
+	}
+	return f, nil
+}
+
+// streamRequest : checks the bot and reads in the filters, aborts the context if the request is not valid
+func (a *App) streamRequest(ctx *gin.Context) (stream.Filter, bool) {
+	botid := ctx.Param("botid")
+	if _, ok := a.Registry.Find(botid); !ok {
+		api.Abort(ctx, http.StatusNotFound, api.CodeBotNotFound, fmt.Sprintf("no bot registered with id %s", botid), nil)
+		return stream.Filter{}, false
+	}
+	filter, err := streamFilter(ctx)
+	if err != nil {
+		api.Abort(ctx, http.StatusBadRequest, api.CodeInvalidRequest, err.Error(), nil)
+		return stream.Filter{}, false
+	}
+	return filter, true
+}
+
+// HndlStreamSSE : pushes the decoded updates of the bot as server sent events, as they are scraped.
+// Event id is the update id, resume with the Last-Event-ID header (or the last_event_id query param).
+// Filters by chat and kind of update from the query params.
+func (a *App) HndlStreamSSE(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	filter, ok := a.streamRequest(ctx)
+	if !ok {
+		return
+	}
+	lastEventID := ctx.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = ctx.Query("last_event_id")
+	}
+	updates, cancel := a.Hub.Subscribe(botid, filter, lastEventID)
+	defer cancel()
+	logging.From(ctx.Request.Context()).WithFields(log.Fields{
+		"bot":           botid,
+		"last_event_id": lastEventID,
+	}).Debug("sse subscriber connected")
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no") // proxies shouldnt buffer the stream
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-a.draining:
+			return false // clients reconnect to another instance with Last-Event-ID
+		case <-heartbeat.C:
+			ctx.Render(-1, sse.Event{Event: "heartbeat", Data: time.Now().Unix()})
+			return true
+		case u, ok := <-updates:
+			if !ok {
+				return false
+			}
+			ctx.Render(-1, sse.Event{Id: u.UpdtID.String(), Event: u.Kind(), Data: u})
+			return true
+		}
+	})
+}
+
+// HndlStreamWS : websocket equivalent of HndlStreamSSE, each update is sent as a json text message.
+// Browsers cant set headers on websockets, resume with the last_event_id query param
+func (a *App) HndlStreamWS(ctx *gin.Context) {
+	botid := ctx.Param("botid")
+	filter, ok := a.streamRequest(ctx)
+	if !ok {
+		return
+	}
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = a.allowedOrigin
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// upgrader has already sent back the error response
+		logging.From(ctx.Request.Context()).WithFields(log.Fields{
+			"bot": botid,
+			"err": err,
+		}).Error("failed HndlStreamWS: could not upgrade to websocket")
+		ctx.Abort()
+		return
+	}
+	defer conn.Close()
+	updates, cancel := a.Hub.Subscribe(botid, filter, ctx.Query("last_event_id"))
+	defer cancel()
+
+	// reading is only to know when the client has gone away, clients arent expected to send anything
+	gone := make(chan bool)
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-a.draining:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(u); err != nil {
+				logging.From(ctx.Request.Context()).WithFields(log.Fields{
+					"bot": botid,
+					"err": err,
+				}).Warn("HndlStreamWS: failed to write update, closing")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// Telegramtest is a fake Telegram Bot API over httptest, for testing the scrapers, senders and handlers offline.
+
+// Bots are added with their token, updates are pushed on to the queue of the bot and getUpdates hands them out
+// with the same offset, limit and long polling semantics as the telegram server. Failures can be queued per method
+// to see how the callers cope with 429, 409, 401, malformed responses and slow responses.
+package telegramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/models"
+)
+
+// maxLongPoll : getUpdates never waits longer than this, whatever the timeout asked for. Keeps the tests quick
+const maxLongPoll = 5 * time.Second
+
+var botPath = regexp.MustCompile(`^/bot([^/]+)/([A-Za-z]+)$`)
+var filePath = regexp.MustCompile(`^/file/bot([^/]+)/(.+)$`)
+
+// SentMessage : message as the bot sent it with sendMessage
+type SentMessage struct {
+	MessageID int64           `json:"message_id"`
+	ChatID    json.Number     `json:"chat_id"`
+	Text      string          `json:"text"`
+	ParseMode string          `json:"parse_mode,omitempty"`
+	Markup    json.RawMessage `json:"reply_markup,omitempty"`
+	ReplyTo   json.Number     `json:"reply_to_message_id,omitempty"`
+}
+
+// File : file the bot can getFile & download
+type File struct {
+	Path    string
+	Content []byte
+}
+
+// Failure : what the server sends back instead of the response, for the next calls to the method
+type Failure struct {
+	Status      int           // http status & error_code, 0 to only delay or send malformed json
+	Description string        // description of the error
+	RetryAfter  int           // seconds, sent as parameters.retry_after
+	Malformed   bool          // response body is not json
+	Delay       time.Duration // wait before responding, longer than the client timeout to time out the client
+	Times       int           // calls this fails for, 0 for just the next call
+}
+
+// TooManyRequests : 429 as the flood control of the telegram server sends it
+func TooManyRequests(retryAfter int) Failure {
+	return Failure{Status: http.StatusTooManyRequests, Description: fmt.Sprintf("Too Many Requests: retry after %d", retryAfter), RetryAfter: retryAfter}
+}
+
+// Conflict : 409, as when another getUpdates is running or a webhook is set
+func Conflict() Failure {
+	return Failure{Status: http.StatusConflict, Description: "Conflict: terminated by other getUpdates request; make sure that only one bot instance is running"}
+}
+
+// Unauthorized : 401, as for a token revoked by BotFather
+func Unauthorized() Failure {
+	return Failure{Status: http.StatusUnauthorized, Description: "Unauthorized"}
+}
+
+// Malformed : 200 with a body that isnt json
+func Malformed() Failure {
+	return Failure{Malformed: true}
+}
+
+// Slow : correct response, but only after the delay
+func Slow(d time.Duration) Failure {
+	return Failure{Delay: d}
+}
+
+// Bot : a bot on the fake server, safe for concurrent use
+type Bot struct {
+	ID       int64
+	Username string
+	Token    string
+
+	srv        *Server
+	updates    []models.Update // not yet confirmed, in the order of update id
+	nextUpdate int64
+	nextMsg    int64
+	sent       []SentMessage
+	files      map[string]File
+	webhook    string
+	revoked    bool
+	arrived    chan struct{} // closed & replaced each time updates are pushed, wakes up the long polls
+}
+
+// Server : fake telegram server, URL is the base url for the scrapers & senders
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bots     map[string]*Bot      // by token
+	failures map[string][]Failure // by method, in the order they were queued
+	calls    map[string]int       // by method
+}
+
+// NewServer : fake server without any bots, tokens that arent added are refused with 401
+func NewServer() *Server {
+	s := &Server{bots: map[string]*Bot{}, failures: map[string][]Failure{}, calls: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddBot : bot for the token, id is from the token same as with the telegram server
+func (s *Server) AddBot(token string) *Bot {
+	id, _ := strconv.ParseInt(strings.Split(token, ":")[0], 10, 64)
+	b := &Bot{
+		ID:         id,
+		Username:   fmt.Sprintf("bot%d_bot", id),
+		Token:      token,
+		srv:        s,
+		nextUpdate: 1,
+		nextMsg:    1,
+		files:      map[string]File{},
+		arrived:    make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.bots[token] = b
+	s.mu.Unlock()
+	return b
+}
+
+// Fail : next calls to the method fail as the failure says, failures queued for the same method go in order
+func (s *Server) Fail(method string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Times <= 0 {
+		f.Times = 1
+	}
+	s.failures[method] = append(s.failures[method], f)
+}
+
+// Calls : count of the calls to the method, failed ones included
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// failure : next failure for the method if any, counts the call
+func (s *Server) failure(method string) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[method]++
+	queued := s.failures[method]
+	if len(queued) == 0 {
+		return Failure{}, false
+	}
+	f := queued[0]
+	queued[0].Times--
+	if queued[0].Times == 0 {
+		s.failures[method] = queued[1:]
+	}
+	return f, true
+}
+
+// Push : updates on to the queue of the bot, update ids are assigned in order to the updates that dont have one.
+// Updates with an id carry on the sequence from there. Updates as pushed are sent back, with the ids
+func (b *Bot) Push(updates ...models.Update) []models.Update {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	for i := range updates {
+		if id, err := updates[i].UpdtID.Int64(); err == nil && id > 0 {
+			b.nextUpdate = id
+		}
+		updates[i].UpdtID = json.Number(strconv.FormatInt(b.nextUpdate, 10))
+		b.nextUpdate++
+		b.updates = append(b.updates, updates[i])
+	}
+	close(b.arrived)
+	b.arrived = make(chan struct{})
+	return updates
+}
+
+// PushText : text message from the chat, as a user would type it
+func (b *Bot) PushText(chatID int64, text string) models.Update {
+	b.srv.mu.Lock()
+	msgID := b.nextMsg
+	b.nextMsg++
+	b.srv.mu.Unlock()
+	u := models.Update{Message: &models.UpdateMessage{
+		MsgId: json.Number(strconv.FormatInt(msgID, 10)),
+		From:  models.Sender{SenderID: json.Number(strconv.FormatInt(chatID, 10)), FirstName: "Tester"},
+		Chat:  models.Chat{ChatID: json.Number(strconv.FormatInt(chatID, 10)), Typ: "private"},
+		Date:  time.Now().Unix(),
+		Text:  text,
+	}}
+	return b.Push(u)[0]
+}
+
+// Pending : updates yet to be confirmed with an offset beyond them
+func (b *Bot) Pending() []models.Update {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	return append([]models.Update{}, b.updates...)
+}
+
+// Sent : messages the bot has sent so far
+func (b *Bot) Sent() []SentMessage {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	return append([]SentMessage{}, b.sent...)
+}
+
+// AddFile : file the bot can getFile and download, under a path made up from the file id
+func (b *Bot) AddFile(fileID string, content []byte) {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	b.files[fileID] = File{Path: fmt.Sprintf("documents/%s", fileID), Content: content}
+}
+
+// Revoke : token is refused with 401 from here on, as when BotFather revokes it
+func (b *Bot) Revoke() {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	b.revoked = true
+}
+
+// Webhook : url of the webhook set, empty when none
+func (b *Bot) Webhook() string {
+	b.srv.mu.Lock()
+	defer b.srv.mu.Unlock()
+	return b.webhook
+}
+
+// reply : response envelope of the bot api
+func reply(w http.ResponseWriter, status int, result interface{}, description string, retryAfter int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+		return
+	}
+	body := map[string]interface{}{"ok": false, "error_code": status, "description": description}
+	if retryAfter > 0 {
+		body["parameters"] = map[string]int{"retry_after": retryAfter}
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// params : parameters from the query, the form or the json body - the bot api takes all of them
+func params(r *http.Request) map[string]string {
+	result := map[string]string{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body := map[string]json.RawMessage{}
+		json.NewDecoder(r.Body).Decode(&body)
+		for k, v := range body {
+			var str string
+			if json.Unmarshal(v, &str) == nil {
+				result[k] = str
+				continue
+			}
+			result[k] = string(v) // numbers, bools, arrays & objects as is
+		}
+	}
+	r.ParseForm()
+	for k := range r.Form {
+		result[k] = r.Form.Get(k)
+	}
+	return result
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if m := filePath.FindStringSubmatch(r.URL.Path); m != nil {
+		s.download(w, m[1], m[2])
+		return
+	}
+	m := botPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		reply(w, http.StatusNotFound, nil, "Not Found", 0)
+		return
+	}
+	token, method := m[1], m[2]
+	if f, ok := s.failure(method); ok {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.Malformed {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok":true,"result":[{"update_id":`))
+			return
+		}
+		if f.Status != 0 {
+			reply(w, f.Status, nil, f.Description, f.RetryAfter)
+			return
+		}
+	}
+	s.mu.Lock()
+	b, ok := s.bots[token]
+	revoked := ok && b.revoked
+	s.mu.Unlock()
+	if !ok || revoked {
+		reply(w, http.StatusUnauthorized, nil, "Unauthorized", 0)
+		return
+	}
+	p := params(r)
+	switch method {
+	case "getMe":
+		reply(w, http.StatusOK, map[string]interface{}{"id": b.ID, "is_bot": true, "first_name": b.Username, "username": b.Username}, "", 0)
+	case "getUpdates":
+		b.getUpdates(w, r, p)
+	case "sendMessage":
+		b.sendMessage(w, p)
+	case "getFile":
+		b.getFile(w, p)
+	case "setWebhook":
+		s.mu.Lock()
+		b.webhook = p["url"]
+		s.mu.Unlock()
+		reply(w, http.StatusOK, true, "", 0)
+	case "deleteWebhook":
+		s.mu.Lock()
+		b.webhook = ""
+		if p["drop_pending_updates"] == "true" {
+			b.updates = nil
+		}
+		s.mu.Unlock()
+		reply(w, http.StatusOK, true, "", 0)
+	case "getWebhookInfo":
+		s.mu.Lock()
+		info := map[string]interface{}{"url": b.webhook, "has_custom_certificate": false, "pending_update_count": len(b.updates)}
+		s.mu.Unlock()
+		reply(w, http.StatusOK, info, "", 0)
+	default:
+		reply(w, http.StatusNotFound, nil, "Not Found: method not found", 0)
+	}
+}
+
+// getUpdates : updates beyond the offset, confirming all the updates before it.
+// Negative offset gets the last few updates & forgets the rest. Without updates the call waits upto the timeout for them
+func (b *Bot) getUpdates(w http.ResponseWriter, r *http.Request, p map[string]string) {
+	offset, _ := strconv.ParseInt(p["offset"], 10, 64)
+	limit := 100
+	if l, err := strconv.Atoi(p["limit"]); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	timeout, _ := strconv.Atoi(p["timeout"])
+	allowed := []string{}
+	if p["allowed_updates"] != "" {
+		json.Unmarshal([]byte(p["allowed_updates"]), &allowed)
+	}
+	wait := time.Duration(timeout) * time.Second
+	if wait > maxLongPoll {
+		wait = maxLongPoll
+	}
+	deadline := time.After(wait)
+	for {
+		b.srv.mu.Lock()
+		if b.webhook != "" {
+			b.srv.mu.Unlock()
+			reply(w, http.StatusConflict, nil, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first", 0)
+			return
+		}
+		b.confirm(offset)
+		result := []models.Update{}
+		for _, u := range b.updates {
+			if len(result) == limit {
+				break
+			}
+			if kindAllowed(u.Kind(), allowed) {
+				result = append(result, u)
+			}
+		}
+		arrived := b.arrived
+		b.srv.mu.Unlock()
+		if len(result) > 0 || wait == 0 {
+			reply(w, http.StatusOK, result, "", 0)
+			return
+		}
+		select {
+		case <-arrived:
+		case <-deadline:
+			wait = 0 // one last look before sending back empty
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// confirm : forgets the updates before the offset, caller has to hold the lock
+func (b *Bot) confirm(offset int64) {
+	if offset < 0 {
+		if keep := int(-offset); keep < len(b.updates) {
+			b.updates = b.updates[len(b.updates)-keep:]
+		}
+		return
+	}
+	kept := b.updates[:0]
+	for _, u := range b.updates {
+		if id, _ := u.UpdtID.Int64(); id >= offset {
+			kept = append(kept, u)
+		}
+	}
+	b.updates = kept
+}
+
+func kindAllowed(kind string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) sendMessage(w http.ResponseWriter, p map[string]string) {
+	chatID, err := strconv.ParseInt(p["chat_id"], 10, 64)
+	if err != nil {
+		reply(w, http.StatusBadRequest, nil, "Bad Request: chat not found", 0)
+		return
+	}
+	if p["text"] == "" {
+		reply(w, http.StatusBadRequest, nil, "Bad Request: message text is empty", 0)
+		return
+	}
+	b.srv.mu.Lock()
+	msg := SentMessage{
+		MessageID: b.nextMsg,
+		ChatID:    json.Number(strconv.FormatInt(chatID, 10)),
+		Text:      p["text"],
+		ParseMode: p["parse_mode"],
+		ReplyTo:   json.Number(p["reply_to_message_id"]),
+	}
+	if p["reply_markup"] != "" {
+		msg.Markup = json.RawMessage(p["reply_markup"])
+	}
+	b.nextMsg++
+	b.sent = append(b.sent, msg)
+	b.srv.mu.Unlock()
+	reply(w, http.StatusOK, map[string]interface{}{
+		"message_id": msg.MessageID,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]interface{}{"id": chatID, "type": "private"},
+		"text":       msg.Text,
+	}, "", 0)
+}
+
+func (b *Bot) getFile(w http.ResponseWriter, p map[string]string) {
+	b.srv.mu.Lock()
+	f, ok := b.files[p["file_id"]]
+	b.srv.mu.Unlock()
+	if !ok {
+		reply(w, http.StatusBadRequest, nil, "Bad Request: invalid file_id", 0)
+		return
+	}
+	reply(w, http.StatusOK, models.File{FileID: p["file_id"], FileUniqueID: "u" + p["file_id"], FileSize: int64(len(f.Content)), FilePath: f.Path}, "", 0)
+}
+
+// download : file by its path, as the file endpoint of the telegram server serves it
+func (s *Server) download(w http.ResponseWriter, token, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bots[token]
+	if !ok || b.revoked {
+		reply(w, http.StatusUnauthorized, nil, "Unauthorized", 0)
+		return
+	}
+	for _, f := range b.files {
+		if f.Path == path {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.Itoa(len(f.Content)))
+			w.Write(f.Content)
+			return
+		}
+	}
+	reply(w, http.StatusNotFound, nil, "Not Found", 0)
+}
@@ -0,0 +1,134 @@
+package telegramtest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eensymachines/tgramscraper/scrapers"
+	"github.com/eensymachines/tgramscraper/senders"
+	"github.com/eensymachines/tgramscraper/telegramtest"
+	"github.com/eensymachines/tgramscraper/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTok = "6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4"
+
+// getUpdates : raw call, for what the scraper doesnt send - limit, timeout, negative offsets
+func getUpdates(t *testing.T, srv *telegramtest.Server, query string) []json.RawMessage {
+	resp, err := http.Get(fmt.Sprintf("%s/bot%s/getUpdates?%s", srv.URL, testTok, query))
+	assert.Nil(t, err, "Unexpected error calling getUpdates")
+	defer resp.Body.Close()
+	body := struct {
+		OK     bool              `json:"ok"`
+		Result []json.RawMessage `json:"result"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body.Result
+}
+
+func TestGetUpdates(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	bot := srv.AddBot(testTok)
+	for i := 0; i < 5; i++ {
+		bot.PushText(5157350442, fmt.Sprintf("message %d", i))
+	}
+	scraper := &scrapers.TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Offset: "0", Registry: tokens.NewRotatingTokenRegistry(testTok)}
+	result, err := scraper.Scrape(scrapers.ScrapeConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Unexpected error scraping the fake server")
+	assert.Equal(t, 5, result.UpdateCount)
+	assert.Equal(t, "6", result.NextUpdateOffset)
+
+	// offset confirms all the updates before it
+	assert.Equal(t, 2, len(getUpdates(t, srv, "offset=4&limit=10")), "Expected updates from the offset")
+	assert.Equal(t, 2, len(bot.Pending()), "Expected updates before the offset forgotten")
+	assert.Equal(t, 1, len(getUpdates(t, srv, "limit=1")), "Expected limit honoured")
+	bot.PushText(5157350442, "late")
+	assert.Equal(t, 1, len(getUpdates(t, srv, "offset=-1")), "Negative offset gets only the last updates")
+	assert.Equal(t, 1, len(bot.Pending()), "Negative offset forgets the rest")
+
+	// long poll returns as soon as an update arrives
+	getUpdates(t, srv, "offset=7")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		bot.PushText(5157350442, "while polling")
+	}()
+	start := time.Now()
+	assert.Equal(t, 1, len(getUpdates(t, srv, "offset=7&timeout=3")), "Expected the update that arrived during the poll")
+	assert.Less(t, time.Since(start), 2*time.Second, "Long poll should return once the update arrives")
+	start = time.Now()
+	assert.Equal(t, 0, len(getUpdates(t, srv, "offset=9&timeout=1")), "Expected empty result after the timeout")
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "Long poll should wait for the timeout")
+}
+
+func TestFailures(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	bot := srv.AddBot(testTok)
+	bot.PushText(5157350442, "hello")
+	registry := tokens.NewRotatingTokenRegistry(testTok)
+	scraper := &scrapers.TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Offset: "0", Registry: registry}
+	sender := &senders.TelegramSender{UID: "6425245255", BaseUrl: srv.URL, Registry: registry}
+	config := scrapers.ScrapeConfig{RequestTimeout: 200 * time.Millisecond}
+
+	srv.Fail("sendMessage", telegramtest.TooManyRequests(7))
+	_, err := sender.Send(senders.OutboundMessage{ChatID: "5157350442", Text: "hi"}, senders.SendConfig{RequestTimeout: time.Second})
+	te, ok := senders.AsTelegramError(err)
+	assert.True(t, ok, "Expected a telegram error for 429")
+	assert.Equal(t, 7, te.RetryAfter, "Expected retry_after from the parameters")
+	result, err := sender.Send(senders.OutboundMessage{ChatID: "5157350442", Text: "hi"}, senders.SendConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Failure should be for the one call only")
+	assert.Equal(t, "5157350442", result.ChatID.String())
+	assert.Equal(t, "hi", bot.Sent()[0].Text, "Expected the message recorded")
+
+	srv.Fail("getUpdates", telegramtest.Malformed())
+	_, err = scraper.Scrape(config)
+	assert.NotNil(t, err, "Expected error for malformed json")
+	srv.Fail("getUpdates", telegramtest.Slow(time.Second))
+	_, err = scraper.Scrape(config)
+	assert.NotNil(t, err, "Expected the client to time out")
+	srv.Fail("getUpdates", telegramtest.Failure{Status: http.StatusBadGateway, Times: 2})
+	_, err = scraper.Scrape(config)
+	assert.NotNil(t, err)
+	_, err = scraper.Scrape(config)
+	assert.NotNil(t, err, "Expected failure for as many times as asked for")
+	_, err = scraper.Scrape(config)
+	assert.Nil(t, err, "Expected the server back to normal")
+	assert.Equal(t, 5, srv.Calls("getUpdates"), "Unexpected count of calls")
+
+	// webhook and getUpdates dont go together
+	resp, _ := http.Get(fmt.Sprintf("%s/bot%s/setWebhook?url=https://example.com/hook", srv.URL, testTok))
+	resp.Body.Close()
+	assert.Equal(t, "https://example.com/hook", bot.Webhook())
+	resp, _ = http.Get(fmt.Sprintf("%s/bot%s/getUpdates", srv.URL, testTok))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "Expected 409 while the webhook is set")
+	resp, _ = http.Get(fmt.Sprintf("%s/bot%s/deleteWebhook", srv.URL, testTok))
+	resp.Body.Close()
+	assert.Equal(t, "", bot.Webhook())
+
+	bot.Revoke()
+	_, err = scraper.Scrape(config)
+	assert.ErrorIs(t, err, scrapers.ErrTokenRevoked, "Expected 401 to revoke the token")
+}
+
+func TestFiles(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	bot := srv.AddBot(testTok)
+	bot.AddFile("AgADBAAD", []byte("not really a photo"))
+	scraper := &scrapers.TelegramScraper{UID: "6425245255", BaseUrl: srv.URL, Registry: tokens.NewRotatingTokenRegistry(testTok)}
+	body, _, file, err := scraper.OpenFile("AgADBAAD", 1<<20, scrapers.ScrapeConfig{RequestTimeout: time.Second})
+	assert.Nil(t, err, "Unexpected error opening the file")
+	defer body.Close()
+	byt, _ := io.ReadAll(body)
+	assert.Equal(t, "not really a photo", string(byt))
+	assert.Equal(t, int64(18), file.FileSize)
+
+	_, _, _, err = scraper.OpenFile("nosuchfile", 1<<20, scrapers.ScrapeConfig{RequestTimeout: time.Second})
+	assert.NotNil(t, err, "Expected error for an unknown file id")
+}
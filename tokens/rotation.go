@@ -0,0 +1,215 @@
+package tokens
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BotState is the health of the token currently registered against a bot
+type BotState string
+
+const (
+	StateActive  BotState = "active"  // token is good, as far as we know
+	StateRevoked BotState = "revoked" // telegram server has refused the token, BotFather has revoked it
+)
+
+// EventKind identifies what has changed in the registry
+type EventKind string
+
+const (
+	EvtTokenRevoked EventKind = "token_revoked" // current token was refused by the telegram server
+	EvtTokenStaged  EventKind = "token_staged"  // new token is pending alongside the current one
+	EvtTokenRotated EventKind = "token_rotated" // pending token has replaced the current one, old one retired
+)
+
+// RegistryEvent is raised each time the state of a bot in the registry changes.
+type RegistryEvent struct {
+	Kind EventKind `json:"kind"`
+	UID  string    `json:"uid"`
+	At   time.Time `json:"at"`
+}
+
+// BotStatus is the publicly visible state of a bot in the registry.
+// Tokens are never a part of the status, only the fact that a pending token is waiting.
+type BotStatus struct {
+	UID        string     `json:"uid"`
+	State      BotState   `json:"state"`
+	HasPending bool       `json:"has_pending"`          // a new token is staged, waiting to be rotated in
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"` // when was the current token refused
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"` // when was the last rotation
+}
+
+// ManagedRegistry is a TokenRegistry that also tracks the state of each token and lets tokens be rotated without a restart.
+// Rotation is in 3 steps: Stage the new token alongside the current one, try the new token, Promote it so the old one is retired.
+type ManagedRegistry interface {
+	TokenRegistry
+	Status(uid string) (BotStatus, bool) // state of a single bot
+	Statuses() []BotStatus               // state of all the bots, sorted by uid
+	Revoke(uid, tok string) bool         // marks the token revoked, only if tok is still the current token
+	Stage(tok string) error              // holds a new token as pending for an already registered bot
+	Pending(uid string) (string, bool)   // pending token, if any, for the bot
+	Promote(uid, old, tok string) error  // pending token tok replaces old as the current token, only if neither has changed
+	Subscribe(fn func(RegistryEvent))    // fn is called for every event the registry raises
+}
+
+// RotatingTokenRegistry is SimpleTokenRegistry with token state and pending tokens.
+// Safe for concurrent use, since tokens can now change while the scrapers are reading them.
+type RotatingTokenRegistry struct {
+	mu      sync.RWMutex
+	simple  *SimpleTokenRegistry
+	status  map[string]*BotStatus
+	pending map[string]string
+	subs    []func(RegistryEvent)
+}
+
+// NewRotatingTokenRegistry creates a RotatingTokenRegistry over the ManagedRegistry interface.
+// Tokens are parsed same as NewSimpleTokenRegistry and all of them start in the active state.
+func NewRotatingTokenRegistry(tokens ...string) ManagedRegistry {
+	simple := NewSimpleTokenRegistry(tokens...).(*SimpleTokenRegistry)
+	reg := &RotatingTokenRegistry{
+		simple:  simple,
+		status:  map[string]*BotStatus{},
+		pending: map[string]string{},
+	}
+	for uid := range simple.Data {
+		reg.status[uid] = &BotStatus{UID: uid, State: StateActive}
+	}
+	return reg
+}
+
+func (rtr *RotatingTokenRegistry) Count() int {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	return rtr.simple.Count()
+}
+
+func (rtr *RotatingTokenRegistry) Find(uid string) (string, bool) {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	return rtr.simple.Find(uid)
+}
+
+// snapshot : copy of the status for the outside world, caller has to hold the lock
+func (rtr *RotatingTokenRegistry) snapshot(uid string) BotStatus {
+	st := *rtr.status[uid]
+	_, st.HasPending = rtr.pending[uid]
+	return st
+}
+
+func (rtr *RotatingTokenRegistry) Status(uid string) (BotStatus, bool) {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	if _, ok := rtr.status[uid]; !ok {
+		return BotStatus{}, false
+	}
+	return rtr.snapshot(uid), true
+}
+
+func (rtr *RotatingTokenRegistry) Statuses() []BotStatus {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	result := make([]BotStatus, 0, len(rtr.status))
+	for uid := range rtr.status {
+		result = append(result, rtr.snapshot(uid))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UID < result[j].UID })
+	return result
+}
+
+// Revoke : marks the bot revoked when the telegram server refuses the token.
+// tok is the token that was refused, if the token has been rotated in the meantime this does nothing and returns false
+func (rtr *RotatingTokenRegistry) Revoke(uid, tok string) bool {
+	rtr.mu.Lock()
+	current, ok := rtr.simple.Data[uid]
+	if !ok || current != tok || rtr.status[uid].State == StateRevoked {
+		rtr.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	rtr.status[uid].State = StateRevoked
+	rtr.status[uid].RevokedAt = &now
+	rtr.mu.Unlock()
+	rtr.raise(EvtTokenRevoked, uid)
+	return true
+}
+
+// Stage : holds the new token as pending against the bot, current token continues to be in use.
+// Staging twice for the same bot replaces the earlier pending token.
+func (rtr *RotatingTokenRegistry) Stage(tok string) error {
+	if !tokenRegx.MatchString(tok) {
+		return fmt.Errorf("invalid token, does not conform to the bot token pattern")
+	}
+	uid := strings.Split(tok, ":")[0]
+	rtr.mu.Lock()
+	current, ok := rtr.simple.Data[uid]
+	if !ok {
+		rtr.mu.Unlock()
+		return fmt.Errorf("no bot with uid %s registered, only registered bots can rotate tokens", uid)
+	}
+	if current == tok {
+		rtr.mu.Unlock()
+		return fmt.Errorf("token is already the current token for bot %s", uid)
+	}
+	rtr.pending[uid] = tok
+	rtr.mu.Unlock()
+	rtr.raise(EvtTokenStaged, uid)
+	return nil
+}
+
+func (rtr *RotatingTokenRegistry) Pending(uid string) (string, bool) {
+	rtr.mu.RLock()
+	defer rtr.mu.RUnlock()
+	tok, ok := rtr.pending[uid]
+	return tok, ok
+}
+
+// Promote : pending token becomes the current token and the old one is retired, all under the same lock.
+// Compare and swap - old has to be still the current token and tok still the pending token, tried tokens are promoted and never what has been staged or rotated in since.
+// Bot is active after promotion, irrespective of the state of the old token.
+func (rtr *RotatingTokenRegistry) Promote(uid, old, tok string) error {
+	rtr.mu.Lock()
+	pending, ok := rtr.pending[uid]
+	if !ok {
+		rtr.mu.Unlock()
+		return fmt.Errorf("no pending token staged for bot %s", uid)
+	}
+	if pending != tok || rtr.simple.Data[uid] != old {
+		rtr.mu.Unlock()
+		return fmt.Errorf("tokens of bot %s have changed in the meantime, not promoted", uid)
+	}
+	now := time.Now()
+	rtr.simple.Data[uid] = tok
+	delete(rtr.pending, uid)
+	rtr.status[uid].State = StateActive
+	rtr.status[uid].RevokedAt = nil
+	rtr.status[uid].RotatedAt = &now
+	rtr.mu.Unlock()
+	rtr.raise(EvtTokenRotated, uid)
+	return nil
+}
+
+func (rtr *RotatingTokenRegistry) Subscribe(fn func(RegistryEvent)) {
+	rtr.mu.Lock()
+	defer rtr.mu.Unlock()
+	rtr.subs = append(rtr.subs, fn)
+}
+
+// raise : calls all the subscribers, outside the lock so subscribers can query the registry
+func (rtr *RotatingTokenRegistry) raise(kind EventKind, uid string) {
+	rtr.mu.RLock()
+	subs := append([]func(RegistryEvent){}, rtr.subs...)
+	rtr.mu.RUnlock()
+	evt := RegistryEvent{Kind: kind, UID: uid, At: time.Now()}
+	log.WithFields(log.Fields{
+		"kind": kind,
+		"uid":  uid,
+	}).Info("token registry event")
+	for _, fn := range subs {
+		fn(evt)
+	}
+}
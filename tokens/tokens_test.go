@@ -82,3 +82,44 @@ func TestCreateRegistry(t *testing.T) {
 	assert.Equal(t, 0, registry.Count(), "Unexpected non zero count of registeries")
 
 }
+
+func TestRotatingRegistry(t *testing.T) {
+	current := "6425245255:EGyHrU-i9MjCL5ZiTBl9k33UBH-o51-G5g4"
+	next := "6425245255:oOkCGb-FjTX43v4u4A2p1IOED0-oHZ-hMPt"
+	registry := tokens.NewRotatingTokenRegistry(current)
+	events := []tokens.EventKind{}
+	registry.Subscribe(func(evt tokens.RegistryEvent) {
+		events = append(events, evt.Kind)
+	})
+	st, ok := registry.Status("6425245255")
+	assert.True(t, ok, "Unexpected missing status for registered bot")
+	assert.Equal(t, tokens.StateActive, st.State, "Unexpected state for newly registered bot")
+
+	// TEST: staging tokens that do not belong to any registered bot
+	assert.NotNil(t, registry.Stage("7679837037:aePQBm-7cABKvZ7sOG6l1q21ha-5NB-2Sj2"), "Unexpected nil error staging token for unregistered bot")
+	assert.NotNil(t, registry.Stage("invalid"), "Unexpected nil error staging invalid token")
+	assert.NotNil(t, registry.Stage(current), "Unexpected nil error staging current token")
+
+	// TEST: revoking a token that isnt current does nothing
+	assert.False(t, registry.Revoke("6425245255", next), "Unexpected revocation of non current token")
+	assert.True(t, registry.Revoke("6425245255", current), "Unexpected failure to revoke current token")
+	assert.False(t, registry.Revoke("6425245255", current), "Unexpected repeat revocation")
+	st, _ = registry.Status("6425245255")
+	assert.Equal(t, tokens.StateRevoked, st.State, "Unexpected state after revocation")
+
+	// TEST: stage and promote the new token
+	assert.NotNil(t, registry.Promote("6425245255", current, next), "Unexpected nil error promoting without pending token")
+	assert.Nil(t, registry.Stage(next), "Unexpected error staging new token")
+	st, _ = registry.Status("6425245255")
+	assert.True(t, st.HasPending, "Unexpected status without pending token")
+	// TEST: promoting only what was tried, against the token it was tried in place of
+	assert.NotNil(t, registry.Promote("6425245255", current, "6425245255:aePQBm-7cABKvZ7sOG6l1q21ha-5NB-2Sj2"), "Unexpected promotion of a token that isnt pending")
+	assert.NotNil(t, registry.Promote("6425245255", next, next), "Unexpected promotion over a token that isnt current")
+	assert.Nil(t, registry.Promote("6425245255", current, next), "Unexpected error promoting pending token")
+	tok, _ := registry.Find("6425245255")
+	assert.Equal(t, next, tok, "Unexpected token after promotion")
+	st, _ = registry.Status("6425245255")
+	assert.Equal(t, tokens.StateActive, st.State, "Unexpected state after promotion")
+	assert.False(t, st.HasPending, "Unexpected pending token after promotion")
+	assert.Equal(t, []tokens.EventKind{tokens.EvtTokenRevoked, tokens.EvtTokenStaged, tokens.EvtTokenRotated}, events, "Unexpected events raised")
+}
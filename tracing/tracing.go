@@ -0,0 +1,104 @@
+// Tracing for the scraper, spans are exported over OTLP/http when configured by the standard OTEL env variables.
+
+// Trace context travels with W3C traceparent headers - in the http requests to the service and in the AMQP message headers
+// so consumers downstream can continue the trace.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/eensymachines/tgramscraper"
+
+// Tracer : tracer for all the packages in the service
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Enabled : tracing is exported only when the OTLP endpoint is set in the env.
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_SDK_DISABLED=true switches it off all the same
+func Enabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup : sets the global tracer provider and the W3C propagator.
+// When tracing isnt enabled the spans are not recorded, but the trace context from callers is still passed on downstream.
+// Rest of the exporter configuration (headers, insecure, timeout, sampler) is from the standard OTEL env variables.
+// Call the shutdown function before exiting so the pending spans are flushed
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %s", err)
+	}
+	// OTEL_SERVICE_NAME & OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %s", err)
+	}
+	envRes, _ := resource.New(ctx, resource.WithFromEnv())
+	if merged, err := resource.Merge(res, envRes); err == nil {
+		res = merged
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// AMQPCarrier : amqp message headers as the carrier for the trace context
+type AMQPCarrier amqp.Table
+
+func (ac AMQPCarrier) Get(key string) string {
+	if v, ok := ac[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (ac AMQPCarrier) Set(key, value string) {
+	ac[key] = value
+}
+
+func (ac AMQPCarrier) Keys() []string {
+	keys := make([]string, 0, len(ac))
+	for k := range ac {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectAMQP : trace context from ctx into the message headers.
+// Headers are copied before injecting, the caller's table is left as is
+func InjectAMQP(ctx context.Context, msg *amqp.Publishing) {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	otel.GetTextMapPropagator().Inject(ctx, AMQPCarrier(headers))
+	msg.Headers = headers
+}
+
+// ExtractAMQP : context carrying the trace context from the delivery headers, for consumers to continue the trace
+func ExtractAMQP(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, AMQPCarrier(headers))
+}
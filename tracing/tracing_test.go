@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestAMQPPropagation(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	shutdown, err := Setup(context.Background(), "test")
+	assert.Nil(t, err, "Unexpected error setting up tracing without an endpoint")
+	assert.Nil(t, shutdown(context.Background()), "Unexpected error shutting down")
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(tracetest.NewSpanRecorder()))
+	otel.SetTracerProvider(tp)
+	ctx, span := Tracer().Start(context.Background(), "publish")
+	defer span.End()
+
+	headers := amqp.Table{"x-app": "scraper"}
+	msg := amqp.Publishing{Headers: headers}
+	InjectAMQP(ctx, &msg)
+	assert.NotEmpty(t, msg.Headers["traceparent"], "Expected traceparent in the message headers")
+	assert.Equal(t, "scraper", msg.Headers["x-app"], "Existing headers should be carried over")
+	_, ok := headers["traceparent"]
+	assert.False(t, ok, "Caller's headers should be left as is")
+
+	got := trace.SpanContextFromContext(ExtractAMQP(context.Background(), msg.Headers))
+	assert.Equal(t, span.SpanContext().TraceID(), got.TraceID(), "Unexpected trace id on the consumer side")
+	assert.True(t, got.IsRemote(), "Extracted span context should be remote")
+
+	empty := ExtractAMQP(context.Background(), nil)
+	assert.False(t, trace.SpanContextFromContext(empty).IsValid(), "No trace expected without headers")
+}
+
+func TestEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	assert.True(t, Enabled(), "Expected tracing enabled with the endpoint set")
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	assert.False(t, Enabled(), "Expected tracing disabled by OTEL_SDK_DISABLED")
+}